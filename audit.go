@@ -0,0 +1,63 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/audit"
+)
+
+// runAudit verifies the hash chain of audit logs, given from the oldest.
+func runAudit(args []string) {
+	var prev string
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s audit [flags] FILE...\n\nVerifies the hash chain of audit logs, given from the oldest rotated file.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&prev, "prev-hash", "",
+		"hash of the record preceding the first record of the first file, when older files were rotated out; the first record of the log if empty.")
+	logFlag(fs)
+	klog.InitFlags(fs)
+	_ = fs.Parse(args)
+	setupLogging()
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	total := 0
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fatal(err, "Failed to open the audit log", "path", path)
+		}
+		var n int
+		prev, n, err = audit.Verify(f, prev)
+		f.Close()
+		total += n
+		if err != nil {
+			fatal(err, "Audit log failed verification", "path", path, "verified", total)
+		}
+	}
+
+	fmt.Printf("%d records verified, last hash %s\n", total, prev)
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/server"
+)
+
+// runBackfill clones the images of the workloads admitted before the
+// webhook existed, and patches them to use the backup registry.
+func runBackfill(args []string) {
+	var (
+		f     workloadFlags
+		qps   float64
+		burst int
+	)
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	f.register(fs, "backfill")
+	fs.Float64Var(&qps, "qps", 1,
+		"number of workloads cloned and patched per second.")
+	fs.IntVar(&burst, "burst", 1,
+		"number of workloads cloned and patched in a burst.")
+	cloneFlags(fs)
+	leaseFlag(fs)
+	logFlag(fs)
+	klog.InitFlags(fs)
+	_ = fs.Parse(args)
+	setupLogging()
+
+	cs, err := kube.NewClient(f.kubeconfig)
+	if err != nil {
+		fatal(err, "Failed to create the Kubernetes client")
+	}
+
+	dyn, err := kube.NewDynamicClient(f.kubeconfig)
+	if err != nil {
+		fatal(err, "Failed to create the Kubernetes client")
+	}
+
+	c := server.Config{
+		WorkloadsFile:  f.workloadsFile,
+		PinDigest:      pinDigest,
+		TagConflict:    tagConflict,
+		LeaseNamespace: leaseNamespace,
+
+		KeepLocalImages: keepLocalImages,
+	}
+	report, err := server.Backfill(context.Background(), c, cs, dyn, server.BackfillOptions{
+		Namespace: f.namespace,
+		Selector:  f.selector,
+		QPS:       float32(qps),
+		Burst:     burst,
+		DryRun:    f.dryRun,
+	})
+	if err != nil {
+		fatal(err, "Backfill failed")
+	}
+
+	suffix := ""
+	if f.dryRun {
+		suffix = " (dry run)"
+	}
+
+	for _, r := range report.Results {
+		if r.Err != nil {
+			fmt.Printf("%s %s/%s failed: %v\n", r.Kind, r.Namespace, r.Name, r.Err)
+			continue
+		}
+		fmt.Printf("%s %s/%s backfilled%s: %s\n", r.Kind, r.Namespace, r.Name, suffix, strings.Join(r.Images, ", "))
+	}
+	fmt.Printf("patched: %d, skipped: %d, failed: %d%s\n", report.Patched, report.Skipped, report.Failed, suffix)
+
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
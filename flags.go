@@ -0,0 +1,93 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/gauravgahlot/image-cloner/internal/gc"
+	"github.com/gauravgahlot/image-cloner/internal/logging"
+	"github.com/gauravgahlot/image-cloner/internal/server"
+)
+
+// workloadFlags select the workloads a subcommand operates on.
+type workloadFlags struct {
+	kubeconfig    string
+	workloadsFile string
+	namespace     string
+	selector      string
+	dryRun        bool
+}
+
+func (f *workloadFlags) register(fs *flag.FlagSet, verb string) {
+	fs.StringVar(&f.kubeconfig, "kubeconfig", "",
+		"path to the kubeconfig file; the in-cluster configuration is used if empty.")
+	fs.StringVar(&f.workloadsFile, "workloads-config", "",
+		"file registering additional kinds, as passed to the webhook, whose objects are "+verb+"ed too.")
+	fs.StringVar(&f.namespace, "namespace", "",
+		"namespace of the workloads to "+verb+"; all namespaces if empty.")
+	fs.StringVar(&f.selector, "selector", "",
+		"label selector of the workloads to "+verb+".")
+	fs.BoolVar(&f.dryRun, "dry-run", false,
+		"print the workloads that would be "+verb+"ed without patching them.")
+}
+
+// cloneFlags registers the flags that configure how images are cloned.
+func cloneFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&pinDigest, "pin-digest", false,
+		"rewrite images to the digest of the backup instead of its tag.")
+	fs.StringVar(&tagConflict, "tag-conflict", string(server.TagConflictOverwrite),
+		"what to do when a backup tag exists with a different image: overwrite, keep or refuse.")
+	fs.BoolVar(&keepLocalImages, "keep-local-images", false,
+		"keep the images pulled and tagged for cloning in the local Docker daemon instead of removing them once pushed.")
+}
+
+func logFlag(fs *flag.FlagSet) {
+	fs.StringVar(&logFormat, "log-format", logging.Text,
+		"format of the logs: text, or json to write each line as a JSON object with its key/value pairs as fields.")
+}
+
+func leaseFlag(fs *flag.FlagSet) {
+	fs.StringVar(&leaseNamespace, "lease-namespace", "",
+		"namespace of the Leases used to elect a leader and lock images across replicas; replicas do not coordinate if empty.")
+}
+
+func gcFlags(fs *flag.FlagSet, prefix string, opts *gc.Options) {
+	fs.Var((*listFlag)(&opts.Repositories), prefix+"repository",
+		"backup repository to collect, such as alpine; may be repeated or comma-separated. All the repositories in the catalog of the backup registry if empty.")
+	fs.Var((*listFlag)(&opts.Protected), prefix+"protect",
+		"pattern of tags that are never deleted, such as latest or v*; may be repeated or comma-separated.")
+	fs.DurationVar(&opts.KeepWithin, prefix+"keep-within", 0,
+		"keep the tags pushed within the duration; requires a lease namespace, where the webhook records the push times.")
+	fs.IntVar(&opts.KeepLast, prefix+"keep-last", 0,
+		"keep the given number of most recently created tags of each repository.")
+}
+
+// listFlag is a flag that may be repeated, or given a comma-separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/gc"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/server"
+)
+
+// runGC deletes the backups that are no longer used by any workload, and
+// prints what it kept and deleted.
+func runGC(args []string) {
+	var (
+		kubeconfig    string
+		workloadsFile string
+		opts          gc.Options
+	)
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	fs.StringVar(&kubeconfig, "kubeconfig", "",
+		"path to the kubeconfig file; the in-cluster configuration is used if empty.")
+	fs.StringVar(&workloadsFile, "workloads-config", "",
+		"file registering additional kinds, as passed to the webhook, so that the backups they use are kept.")
+	fs.BoolVar(&opts.DryRun, "dry-run", false,
+		"print the tags that would be deleted without deleting them.")
+	gcFlags(fs, "", &opts)
+	leaseFlag(fs)
+	logFlag(fs)
+	klog.InitFlags(fs)
+	_ = fs.Parse(args)
+	setupLogging()
+
+	cs, err := kube.NewClient(kubeconfig)
+	if err != nil {
+		fatal(err, "Failed to create the Kubernetes client")
+	}
+
+	dyn, err := kube.NewDynamicClient(kubeconfig)
+	if err != nil {
+		fatal(err, "Failed to create the Kubernetes client")
+	}
+
+	report, err := server.GC(context.Background(), server.Config{WorkloadsFile: workloadsFile, LeaseNamespace: leaseNamespace}, cs, dyn, opts)
+	if err != nil {
+		fatal(err, "Garbage collection failed")
+	}
+
+	suffix := ""
+	if opts.DryRun {
+		suffix = " (dry run)"
+	}
+
+	for _, t := range report.Kept {
+		fmt.Printf("%s:%s kept: %s\n", t.Repository, t.Tag, t.Reason)
+	}
+	for _, t := range report.Deleted {
+		fmt.Printf("%s:%s deleted%s: %s\n", t.Repository, t.Tag, suffix, t.Digest)
+	}
+	for _, err := range report.Errors {
+		fmt.Printf("error: %v\n", err)
+	}
+	fmt.Printf("kept: %d, deleted: %d, errors: %d%s\n", len(report.Kept), len(report.Deleted), len(report.Errors), suffix)
+
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
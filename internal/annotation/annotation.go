@@ -0,0 +1,64 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package annotation
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// OriginalImages is the annotation recording the images of a workload
+// before they were rewritten to the backup registry.
+const OriginalImages = "image-cloner.io/original-images"
+
+// ResyncPolicy is the namespace annotation overriding what happens to the
+// workloads of the namespace when the source of their backup moves: "off",
+// "backup" or "rollout".
+const ResyncPolicy = "image-cloner.io/resync"
+
+// Original is the image a container used before it was rewritten.
+type Original struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+
+	// Path is the JSON pointer to the image in the object. Annotations
+	// recorded before it was stored have none, in which case the image is
+	// that of the container in the pod template.
+	Path string `json:"path,omitempty"`
+}
+
+// Decode returns the original images recorded in annotations, keyed by
+// container name. It returns an empty map if none are recorded.
+func Decode(annotations map[string]string) (map[string]Original, error) {
+	originals := map[string]Original{}
+	value, ok := annotations[OriginalImages]
+	if !ok {
+		return originals, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &originals); err != nil {
+		return map[string]Original{}, fmt.Errorf("invalid %s annotation: %v", OriginalImages, err)
+	}
+	return originals, nil
+}
+
+// Encode returns the value of the OriginalImages annotation for originals.
+func Encode(originals map[string]Original) (string, error) {
+	value, err := json.Marshal(originals)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
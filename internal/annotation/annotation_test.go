@@ -0,0 +1,67 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package annotation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	cases := map[string]struct {
+		annotations map[string]string
+		want        map[string]Original
+		err         bool
+	}{
+		"none": {
+			annotations: nil,
+			want:        map[string]Original{},
+		},
+		"recorded": {
+			annotations: map[string]string{
+				OriginalImages: `{"app":{"image":"alpine:3.12","digest":"sha256:abc"},"sidecar":{"image":"busybox:1.33"}}`,
+			},
+			want: map[string]Original{
+				"app":     {Image: "alpine:3.12", Digest: "sha256:abc"},
+				"sidecar": {Image: "busybox:1.33"},
+			},
+		},
+		"invalid": {
+			annotations: map[string]string{OriginalImages: "alpine:3.12"},
+			want:        map[string]Original{},
+			err:         true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := Decode(tc.annotations)
+			assert.Equal(t, tc.err, err != nil)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	originals := map[string]Original{"app": {Image: "alpine:3.12", Digest: "sha256:abc"}}
+
+	value, err := Encode(originals)
+	assert.NoError(t, err)
+
+	got, err := Decode(map[string]string{OriginalImages: value})
+	assert.NoError(t, err)
+	assert.Equal(t, originals, got)
+}
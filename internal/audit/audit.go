@@ -0,0 +1,338 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit writes the decisions of the webhook on the images of the
+// admitted objects to an append-only JSON-lines file. Each record may be
+// chained to the previous one by its hash, so that a record that was
+// modified, removed or inserted is detected.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Decision of the webhook on an image.
+type Decision string
+
+// Decisions on an image.
+const (
+	// Rewritten images were cloned, and replaced by their backup.
+	Rewritten Decision = "rewritten"
+	// Skipped images were left as they are.
+	Skipped Decision = "skipped"
+	// Denied images could not be cloned, and their object was rejected.
+	Denied Decision = "denied"
+)
+
+// User is the user who sent the admitted object.
+type User struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// Record is the decision of the webhook on an image of an admitted object.
+type Record struct {
+	Time      time.Time `json:"time"`
+	UID       string    `json:"uid"`
+	User      User      `json:"user"`
+	Operation string    `json:"operation"`
+
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Container string `json:"container,omitempty"`
+
+	// OldImage is the image of the container, NewImage the backup it was
+	// replaced by, and Digest the digest of the image that was cloned.
+	OldImage string `json:"oldImage,omitempty"`
+	NewImage string `json:"newImage,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+
+	Decision Decision `json:"decision"`
+	Reason   string   `json:"reason,omitempty"`
+
+	// PrevHash is the hash of the previous record, and Hash the hash of this
+	// one, when the records are chained.
+	PrevHash string `json:"prevHash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Defaults of Options.
+const (
+	DefaultMaxSize    = 100 << 20
+	DefaultMaxBackups = 5
+)
+
+// Options configures a Log.
+type Options struct {
+	// Path of the file the records are appended to.
+	Path string
+
+	// MaxSize is the size in bytes above which the file is rotated: it is
+	// renamed to Path.1, the previous Path.1 to Path.2, and so on, keeping
+	// MaxBackups of them.
+	MaxSize    int64
+	MaxBackups int
+
+	// HashChain chains each record to the previous one by its hash,
+	// including across rotations.
+	HashChain bool
+}
+
+// Log appends records to a file.
+type Log struct {
+	opts Options
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	prev string
+}
+
+// Open opens the file at opts.Path to append records to it, creating it
+// if it does not exist. A chained Log continues from the last record of
+// the file. Options left zero take their default.
+func Open(opts Options) (*Log, error) {
+	if opts.Path == "" {
+		return nil, errors.New("audit log path is required")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = DefaultMaxBackups
+	}
+
+	l := &Log{opts: opts}
+	if opts.HashChain {
+		prev, err := lastHash(opts.Path)
+		if err != nil {
+			return nil, err
+		}
+		l.prev = prev
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Write appends r to the log, and syncs the file so that the record
+// outlives a crash.
+func (l *Log) Write(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	r.PrevHash, r.Hash = "", ""
+	if l.opts.HashChain {
+		r.PrevHash = l.prev
+		hash, err := hashOf(r)
+		if err != nil {
+			return err
+		}
+		r.Hash = hash
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.prev = r.Hash
+	return nil
+}
+
+// rotate renames the file to Path.1, shifting the previous backups and
+// removing the oldest, and opens a new file.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	for i := l.opts.MaxBackups; i > 0; i-- {
+		src := l.opts.Path
+		if i > 1 {
+			src = backup(l.opts.Path, i-1)
+		}
+		err := os.Rename(src, backup(l.opts.Path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// Close closes the file of the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Backups returns the paths of the rotated files of the log at path, from
+// the oldest; the records were written in the order of the backups, and
+// then of path.
+func Backups(path string, maxBackups int) []string {
+	var paths []string
+	for i := maxBackups; i > 0; i-- {
+		if _, err := os.Stat(backup(path, i)); err == nil {
+			paths = append(paths, backup(path, i))
+		}
+	}
+	return paths
+}
+
+func backup(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// hashOf returns the hex SHA-256 of r without its hash, which covers the
+// hash of the previous record.
+func hashOf(r Record) (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastHash returns the hash of the last record in the file at path; empty
+// if the file does not exist or has no record.
+func lastHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var last []byte
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if last == nil {
+		return "", nil
+	}
+
+	var r Record
+	if err := json.Unmarshal(last, &r); err != nil {
+		return "", fmt.Errorf("invalid last record of audit log %s: %v", path, err)
+	}
+	return r.Hash, nil
+}
+
+// VerifyError locates the first record that breaks the hash chain.
+type VerifyError struct {
+	// Line of the record in the verified reader, counted from 1.
+	Line int
+	Err  error
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Verify checks the hash chain of the records read from r, the first of
+// which follows the record whose hash is prev; empty for the first record
+// of the log. It returns the hash of the last record verified, and the
+// number of records verified.
+func Verify(r io.Reader, prev string) (string, int, error) {
+	line, n := 0, 0
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return prev, n, VerifyError{line, err}
+		}
+		if rec.PrevHash != prev {
+			return prev, n, VerifyError{line, fmt.Errorf("previous hash %q does not match %q", rec.PrevHash, prev)}
+		}
+		hash, err := hashOf(rec)
+		if err != nil {
+			return prev, n, VerifyError{line, err}
+		}
+		if rec.Hash != hash {
+			return prev, n, VerifyError{line, fmt.Errorf("hash %q does not match the record", rec.Hash)}
+		}
+		prev = rec.Hash
+		n++
+	}
+	return prev, n, scanner.Err()
+}
+
+// newScanner returns a scanner of the lines of r, allowing records larger
+// than the default buffer.
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	return scanner
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func record(container string) Record {
+	return Record{
+		UID:       "4584308f-b307-455b-ab11-5765b4548b71",
+		User:      User{Username: "minikube-user", Groups: []string{"system:masters", "system:authenticated"}},
+		Operation: "CREATE",
+		Kind:      "Deployment",
+		Namespace: "default",
+		Name:      "alpine",
+		Container: container,
+		OldImage:  "alpine:3.12",
+		NewImage:  "gauravgahlot/alpine:3.12",
+		Digest:    "sha256:d9a7354e3845ea8466bb00b22224d9116b183e594527fb5b6c3d30bc01a20378",
+		Decision:  Rewritten,
+	}
+}
+
+func readLines(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestLogHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(Options{Path: path, HashChain: true})
+	assert.NoError(t, err)
+	for _, c := range []string{"alpine", "sidecar"} {
+		assert.NoError(t, l.Write(record(c)))
+	}
+	assert.NoError(t, l.Close())
+
+	// A reopened log continues the chain.
+	l, err = Open(Options{Path: path, HashChain: true})
+	assert.NoError(t, err)
+	assert.NoError(t, l.Write(record("init")))
+	assert.NoError(t, l.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	last, n, err := Verify(bytes.NewReader(data), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, l.prev, last)
+
+	lines := readLines(t, path)
+	cases := map[string]struct {
+		lines []string
+		line  int
+	}{
+		"modified":  {lines: []string{lines[0], strings.Replace(lines[1], "gauravgahlot/alpine", "evil/alpine", 1), lines[2]}, line: 2},
+		"removed":   {lines: []string{lines[0], lines[2]}, line: 2},
+		"inserted":  {lines: []string{lines[0], lines[0], lines[1], lines[2]}, line: 2},
+		"reordered": {lines: []string{lines[1], lines[0], lines[2]}, line: 1},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := Verify(strings.NewReader(strings.Join(tc.lines, "\n")), "")
+			var verr VerifyError
+			assert.True(t, errors.As(err, &verr), "%v", err)
+			assert.Equal(t, tc.line, verr.Line)
+		})
+	}
+}
+
+func TestLogWithoutHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(Options{Path: path})
+	assert.NoError(t, err)
+	assert.NoError(t, l.Write(record("alpine")))
+	assert.NoError(t, l.Close())
+
+	lines := readLines(t, path)
+	assert.Len(t, lines, 1)
+	assert.NotContains(t, lines[0], "hash")
+	assert.Contains(t, lines[0], `"decision":"rewritten"`)
+	assert.Contains(t, lines[0], `"username":"minikube-user"`)
+}
+
+func TestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(Options{Path: path, MaxSize: 1500, MaxBackups: 2, HashChain: true})
+	assert.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, l.Write(record("alpine")))
+	}
+	assert.NoError(t, l.Close())
+
+	// Each file holds at most two records of about 600 bytes, and the
+	// oldest backup was removed.
+	backups := Backups(path, 2)
+	assert.Equal(t, []string{path + ".2", path + ".1"}, backups)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// The chain continues across the files kept, from the first record
+	// kept.
+	var first Record
+	data, err := ioutil.ReadFile(backups[0])
+	assert.NoError(t, err)
+	assert.NoError(t, jsonFirst(data, &first))
+
+	prev, total := first.PrevHash, 0
+	for _, p := range append(backups, path) {
+		data, err := ioutil.ReadFile(p)
+		assert.NoError(t, err)
+		var n int
+		prev, n, err = Verify(bytes.NewReader(data), prev)
+		assert.NoError(t, err, p)
+		total += n
+	}
+	assert.Equal(t, 5, total)
+}
+
+func jsonFirst(data []byte, r *Record) error {
+	return json.Unmarshal(bytes.SplitN(data, []byte("\n"), 2)[0], r)
+}
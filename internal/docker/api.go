@@ -27,9 +27,39 @@ import (
 
 // Client defines the operations that can be performed with a Docker client.
 type Client interface {
+	// ImagePull and ImagePush report the progress of each layer to the
+	// ProgressFunc set by WithProgress on ctx, if any.
 	ImagePull(ctx context.Context, image string) error
-	ImagePush(ctx context.Context, image string) error
+	ImagePush(ctx context.Context, image string) (string, error)
 	ImageTag(ctx context.Context, src, dst string) error
+	ImageInspect(ctx context.Context, image string) (Image, error)
+
+	// ImageExists reports whether the daemon has a reference to image.
+	ImageExists(ctx context.Context, image string) (bool, error)
+
+	// ImageRemove removes the reference to image, and the image itself if
+	// no other reference to it remains.
+	ImageRemove(ctx context.Context, image string) error
+
+	// DiskUsage returns the size of the image layers stored by the daemon.
+	DiskUsage(ctx context.Context) (int64, error)
+
+	// Platform returns the platform of the daemon, as os/arch, which is
+	// the image it pulls from an index.
+	Platform(ctx context.Context) (string, error)
+}
+
+// Image describes an image in the local Docker daemon.
+type Image struct {
+	// ID is the digest of the image config.
+	ID string
+
+	// Digest is the digest the registry reported when the image was pulled;
+	// empty if it was not pulled from a registry.
+	Digest string
+
+	// Platform is the platform of the image, as os/arch[/variant].
+	Platform string
 }
 
 type docker struct {
@@ -68,10 +98,15 @@ func RegistryUser() string {
 	return readData("/auth/username")
 }
 
+// RegistryPassword returns the password for provided container registry
+func RegistryPassword() string {
+	return readData(pswdPath)
+}
+
 func readData(src string) string {
 	data, err := ioutil.ReadFile(src)
 	if err != nil {
-		klog.Errorf("[error]: error reading data from source: %s\n%v", src, err)
+		klog.ErrorS(err, "Failed to read registry credentials", "path", src)
 		return ""
 	}
 	return string(data)
@@ -20,14 +20,21 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"time"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
 )
 
-func (d *docker) ImagePull(ctx context.Context, image string) error {
-	res, err := d.client.ImagePull(context.Background(), image, types.ImagePullOptions{})
+func (d *docker) ImagePull(ctx context.Context, image string) (err error) {
+	defer observe("pull", time.Now(), &err)
+
+	res, err := d.client.ImagePull(ctx, image, types.ImagePullOptions{})
 	if res != nil {
 		defer res.Close()
 	}
@@ -35,14 +42,18 @@ func (d *docker) ImagePull(ctx context.Context, image string) error {
 		return err
 	}
 
-	if err = d.watch(res); err != nil {
+	if err = d.watch(ctx, "pull", image, res, nil); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (d *docker) ImagePush(ctx context.Context, image string) error {
-	res, err := d.client.ImagePush(context.Background(), image,
+// ImagePush pushes image and returns the digest of the manifest the
+// registry stored.
+func (d *docker) ImagePush(ctx context.Context, image string) (_ string, err error) {
+	defer observe("push", time.Now(), &err)
+
+	res, err := d.client.ImagePush(ctx, image,
 		types.ImagePushOptions{
 			RegistryAuth: d.registryAuth,
 		})
@@ -50,32 +61,149 @@ func (d *docker) ImagePush(ctx context.Context, image string) error {
 		defer res.Close()
 	}
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if err = d.watch(res); err != nil {
+	var digest string
+	err = d.watch(ctx, "push", image, res, func(aux *json.RawMessage) {
+		var result types.PushResult
+		if err := json.Unmarshal(*aux, &result); err == nil && result.Digest != "" {
+			digest = result.Digest
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+func (d *docker) ImageTag(ctx context.Context, src, dst string) (err error) {
+	defer observe("tag", time.Now(), &err)
+
+	err = d.client.ImageTag(ctx, src, dst)
+	if err != nil {
 		return err
 	}
+
+	klog.FromContext(ctx).Info("Tagged image", "source", src, "destination", dst)
 	return nil
 }
 
-func (d *docker) ImageTag(ctx context.Context, src, dst string) error {
-	err := d.client.ImageTag(context.Background(), src, dst)
+func (d *docker) ImageInspect(ctx context.Context, image string) (Image, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return Image{}, err
+	}
+
+	inspect, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return Image{}, err
+	}
+
+	img := Image{ID: inspect.ID, Platform: inspect.Os + "/" + inspect.Architecture}
+	if inspect.Variant != "" {
+		img.Platform += "/" + inspect.Variant
+	}
+	for _, rd := range inspect.RepoDigests {
+		ref, err := reference.ParseNormalizedNamed(rd)
+		if err != nil {
+			continue
+		}
+		if c, ok := ref.(reference.Canonical); ok && ref.Name() == named.Name() {
+			img.Digest = c.Digest().String()
+			break
+		}
+	}
+	return img, nil
+}
+
+func (d *docker) ImageExists(ctx context.Context, image string) (bool, error) {
+	_, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *docker) ImageRemove(ctx context.Context, image string) error {
+	_, err := d.client.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true})
+	if client.IsErrNotFound(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	klog.Infof("[info]: '%s' successfully tagged as '%s'\n", src, dst)
+	klog.FromContext(ctx).Info("Removed image", "image", image)
 	return nil
 }
 
-func (d *docker) watch(in io.Reader) error {
+func (d *docker) DiskUsage(ctx context.Context) (int64, error) {
+	du, err := d.client.DiskUsage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return du.LayersSize, nil
+}
+
+func (d *docker) Platform(ctx context.Context) (string, error) {
+	v, err := d.client.ServerVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	return v.Os + "/" + v.Arch, nil
+}
+
+// observe records how long operation took since start, and whether *err
+// is nil.
+func observe(operation string, start time.Time, err *error) {
+	result := "success"
+	if *err != nil {
+		result = "error"
+	}
+	metrics.DockerDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// watch logs the progress of a pull or push of image, reports the progress
+// of each layer to the ProgressFunc of ctx, and passes the auxiliary
+// messages, such as the result of a push, to aux if it is not nil. The size
+// of the layers transferred is added to the bytes of operation. in is
+// closed, and ctx.Err() returned, once ctx is done.
+func (d *docker) watch(ctx context.Context, operation, image string, in io.ReadCloser, aux func(*json.RawMessage)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			in.Close()
+		case <-done:
+		}
+	}()
+
 	dec := json.NewDecoder(in)
 	status := ""
+	progress := ProgressFrom(ctx)
+
+	// The size of each layer is reported by its progress messages; layers
+	// the daemon or registry already has report none.
+	sizes := map[string]int64{}
+	defer func() {
+		var total int64
+		for _, n := range sizes {
+			total += n
+		}
+		metrics.DockerBytes.WithLabelValues(operation).Add(float64(total))
+	}()
 
 	for {
 		var jm jsonmessage.JSONMessage
 		if err := dec.Decode(&jm); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if err == io.EOF {
 				break
 			}
@@ -87,9 +215,22 @@ func (d *docker) watch(in io.Reader) error {
 		if len(jm.ErrorMessage) > 0 {
 			return errors.New(jm.ErrorMessage)
 		}
+		if jm.Aux != nil && aux != nil {
+			aux(jm.Aux)
+		}
+		if jm.ID != "" && jm.Progress != nil && jm.Progress.Total > sizes[jm.ID] {
+			sizes[jm.ID] = jm.Progress.Total
+		}
+		if jm.ID != "" {
+			p := Progress{Operation: operation, Image: image, Layer: jm.ID, Status: jm.Status}
+			if jm.Progress != nil {
+				p.Current, p.Total = jm.Progress.Current, jm.Progress.Total
+			}
+			progress(p)
+		}
 
 		if jm.Status != "" && !strings.EqualFold(status, jm.Status) {
-			klog.Infof("[info]: %v\n", jm.Status)
+			klog.FromContext(ctx).Info("Docker progress", "operation", operation, "status", jm.Status)
 			status = jm.Status
 		}
 	}
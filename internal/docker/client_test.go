@@ -0,0 +1,85 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+)
+
+func TestWatch(t *testing.T) {
+	in := strings.Join([]string{
+		`{"status":"The push refers to repository [docker.io/gauravgahlot/alpine]"}`,
+		`{"status":"Preparing","id":"8d3ac3489996"}`,
+		`{"status":"Pushing","progressDetail":{"current":512,"total":2048},"id":"8d3ac3489996"}`,
+		`{"status":"Pushing","progressDetail":{"current":2048,"total":2048},"id":"8d3ac3489996"}`,
+		`{"status":"Pushed","progressDetail":{},"id":"8d3ac3489996"}`,
+		`{"status":"Layer already exists","progressDetail":{},"id":"5d20c808ce19"}`,
+		`{"status":"3.12: digest: sha256:a9c2 size: 528"}`,
+		`{"progressDetail":{},"aux":{"Tag":"3.12","Digest":"sha256:a9c2","Size":528}}`,
+	}, "\n")
+
+	before := testutil.ToFloat64(metrics.DockerBytes.WithLabelValues("push"))
+
+	progress := []Progress{}
+	ctx := WithProgress(context.Background(), func(p Progress) { progress = append(progress, p) })
+
+	var digest string
+	err := (&docker{}).watch(ctx, "push", "gauravgahlot/alpine:3.12", ioutil.NopCloser(strings.NewReader(in)), func(aux *json.RawMessage) {
+		var result types.PushResult
+		if err := json.Unmarshal(*aux, &result); err == nil {
+			digest = result.Digest
+		}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:a9c2", digest)
+	assert.Equal(t, 2048.0, testutil.ToFloat64(metrics.DockerBytes.WithLabelValues("push"))-before)
+
+	// Only the messages of a layer are reported.
+	assert.Len(t, progress, 5)
+	assert.Equal(t, Progress{
+		Operation: "push", Image: "gauravgahlot/alpine:3.12", Layer: "8d3ac3489996", Status: "Pushing", Current: 512, Total: 2048,
+	}, progress[1])
+	assert.Equal(t, Progress{
+		Operation: "push", Image: "gauravgahlot/alpine:3.12", Layer: "5d20c808ce19", Status: "Layer already exists",
+	}, progress[4])
+
+	err = (&docker{}).watch(context.Background(), "pull", "alpine:3.12", ioutil.NopCloser(strings.NewReader(`{"errorDetail":{"message":"not found"},"error":"not found"}`)), nil)
+	assert.EqualError(t, err, "not found")
+}
+
+func TestWatchCanceled(t *testing.T) {
+	r, w := io.Pipe()
+	go func() {
+		_, _ = w.Write([]byte(`{"status":"Preparing","id":"8d3ac3489996"}`))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = WithProgress(ctx, func(p Progress) { cancel() })
+
+	// The stream is still open, but is no longer read once ctx is done.
+	err := (&docker{}).watch(ctx, "push", "gauravgahlot/alpine:3.12", r, nil)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import "context"
+
+// Progress is the progress of a layer of an image pulled or pushed.
+type Progress struct {
+	// Operation is pull or push.
+	Operation string `json:"operation"`
+	Image     string `json:"image"`
+	Layer     string `json:"layer"`
+	Status    string `json:"status"`
+
+	// Current and Total are the bytes of the layer transferred so far, and
+	// its size; zero when the status reports no transfer.
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+}
+
+// ProgressFunc receives the progress of the layers pulled or pushed. It
+// must not block.
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx in which pulls and pushes report the
+// progress of their layers to fn.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// ProgressFrom returns the ProgressFunc of ctx, or one doing nothing. Each
+// implementation of Client reports the progress of its pulls and pushes to
+// it.
+func ProgressFrom(ctx context.Context) ProgressFunc {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok {
+		return fn
+	}
+	return func(Progress) {}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"context"
+
+	"github.com/gauravgahlot/image-cloner/internal/tracing"
+)
+
+// Traced returns a Client recording a span for each call to c.
+func Traced(c Client) Client {
+	return traced{c: c}
+}
+
+type traced struct {
+	c Client
+}
+
+func (t traced) ImagePull(ctx context.Context, image string) (err error) {
+	ctx, span := tracing.Start(ctx, "docker.ImagePull", tracing.Image.String(image))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ImagePull(ctx, image)
+}
+
+func (t traced) ImagePush(ctx context.Context, image string) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "docker.ImagePush", tracing.Image.String(image))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ImagePush(ctx, image)
+}
+
+func (t traced) ImageTag(ctx context.Context, src, dst string) (err error) {
+	ctx, span := tracing.Start(ctx, "docker.ImageTag", tracing.Source.String(src), tracing.Destination.String(dst))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ImageTag(ctx, src, dst)
+}
+
+func (t traced) ImageInspect(ctx context.Context, image string) (_ Image, err error) {
+	ctx, span := tracing.Start(ctx, "docker.ImageInspect", tracing.Image.String(image))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ImageInspect(ctx, image)
+}
+
+func (t traced) ImageExists(ctx context.Context, image string) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "docker.ImageExists", tracing.Image.String(image))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ImageExists(ctx, image)
+}
+
+func (t traced) ImageRemove(ctx context.Context, image string) (err error) {
+	ctx, span := tracing.Start(ctx, "docker.ImageRemove", tracing.Image.String(image))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ImageRemove(ctx, image)
+}
+
+func (t traced) DiskUsage(ctx context.Context) (_ int64, err error) {
+	ctx, span := tracing.Start(ctx, "docker.DiskUsage")
+	defer func() { tracing.End(span, err) }()
+	return t.c.DiskUsage(ctx)
+}
+
+func (t traced) Platform(ctx context.Context) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "docker.Platform")
+	defer func() { tracing.End(span, err) }()
+	return t.c.Platform(ctx)
+}
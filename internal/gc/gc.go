@@ -0,0 +1,299 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gc deletes the backups that are no longer used by any workload.
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+// Reasons a tag is kept.
+const (
+	InUse      = "in use"
+	Protected  = "protected"
+	Recent     = "pushed recently"
+	Retained   = "within retention window"
+	KeptLast   = "among the most recent tags"
+	SharedWith = "shares its manifest with a kept tag"
+	Unreadable = "manifest could not be read"
+)
+
+// Options selects the backups that are kept.
+type Options struct {
+	// Repositories to collect. Each is the name of a repository in the
+	// backup registry.
+	Repositories []string
+
+	// Protected are path.Match patterns of tags that are never deleted,
+	// such as "latest" or "v*".
+	Protected []string
+
+	// KeepWithin keeps the tags pushed within the duration.
+	KeepWithin time.Duration
+
+	// Grace keeps the tags pushed within the duration whatever the other
+	// options, so that a backup pushed for an admission is not deleted
+	// before its workload is created.
+	Grace time.Duration
+
+	// KeepLast keeps the most recently created tags of each repository.
+	KeepLast int
+
+	// DryRun reports the tags that would be deleted without deleting them.
+	DryRun bool
+
+	// PushLog records when the tags were pushed. The tags it has no record
+	// of are recorded as pushed when first collected. Tags are not kept by
+	// their push time if nil.
+	PushLog PushLog
+}
+
+// PushLog records the time each tag was pushed, by "repository:tag"
+// reference.
+type PushLog interface {
+	Pushes(ctx context.Context) (map[string]time.Time, error)
+	Update(ctx context.Context, fn func(pushes map[string]time.Time)) error
+}
+
+// Tag is a tag of a backup repository.
+type Tag struct {
+	Repository string
+	Tag        string
+	Digest     string
+	Created    time.Time
+	Pushed     time.Time
+
+	// Reason is why the tag is kept; empty if it is deleted.
+	Reason string
+}
+
+// Report describes a collection.
+type Report struct {
+	Kept    []Tag
+	Deleted []Tag
+
+	// Errors of the repositories or manifests that could not be collected.
+	Errors []error
+}
+
+// Run deletes the manifests of the backups in opts.Repositories that are
+// not referenced by images, the references used by the workloads in the
+// cluster, and are not kept by opts.
+func Run(ctx context.Context, reg registry.Client, images []string, opts Options) Report {
+	inUse := references(images)
+	report := Report{Kept: []Tag{}, Deleted: []Tag{}, Errors: []error{}}
+
+	// Nothing is deleted if the push times are unknown, since the recent
+	// tags could not be told apart.
+	now := time.Now()
+	pushes := map[string]time.Time{}
+	if opts.PushLog != nil {
+		var err error
+		if pushes, err = opts.PushLog.Pushes(ctx); err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("failed to read the push times: %v", err))
+			return report
+		}
+	}
+
+	for _, repo := range opts.Repositories {
+		tags, err := describe(ctx, reg, repo)
+		if err != nil {
+			report.Errors = append(report.Errors, err)
+			continue
+		}
+		for i, t := range tags {
+			if pushed, ok := pushes[t.ref()]; ok {
+				tags[i].Pushed = pushed
+			} else if opts.PushLog != nil {
+				tags[i].Pushed = now
+			}
+		}
+		keep(tags, inUse, opts, now)
+
+		// A manifest is deleted along with every tag that points to it, so
+		// it is only deleted if none of them is kept.
+		kept := map[string]bool{}
+		for _, t := range tags {
+			if t.Reason != "" {
+				kept[t.Digest] = true
+			}
+		}
+
+		deleted := map[string]error{}
+		for i, t := range tags {
+			if t.Reason == "" && kept[t.Digest] {
+				tags[i].Reason = SharedWith
+			}
+			if tags[i].Reason != "" {
+				report.Kept = append(report.Kept, tags[i])
+				continue
+			}
+
+			if _, ok := deleted[t.Digest]; !ok && !opts.DryRun {
+				err := reg.Delete(ctx, repo, t.Digest)
+				if errors.Is(err, registry.ErrNotFound) {
+					err = nil
+				}
+				if err != nil {
+					klog.FromContext(ctx).Error(err, "Failed to delete backup", "repository", repo, "digest", t.Digest)
+					report.Errors = append(report.Errors, err)
+				} else {
+					klog.FromContext(ctx).Info("Deleted backup", "repository", repo, "digest", t.Digest)
+				}
+				deleted[t.Digest] = err
+			}
+			if deleted[t.Digest] == nil {
+				report.Deleted = append(report.Deleted, t)
+			}
+		}
+	}
+
+	if opts.PushLog != nil && !opts.DryRun {
+		if err := opts.PushLog.Update(ctx, func(pushes map[string]time.Time) {
+			prune(pushes, report, opts.Repositories, now)
+		}); err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("failed to record the push times: %v", err))
+		}
+	}
+	return report
+}
+
+// prune records the push time of the kept tags that had none, and forgets
+// those of the tags of repos that are gone. A time recorded after the
+// collection started is left as is, since its tag may have been pushed, or
+// pushed again, after the tags were listed.
+func prune(pushes map[string]time.Time, report Report, repos []string, started time.Time) {
+	kept := map[string]bool{}
+	for _, t := range report.Kept {
+		kept[t.ref()] = true
+		if _, ok := pushes[t.ref()]; !ok {
+			pushes[t.ref()] = t.Pushed
+		}
+	}
+
+	collected := map[string]bool{}
+	for _, r := range repos {
+		collected[normalize(r)] = true
+	}
+	for ref, pushed := range pushes {
+		tag, err := name.NewTag(ref)
+		if err != nil || !collected[tag.Context().Name()] || kept[ref] || pushed.After(started) {
+			continue
+		}
+		delete(pushes, ref)
+	}
+}
+
+// ref returns the "repository:tag" reference of t.
+func (t Tag) ref() string {
+	return normalize(t.Repository) + ":" + t.Tag
+}
+
+// describe returns the tags of repo along with the manifests they point
+// to. Tags whose manifest cannot be read are kept.
+func describe(ctx context.Context, reg registry.Client, repo string) ([]Tag, error) {
+	names, err := reg.Tags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]Tag, 0, len(names))
+	for _, n := range names {
+		t := Tag{Repository: repo, Tag: n}
+		m, err := reg.Describe(ctx, repo+":"+n)
+		if err != nil {
+			klog.FromContext(ctx).Info("Keeping unreadable tag", "repository", repo, "tag", n, "err", err)
+			t.Reason = Unreadable
+		}
+		t.Digest = m.Digest
+		t.Created = m.Created
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// keep sets the reason each of tags is kept, if any. tags are sorted from
+// the most recently created.
+func keep(tags []Tag, inUse map[string]bool, opts Options, now time.Time) {
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Created.After(tags[j].Created) })
+
+	for i := range tags {
+		t := &tags[i]
+		switch {
+		case t.Reason != "":
+		case inUse[t.ref()] || inUse[normalize(t.Repository)+"@"+t.Digest]:
+			t.Reason = InUse
+		case opts.Grace > 0 && now.Sub(t.Pushed) < opts.Grace:
+			t.Reason = Recent
+		case protected(t.Tag, opts.Protected):
+			t.Reason = Protected
+		case opts.KeepWithin > 0 && now.Sub(t.Pushed) < opts.KeepWithin:
+			t.Reason = Retained
+		case i < opts.KeepLast:
+			t.Reason = KeptLast
+		}
+	}
+}
+
+func protected(tag string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// references returns the set of images as fully qualified
+// "repository:tag" and "repository@digest" references.
+func references(images []string) map[string]bool {
+	refs := map[string]bool{}
+	for _, img := range images {
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			continue
+		}
+		refs[ref.Name()] = true
+
+		// A reference by both tag and digest, such as alpine:3.12@sha256:…,
+		// is parsed as a digest and keeps the tag too.
+		base := strings.Split(img, "@")[0]
+		if _, ok := ref.(name.Digest); ok && strings.Contains(path.Base(base), ":") {
+			if tag, err := name.NewTag(base); err == nil {
+				refs[tag.Name()] = true
+			}
+		}
+	}
+	return refs
+}
+
+func normalize(repo string) string {
+	r, err := name.NewRepository(repo)
+	if err != nil {
+		return repo
+	}
+	return r.Name()
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gc
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+const repo = "index.docker.io/gauravgahlot/alpine"
+
+// fakeRegistry serves the manifests of the tags of repo.
+type fakeRegistry struct {
+	registry.Client
+
+	manifests map[string]registry.Manifest
+	deleted   []string
+}
+
+func (r *fakeRegistry) Tags(ctx context.Context, repo string) ([]string, error) {
+	tags := []string{}
+	for t := range r.manifests {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (r *fakeRegistry) Describe(ctx context.Context, ref string) (registry.Manifest, error) {
+	m, ok := r.manifests[ref[strings.LastIndex(ref, ":")+1:]]
+	if !ok {
+		return registry.Manifest{}, registry.ErrNotFound
+	}
+	return m, nil
+}
+
+func (r *fakeRegistry) Delete(ctx context.Context, repo, digest string) error {
+	r.deleted = append(r.deleted, digest)
+	return nil
+}
+
+// fakePushLog records push times in memory.
+type fakePushLog struct {
+	pushes map[string]time.Time
+}
+
+func (l *fakePushLog) Pushes(ctx context.Context) (map[string]time.Time, error) {
+	pushes := map[string]time.Time{}
+	for ref, t := range l.pushes {
+		pushes[ref] = t
+	}
+	return pushes, nil
+}
+
+func (l *fakePushLog) Update(ctx context.Context, fn func(pushes map[string]time.Time)) error {
+	fn(l.pushes)
+	return nil
+}
+
+// testPushLog records every tag of testRegistry as pushed when its image
+// was created, but 3.12 and 3.13, whose images were pushed long after and
+// long before they were built respectively.
+func testPushLog(reg *fakeRegistry) *fakePushLog {
+	day := 24 * time.Hour
+	pushes := map[string]time.Time{}
+	for tag, m := range reg.manifests {
+		pushes[repo+":"+tag] = m.Created
+	}
+	pushes[repo+":3.12"] = time.Now().Add(-1 * day)
+	pushes[repo+":3.13"] = time.Now().Add(-30 * day)
+	return &fakePushLog{pushes: pushes}
+}
+
+// digest returns a valid digest made of n.
+func digest(n string) string {
+	return "sha256:" + strings.Repeat(n, 32)
+}
+
+func testRegistry() *fakeRegistry {
+	now := time.Now()
+	day := 24 * time.Hour
+	return &fakeRegistry{manifests: map[string]registry.Manifest{
+		"3.10":    {Digest: digest("10"), Created: now.Add(-300 * day)},
+		"3.11":    {Digest: digest("11"), Created: now.Add(-200 * day)},
+		"3.12":    {Digest: digest("12"), Created: now.Add(-100 * day)},
+		"3.13":    {Digest: digest("13"), Created: now.Add(-2 * day)},
+		"3.14":    {Digest: digest("14"), Created: now.Add(-1 * day)},
+		"latest":  {Digest: digest("09"), Created: now.Add(-400 * day)},
+		"3.9":     {Digest: digest("09"), Created: now.Add(-400 * day)},
+		"pinned":  {Digest: digest("08"), Created: now.Add(-500 * day)},
+		"unknown": {Digest: digest("07"), Created: now.Add(-600 * day)},
+	}}
+}
+
+func reasons(r Report) map[string]string {
+	got := map[string]string{}
+	for _, t := range r.Kept {
+		got[t.Tag] = t.Reason
+	}
+	for _, t := range r.Deleted {
+		got[t.Tag] = "deleted"
+	}
+	return got
+}
+
+func TestRun(t *testing.T) {
+	reg := testRegistry()
+	images := []string{
+		"gauravgahlot/alpine:3.11",
+		"gauravgahlot/alpine@" + digest("08"),
+		"alpine:3.10",
+	}
+	opts := Options{
+		Repositories: []string{repo},
+		Protected:    []string{"lat*"},
+		KeepWithin:   7 * 24 * time.Hour,
+		KeepLast:     1,
+		PushLog:      testPushLog(reg),
+	}
+
+	report := Run(context.Background(), reg, images, opts)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, map[string]string{
+		"3.14":    Retained,
+		"3.13":    "deleted",
+		"3.12":    Retained,
+		"3.11":    InUse,
+		"3.10":    "deleted",
+		"3.9":     SharedWith,
+		"latest":  Protected,
+		"pinned":  InUse,
+		"unknown": "deleted",
+	}, reasons(report))
+	assert.ElementsMatch(t, []string{digest("13"), digest("10"), digest("07")}, reg.deleted)
+}
+
+func TestRunRecordsPushes(t *testing.T) {
+	reg := testRegistry()
+	log := testPushLog(reg)
+	delete(log.pushes, repo+":3.9")
+	delete(log.pushes, repo+":latest")
+	later := time.Now().Add(time.Hour)
+	log.pushes[repo+":gone"] = time.Now().Add(-time.Hour)
+	log.pushes[repo+":pushing"] = later
+	log.pushes["index.docker.io/gauravgahlot/busybox:1.33"] = time.Now().Add(-time.Hour)
+
+	report := Run(context.Background(), reg, nil, Options{
+		Repositories: []string{repo},
+		KeepWithin:   7 * 24 * time.Hour,
+		PushLog:      log,
+	})
+	assert.Empty(t, report.Errors)
+
+	// The tags without a push time are recorded as pushed now, and kept.
+	assert.Equal(t, Retained, reasons(report)["3.9"])
+	assert.Equal(t, Retained, reasons(report)["latest"])
+	assert.Contains(t, log.pushes, repo+":3.9")
+
+	// The times of the deleted tags, and of the tags that are gone, are
+	// forgotten; those of other repositories, and those recorded after the
+	// tags were listed, are not.
+	assert.NotContains(t, log.pushes, repo+":3.10")
+	assert.NotContains(t, log.pushes, repo+":gone")
+	assert.Equal(t, later, log.pushes[repo+":pushing"])
+	assert.Contains(t, log.pushes, "index.docker.io/gauravgahlot/busybox:1.33")
+	assert.Contains(t, log.pushes, repo+":3.14")
+}
+
+func TestRunGrace(t *testing.T) {
+	reg := testRegistry()
+	log := testPushLog(reg)
+	log.pushes[repo+":3.14"] = time.Now().Add(-time.Hour)
+
+	report := Run(context.Background(), reg, nil, Options{
+		Repositories: []string{repo},
+		Grace:        2 * time.Hour,
+		PushLog:      log,
+	})
+	assert.Equal(t, Recent, reasons(report)["3.14"])
+	assert.Equal(t, "deleted", reasons(report)["3.12"])
+}
+
+func TestRunKeepLast(t *testing.T) {
+	reg := testRegistry()
+
+	report := Run(context.Background(), reg, nil, Options{Repositories: []string{repo}, KeepLast: 3})
+	assert.Equal(t, KeptLast, reasons(report)["3.12"])
+	assert.Equal(t, "deleted", reasons(report)["3.11"])
+}
+
+func TestRunDryRun(t *testing.T) {
+	reg := testRegistry()
+
+	report := Run(context.Background(), reg, nil, Options{Repositories: []string{repo}, DryRun: true})
+	assert.Len(t, report.Deleted, 9)
+	assert.Empty(t, reg.deleted)
+}
+
+func TestReferences(t *testing.T) {
+	got := references([]string{
+		"gauravgahlot/alpine:3.12@" + digest("12"),
+		"gauravgahlot/busybox@" + digest("13"),
+		"quay.io/gauravgahlot/nginx",
+		"invalid image",
+	})
+	assert.Equal(t, map[string]bool{
+		repo + ":3.12":            true,
+		repo + "@" + digest("12"): true,
+		"index.docker.io/gauravgahlot/busybox@" + digest("13"): true,
+		"quay.io/gauravgahlot/nginx:latest":                    true,
+	}, got)
+}
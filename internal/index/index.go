@@ -0,0 +1,85 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package index lists the clones made by image cloner. The index is built
+// from the workloads themselves: each container whose original image is
+// recorded in the OriginalImages annotation uses the backup of that image.
+package index
+
+import (
+	"fmt"
+	"sort"
+
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+// Entry is the clone of an image to the backup registry.
+type Entry struct {
+	// Source is the original image, and SourceDigest its digest when it was
+	// cloned, if recorded.
+	Source       string `json:"source"`
+	SourceDigest string `json:"sourceDigest,omitempty"`
+
+	// Backup is the image in the backup registry.
+	Backup string `json:"backup"`
+
+	// Workloads using the backup, as "Kind namespace/name".
+	Workloads []string `json:"workloads"`
+}
+
+// Build returns the entries of the clones used by workloads, sorted by
+// backup and source.
+func Build(workloads []kube.Workload) []Entry {
+	type key struct{ source, digest, backup string }
+	entries := map[key]*Entry{}
+
+	for _, w := range workloads {
+		originals, err := annotation.Decode(w.Annotations)
+		if err != nil {
+			klog.InfoS("Ignoring the original images of workload", "kind", w.Kind, "namespace", w.Namespace, "name", w.Name, "err", err)
+			continue
+		}
+
+		for _, c := range w.Containers {
+			o, ok := originals[c.Name]
+			if !ok || o.Image == c.Image {
+				continue
+			}
+
+			k := key{o.Image, o.Digest, c.Image}
+			if entries[k] == nil {
+				entries[k] = &Entry{Source: o.Image, SourceDigest: o.Digest, Backup: c.Image, Workloads: []string{}}
+			}
+			entries[k].Workloads = append(entries[k].Workloads, fmt.Sprintf("%s %s/%s", w.Kind, w.Namespace, w.Name))
+		}
+	}
+
+	list := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Backup != list[j].Backup {
+			return list[i].Backup < list[j].Backup
+		}
+		if list[i].Source != list[j].Source {
+			return list[i].Source < list[j].Source
+		}
+		return list[i].SourceDigest < list[j].SourceDigest
+	})
+	return list
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+const digest = "sha256:87703314048c40236c6d674424159ee862e2b96ce1c37c62d877e21ed27a387e"
+
+func TestBuild(t *testing.T) {
+	originals := `{"app":{"image":"alpine:3.12","digest":"` + digest + `"},"sidecar":{"image":"busybox:1.33"}}`
+	workloads := []kube.Workload{
+		{
+			Kind: kube.Deployment, Namespace: "default", Name: "a",
+			Annotations: map[string]string{annotation.OriginalImages: originals},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "gauravgahlot/alpine:3.12"},
+				{Name: "sidecar", Image: "gauravgahlot/busybox:1.33"},
+				{Name: "unrecorded", Image: "nginx:1.21"},
+			},
+		},
+		{
+			Kind: kube.DaemonSet, Namespace: "kube-system", Name: "b",
+			Annotations: map[string]string{annotation.OriginalImages: originals},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "gauravgahlot/alpine:3.12"},
+				// Reverted by hand, so it no longer uses the backup.
+				{Name: "sidecar", Image: "busybox:1.33"},
+			},
+		},
+		{
+			Kind: kube.Deployment, Namespace: "default", Name: "invalid",
+			Annotations: map[string]string{annotation.OriginalImages: "alpine"},
+			Containers:  []corev1.Container{{Name: "app", Image: "gauravgahlot/alpine:3.12"}},
+		},
+	}
+
+	assert.Equal(t, []Entry{
+		{
+			Source: "alpine:3.12", SourceDigest: digest, Backup: "gauravgahlot/alpine:3.12",
+			Workloads: []string{"Deployment default/a", "DaemonSet kube-system/b"},
+		},
+		{
+			Source: "busybox:1.33", Backup: "gauravgahlot/busybox:1.33",
+			Workloads: []string{"Deployment default/a"},
+		},
+	}, Build(workloads))
+}
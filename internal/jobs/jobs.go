@@ -0,0 +1,189 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jobs keeps track of the clones run by a replica, whether for an
+// admitted object, a watched workload, or on demand.
+package jobs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// Status of a job.
+type Status string
+
+// Statuses of a job.
+const (
+	Running   Status = "running"
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+)
+
+// Job is the clone of an image to the backup registry.
+type Job struct {
+	ID     string `json:"id"`
+	Status Status `json:"status"`
+
+	// Source is the image cloned, Digest its digest, and Destination its
+	// backup.
+	Source      string `json:"source"`
+	Digest      string `json:"digest,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// Kind, Namespace, Name and Container identify the container whose
+	// image is cloned; empty for a clone on demand.
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Container string `json:"container,omitempty"`
+
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Filter selects jobs by the fields that are set.
+type Filter struct {
+	Status      Status
+	Source      string
+	Destination string
+	Kind        string
+	Namespace   string
+	Name        string
+}
+
+func (f Filter) matches(j Job) bool {
+	for _, c := range []struct{ want, got string }{
+		{string(f.Status), string(j.Status)},
+		{f.Source, j.Source},
+		{f.Destination, j.Destination},
+		{f.Kind, j.Kind},
+		{f.Namespace, j.Namespace},
+		{f.Name, j.Name},
+	} {
+		if c.want != "" && c.want != c.got {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultMaxJobs is the number of jobs a Store keeps by default.
+const DefaultMaxJobs = 1000
+
+// Store keeps the running jobs, and the most recent finished jobs. The
+// methods of a nil Store do nothing.
+type Store struct {
+	max int
+
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	// finished lists the IDs of the finished jobs, from the oldest.
+	finished []string
+}
+
+// NewStore returns a Store keeping at most max finished jobs.
+func NewStore(max int) *Store {
+	if max <= 0 {
+		max = DefaultMaxJobs
+	}
+	return &Store{max: max, jobs: map[string]*Job{}}
+}
+
+// Start adds a running job for j, and returns its ID.
+func (s *Store) Start(j Job) string {
+	if s == nil {
+		return ""
+	}
+
+	j.ID = string(uuid.NewUUID())
+	j.Status = Running
+	j.Started = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = &j
+	return j.ID
+}
+
+// Finish sets the job id as finished, succeeded unless err is not nil.
+func (s *Store) Finish(id, destination, digest string, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || j.Finished != nil {
+		return
+	}
+	now := time.Now().UTC()
+	j.Finished = &now
+	j.Status = Succeeded
+	j.Destination, j.Digest = destination, digest
+	if err != nil {
+		j.Status, j.Error = Failed, err.Error()
+	}
+
+	s.finished = append(s.finished, id)
+	for len(s.finished) > s.max {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+// Get returns the job id.
+func (s *Store) Get(id string) (Job, bool) {
+	if s == nil {
+		return Job{}, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// List returns the jobs matching f, from the most recently started.
+func (s *Store) List(f Filter) []Job {
+	list := []Job{}
+	if s == nil {
+		return list
+	}
+
+	s.mu.RLock()
+	for _, j := range s.jobs {
+		if f.matches(*j) {
+			list = append(list, *j)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Started.Equal(list[j].Started) {
+			return list[i].Started.After(list[j].Started)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(2)
+
+	cloned := s.Start(Job{Source: "alpine:3.12", Kind: "Deployment", Namespace: "default", Name: "alpine", Container: "alpine"})
+	failed := s.Start(Job{Source: "busybox:1.33"})
+	running := s.Start(Job{Source: "nginx:1.21"})
+
+	s.Finish(cloned, "gauravgahlot/alpine:3.12", "sha256:1234", nil)
+	s.Finish(failed, "", "", errors.New("not found"))
+
+	j, ok := s.Get(cloned)
+	assert.True(t, ok)
+	assert.Equal(t, Succeeded, j.Status)
+	assert.Equal(t, "gauravgahlot/alpine:3.12", j.Destination)
+	assert.Equal(t, "sha256:1234", j.Digest)
+	assert.NotNil(t, j.Finished)
+
+	j, ok = s.Get(failed)
+	assert.True(t, ok)
+	assert.Equal(t, Failed, j.Status)
+	assert.Equal(t, "not found", j.Error)
+
+	j, ok = s.Get(running)
+	assert.True(t, ok)
+	assert.Equal(t, Running, j.Status)
+	assert.Nil(t, j.Finished)
+
+	assert.Len(t, s.List(Filter{}), 3)
+	assert.Equal(t, []string{cloned}, ids(s.List(Filter{Namespace: "default", Name: "alpine"})))
+	assert.Equal(t, []string{failed}, ids(s.List(Filter{Status: Failed})))
+	assert.Empty(t, s.List(Filter{Source: "alpine:3.12", Status: Failed}))
+
+	// The oldest finished job is dropped, never a running one.
+	s.Finish(s.Start(Job{Source: "redis:6"}), "gauravgahlot/redis:6", "sha256:5678", nil)
+	_, ok = s.Get(cloned)
+	assert.False(t, ok)
+	_, ok = s.Get(running)
+	assert.True(t, ok)
+	assert.Len(t, s.List(Filter{}), 3)
+}
+
+func TestStoreNil(t *testing.T) {
+	var s *Store
+
+	id := s.Start(Job{Source: "alpine:3.12"})
+	s.Finish(id, "", "", nil)
+	_, ok := s.Get(id)
+	assert.False(t, ok)
+	assert.Empty(t, s.List(Filter{}))
+}
+
+func ids(list []Job) []string {
+	ids := []string{}
+	for _, j := range list {
+		ids = append(ids, j.ID)
+	}
+	return ids
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+)
+
+// Resources of the supported workload kinds, for the dynamic client.
+var (
+	DeploymentResource = appsv1.SchemeGroupVersion.WithResource("deployments")
+	DaemonSetResource  = appsv1.SchemeGroupVersion.WithResource("daemonsets")
+)
+
+// Resources returns the resource of each of kinds, resolved with the
+// discovery API of cs.
+func Resources(cs kubernetes.Interface, kinds []schema.GroupVersionKind) ([]schema.GroupVersionResource, error) {
+	resources := make([]schema.GroupVersionResource, 0, len(kinds))
+	if len(kinds) == 0 {
+		return resources, nil
+	}
+
+	groups, err := restmapper.GetAPIGroupResources(cs.Discovery())
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groups)
+
+	for _, gvk := range kinds {
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the resource of %s: %v", gvk.Kind, err)
+		}
+		resources = append(resources, mapping.Resource)
+	}
+	return resources, nil
+}
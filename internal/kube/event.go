@@ -0,0 +1,48 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Limits of the Events recorded on an object. Each object may be sent
+// eventBurst Events at once, refilled at eventQPS; similar Events, which
+// differ only by message, are aggregated into one once more than
+// eventsAggregated of them are recorded within eventAggregationSeconds.
+const (
+	eventBurst              = 25
+	eventQPS                = 1. / 60
+	eventsAggregated        = 10
+	eventAggregationSeconds = 600
+)
+
+// NewRecorder returns an EventRecorder that records the Events of image
+// cloner in the cluster of cs. Identical Events are counted on a single
+// Event, and the Events of each object are rate limited.
+func NewRecorder(cs kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize:            eventBurst,
+		QPS:                  eventQPS,
+		MaxEvents:            eventsAggregated,
+		MaxIntervalInSeconds: eventAggregationSeconds,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "image-cloner"})
+}
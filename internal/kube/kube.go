@@ -0,0 +1,204 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Supported workload kinds.
+const (
+	Deployment = "Deployment"
+	DaemonSet  = "DaemonSet"
+)
+
+// Workload is the part of a Deployment or DaemonSet that image cloner
+// reads and patches.
+type Workload struct {
+	Kind        string
+	Namespace   string
+	Name        string
+	UID         types.UID
+	Annotations map[string]string
+	Containers  []corev1.Container
+}
+
+// Reference returns the reference to w used by Events.
+func (w Workload) Reference() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: appsv1.SchemeGroupVersion.String(),
+		Kind:       w.Kind,
+		Namespace:  w.Namespace,
+		Name:       w.Name,
+		UID:        w.UID,
+	}
+}
+
+// NewClient returns a clientset for the cluster of kubeconfig. If
+// kubeconfig is empty, the default kubeconfig is used when it exists, and
+// the cluster the process runs in otherwise.
+func NewClient(kubeconfig string) (kubernetes.Interface, error) {
+	cfg, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+// NewDynamicClient returns a dynamic client for the cluster of kubeconfig,
+// which is resolved as by NewClient.
+func NewDynamicClient(kubeconfig string) (dynamic.Interface, error) {
+	cfg, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(cfg)
+}
+
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+// ListWorkloads returns the Deployments and DaemonSets in namespace that
+// match the label selector. An empty namespace lists all namespaces.
+func ListWorkloads(ctx context.Context, cs kubernetes.Interface, namespace, selector string) ([]Workload, error) {
+	opts := metav1.ListOptions{LabelSelector: selector}
+	workloads := []Workload{}
+
+	deploys, err := cs.AppsV1().Deployments(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range deploys.Items {
+		workloads = append(workloads, DeploymentWorkload(&deploys.Items[i]))
+	}
+
+	daemonsets, err := cs.AppsV1().DaemonSets(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range daemonsets.Items {
+		workloads = append(workloads, DaemonSetWorkload(&daemonsets.Items[i]))
+	}
+	return workloads, nil
+}
+
+// ListImages returns the images used by the containers of the Pods, and of
+// the pod templates of the Deployments, DaemonSets, StatefulSets and
+// ReplicaSets in the cluster. ReplicaSets are included so that the images a
+// Deployment can be rolled back to are reported too. The images of the
+// kinds registered in the workloads config are listed by the server.
+func ListImages(ctx context.Context, cs kubernetes.Interface) ([]string, error) {
+	specs := []corev1.PodSpec{}
+	opts := metav1.ListOptions{}
+
+	pods, err := cs.CoreV1().Pods("").List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pods.Items {
+		specs = append(specs, p.Spec)
+	}
+
+	deploys, err := cs.AppsV1().Deployments("").List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deploys.Items {
+		specs = append(specs, d.Spec.Template.Spec)
+	}
+
+	daemonsets, err := cs.AppsV1().DaemonSets("").List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range daemonsets.Items {
+		specs = append(specs, d.Spec.Template.Spec)
+	}
+
+	statefulsets, err := cs.AppsV1().StatefulSets("").List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range statefulsets.Items {
+		specs = append(specs, s.Spec.Template.Spec)
+	}
+
+	replicasets, err := cs.AppsV1().ReplicaSets("").List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range replicasets.Items {
+		specs = append(specs, r.Spec.Template.Spec)
+	}
+
+	images := []string{}
+	for _, spec := range specs {
+		for _, c := range append(spec.InitContainers, spec.Containers...) {
+			images = append(images, c.Image)
+		}
+	}
+	return images, nil
+}
+
+// DeploymentWorkload returns the Workload of d.
+func DeploymentWorkload(d *appsv1.Deployment) Workload {
+	return Workload{
+		Kind:        Deployment,
+		Namespace:   d.Namespace,
+		Name:        d.Name,
+		UID:         d.UID,
+		Annotations: d.Annotations,
+		Containers:  d.Spec.Template.Spec.Containers,
+	}
+}
+
+// DaemonSetWorkload returns the Workload of d.
+func DaemonSetWorkload(d *appsv1.DaemonSet) Workload {
+	return Workload{
+		Kind:        DaemonSet,
+		Namespace:   d.Namespace,
+		Name:        d.Name,
+		UID:         d.UID,
+		Annotations: d.Annotations,
+		Containers:  d.Spec.Template.Spec.Containers,
+	}
+}
+
+// PatchWorkload applies a patch of type pt to w.
+func PatchWorkload(ctx context.Context, cs kubernetes.Interface, w Workload, pt types.PatchType, patch []byte, opts metav1.PatchOptions) error {
+	var err error
+	switch w.Kind {
+	case Deployment:
+		_, err = cs.AppsV1().Deployments(w.Namespace).Patch(ctx, w.Name, pt, patch, opts)
+	case DaemonSet:
+		_, err = cs.AppsV1().DaemonSets(w.Namespace).Patch(ctx, w.Name, pt, patch, opts)
+	default:
+		err = fmt.Errorf("unsupported kind %s", w.Kind)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	klog "k8s.io/klog/v2"
+)
+
+// LeaderElection identifies the Lease that replicas compete for.
+type LeaderElection struct {
+	// Name and Namespace of the Lease.
+	Name      string
+	Namespace string
+
+	// Identity of this replica; the hostname if empty.
+	Identity string
+}
+
+// RunLeaderElected blocks until ctx is done, and calls run with a context
+// that is canceled when this replica stops leading. The Lease is released
+// when ctx is done so that another replica can take over right away.
+func RunLeaderElected(ctx context.Context, cs kubernetes.Interface, le LeaderElection, run func(ctx context.Context)) error {
+	id := le.Identity
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		id = host
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: le.Name, Namespace: le.Namespace},
+		Client:     cs.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Name:            le.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				klog.InfoS("Stopped leading", "identity", id, "lease", klog.KRef(le.Namespace, le.Name))
+			},
+			OnNewLeader: func(identity string) {
+				klog.InfoS("New leader elected", "lease", klog.KRef(le.Namespace, le.Name), "leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// A replica that loses the Lease campaigns again until ctx is done.
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
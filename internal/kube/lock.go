@@ -0,0 +1,231 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	lockPrefix   = "image-cloner-image-"
+	lockDuration = 30 * time.Second
+)
+
+// ImageLocker serializes the cloning of an image across replicas with a
+// Lease named after the hash of the image.
+type ImageLocker struct {
+	cs        kubernetes.Interface
+	namespace string
+	identity  string
+
+	// duration after which a Lease that is not renewed can be taken over,
+	// and retry the interval at which a held Lease is polled.
+	duration time.Duration
+	retry    time.Duration
+}
+
+// NewImageLocker returns an ImageLocker whose Leases are in namespace.
+func NewImageLocker(cs kubernetes.Interface, namespace string) (*ImageLocker, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &ImageLocker{
+		cs:        cs,
+		namespace: namespace,
+		identity:  host,
+		duration:  lockDuration,
+		retry:     time.Second,
+	}, nil
+}
+
+// LockName returns the name of the Lease that locks image.
+func LockName(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return lockPrefix + hex.EncodeToString(sum[:])[:32]
+}
+
+// errLockLost is returned when a Lease is found to be deleted or taken over
+// by another replica while it is held.
+var errLockLost = errors.New("lock was lost")
+
+// Lock blocks until it holds the Lease of image, or ctx is done. The Lease
+// is renewed until the returned function releases it. The returned context
+// is canceled if the Lease is lost before then, such as when another
+// replica takes it over after failing renewals, so that the image is not
+// cloned by two replicas at once.
+func (l *ImageLocker) Lock(ctx context.Context, image string) (context.Context, func(), error) {
+	leases := l.cs.CoordinationV1().Leases(l.namespace)
+	name := LockName(image)
+	seconds := int32(l.duration / time.Second)
+
+	for {
+		now := metav1.NewMicroTime(time.Now())
+		lease, err := leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   l.namespace,
+				Labels:      map[string]string{"app": "image-cloner"},
+				Annotations: map[string]string{"image-cloner.io/image": image},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if err == nil {
+			ctx, unlock := l.hold(ctx, lease)
+			return ctx, unlock, nil
+		}
+		if !apierrors.IsAlreadyExists(err) {
+			return nil, nil, err
+		}
+
+		held, err := leases.Get(ctx, name, metav1.GetOptions{})
+		if err == nil && expired(held) {
+			klog.FromContext(ctx).Info("Taking over expired lock", "image", image, "holder", holder(held))
+			err = leases.Delete(ctx, name, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{UID: &held.UID, ResourceVersion: &held.ResourceVersion},
+			})
+			if err == nil || apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+				continue
+			}
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(l.retry):
+		}
+	}
+}
+
+// hold renews lease until the returned function is called, which deletes
+// it unless it was lost. The returned context is canceled once the lease is
+// lost or released.
+func (l *ImageLocker) hold(ctx context.Context, lease *coordinationv1.Lease) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	lost := false
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				renewed, err := l.renew(lease)
+				lease = renewed
+				if errors.Is(err, errLockLost) {
+					klog.InfoS("Lost lease, canceling its clone", "lease", klog.KObj(lease))
+					lost = true
+					cancel()
+					return
+				}
+				if err != nil {
+					klog.ErrorS(err, "Failed to renew lease", "lease", klog.KObj(lease))
+				}
+			}
+		}
+	}()
+
+	return ctx, func() {
+		cancel()
+		<-stopped
+		if lost {
+			return
+		}
+		err := l.cs.CoordinationV1().Leases(l.namespace).Delete(context.Background(), lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &lease.UID},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.ErrorS(err, "Failed to release lease", "lease", klog.KObj(lease))
+		}
+	}
+}
+
+// renew updates the renew time of lease, and returns the lease as last
+// read. On a conflict, the lease is read again and renewed if it is still
+// held; errLockLost is returned if it is not.
+func (l *ImageLocker) renew(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	leases := l.cs.CoordinationV1().Leases(l.namespace)
+	ctx := context.Background()
+
+	update := func(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+		now := metav1.NewMicroTime(time.Now())
+		renewing := lease.DeepCopy()
+		renewing.Spec.RenewTime = &now
+		return leases.Update(ctx, renewing, metav1.UpdateOptions{})
+	}
+
+	renewed, err := update(lease)
+	if err == nil {
+		return renewed, nil
+	}
+	if !apierrors.IsConflict(err) && !apierrors.IsNotFound(err) {
+		return lease, err
+	}
+
+	current, err := leases.Get(ctx, lease.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return lease, errLockLost
+	}
+	if err != nil {
+		return lease, err
+	}
+	if current.UID != lease.UID || holder(current) != l.identity {
+		return lease, errLockLost
+	}
+
+	renewed, err = update(current)
+	if err != nil {
+		return current, err
+	}
+	return renewed, nil
+}
+
+func expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	d := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return time.Now().After(lease.Spec.RenewTime.Add(d))
+}
+
+func holder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return "unknown"
+	}
+	return *lease.Spec.HolderIdentity
+}
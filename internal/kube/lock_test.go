@@ -0,0 +1,162 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testLocker(identity string, cs *fake.Clientset) *ImageLocker {
+	return &ImageLocker{
+		cs:        cs,
+		namespace: "default",
+		identity:  identity,
+		duration:  lockDuration,
+		retry:     10 * time.Millisecond,
+	}
+}
+
+func TestImageLocker(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	a, b := testLocker("a", cs), testLocker("b", cs)
+	ctx := context.Background()
+
+	_, unlock, err := a.Lock(ctx, "alpine:3.12")
+	assert.NoError(t, err)
+
+	// Other images are not blocked.
+	_, unlockOther, err := b.Lock(ctx, "busybox:1.33")
+	assert.NoError(t, err)
+	unlockOther()
+
+	// The same image is, until the lock is released or ctx is done.
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, _, err = b.Lock(timeout, "alpine:3.12")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	locked := make(chan struct{})
+	go func() {
+		_, unlock, err := b.Lock(ctx, "alpine:3.12")
+		assert.NoError(t, err)
+		close(locked)
+		unlock()
+	}()
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not acquired after release")
+	}
+}
+
+func TestImageLockerExpired(t *testing.T) {
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	seconds := int32(30)
+	holder := "crashed"
+	cs := fake.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: LockName("alpine:3.12"), Namespace: "default"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewed,
+		},
+	})
+
+	timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, unlock, err := testLocker("a", cs).Lock(timeout, "alpine:3.12")
+	assert.NoError(t, err)
+
+	lease, err := cs.CoordinationV1().Leases("default").Get(timeout, LockName("alpine:3.12"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "a", *lease.Spec.HolderIdentity)
+	unlock()
+}
+
+func TestImageLockerRenewConflict(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	l := testLocker("a", cs)
+	l.duration = 30 * time.Millisecond
+
+	// The first renewal conflicts, as when the Lease was updated since it
+	// was read; the lock is still held, so it is read again and renewed.
+	conflicts := 1
+	cs.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			return false, nil, nil
+		}
+		conflicts--
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "leases"}, LockName("alpine:3.12"), nil)
+	})
+
+	ctx, unlock, err := l.Lock(context.Background(), "alpine:3.12")
+	assert.NoError(t, err)
+	defer unlock()
+
+	acquired, err := cs.CoordinationV1().Leases("default").Get(ctx, LockName("alpine:3.12"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		lease, err := cs.CoordinationV1().Leases("default").Get(ctx, LockName("alpine:3.12"), metav1.GetOptions{})
+		return err == nil && lease.Spec.RenewTime.After(acquired.Spec.RenewTime.Time)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestImageLockerLost(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	l := testLocker("a", cs)
+	l.duration = 30 * time.Millisecond
+
+	ctx, unlock, err := l.Lock(context.Background(), "alpine:3.12")
+	assert.NoError(t, err)
+
+	// Another replica takes the Lease over, so renewing it conflicts.
+	leases := cs.CoordinationV1().Leases("default")
+	assert.NoError(t, leases.Delete(context.Background(), LockName("alpine:3.12"), metav1.DeleteOptions{}))
+	other := "b"
+	_, err = leases.Create(context.Background(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: LockName("alpine:3.12"), Namespace: "default", UID: "other"},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &other},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	cs.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "leases"}, LockName("alpine:3.12"), nil)
+	})
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not canceled after the lock was lost")
+	}
+
+	// Releasing the lost lock leaves the Lease of the other replica.
+	unlock()
+	lease, err := leases.Get(context.Background(), LockName("alpine:3.12"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", *lease.Spec.HolderIdentity)
+}
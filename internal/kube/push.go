@@ -0,0 +1,111 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	pushLogName = "image-cloner-pushes"
+	pushLogKey  = "pushes"
+)
+
+// PushLog records when the backups were pushed in a ConfigMap, so that
+// they are retained by their push time whichever replica or job pushed
+// them. The times are stored as a JSON object keyed by tag reference.
+type PushLog struct {
+	cs        kubernetes.Interface
+	namespace string
+}
+
+// NewPushLog returns a PushLog whose ConfigMap is in namespace.
+func NewPushLog(cs kubernetes.Interface, namespace string) *PushLog {
+	return &PushLog{cs: cs, namespace: namespace}
+}
+
+// Pushes returns the time each backup was pushed, by tag reference.
+func (p *PushLog) Pushes(ctx context.Context) (map[string]time.Time, error) {
+	cm, err := p.cs.CoreV1().ConfigMaps(p.namespace).Get(ctx, pushLogName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return map[string]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodePushes(cm)
+}
+
+// Record records that ref was pushed at t.
+func (p *PushLog) Record(ctx context.Context, ref string, t time.Time) error {
+	return p.Update(ctx, func(pushes map[string]time.Time) {
+		pushes[ref] = t
+	})
+}
+
+// Update replaces the push times with those modified by fn. It is retried
+// with the latest times if another replica updated them meanwhile.
+func (p *PushLog) Update(ctx context.Context, fn func(pushes map[string]time.Time)) error {
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		configMaps := p.cs.CoreV1().ConfigMaps(p.namespace)
+		cm, err := configMaps.Get(ctx, pushLogName, metav1.GetOptions{})
+		found := err == nil
+		if apierrors.IsNotFound(err) {
+			cm, err = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: pushLogName, Namespace: p.namespace}}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		pushes, err := decodePushes(cm)
+		if err != nil {
+			return err
+		}
+		fn(pushes)
+		raw, err := json.Marshal(pushes)
+		if err != nil {
+			return err
+		}
+		cm.Data = map[string]string{pushLogKey: string(raw)}
+
+		if found {
+			_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		} else {
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		}
+		return err
+	})
+}
+
+func decodePushes(cm *corev1.ConfigMap) (map[string]time.Time, error) {
+	pushes := map[string]time.Time{}
+	if raw := cm.Data[pushLogKey]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &pushes); err != nil {
+			return nil, err
+		}
+	}
+	return pushes, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPushLog(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	a, b := NewPushLog(cs, "default"), NewPushLog(cs, "default")
+	ctx := context.Background()
+
+	pushes, err := a.Pushes(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, pushes)
+
+	pushed := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, a.Record(ctx, "index.docker.io/gauravgahlot/alpine:3.12", pushed))
+	assert.NoError(t, b.Record(ctx, "index.docker.io/gauravgahlot/busybox:1.33", pushed.Add(time.Hour)))
+
+	pushes, err = b.Pushes(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, pushes, 2)
+	assert.True(t, pushed.Equal(pushes["index.docker.io/gauravgahlot/alpine:3.12"]))
+
+	assert.NoError(t, b.Update(ctx, func(pushes map[string]time.Time) {
+		delete(pushes, "index.docker.io/gauravgahlot/alpine:3.12")
+	}))
+	pushes, err = a.Pushes(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, pushes, 1)
+}
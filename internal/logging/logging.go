@@ -0,0 +1,62 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging selects the format of the logs written through klog.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	klog "k8s.io/klog/v2"
+)
+
+// Formats of the logs.
+const (
+	// Text is the klog text format.
+	Text = "text"
+
+	// JSON writes each log line as a JSON object, with its key/value pairs
+	// as fields.
+	JSON = "json"
+)
+
+// Setup writes the logs in format to w; klog writes them itself in the
+// text format.
+func Setup(format string, w io.Writer) error {
+	switch format {
+	case Text:
+		klog.ClearLogger()
+	case JSON:
+		klog.SetLogger(NewJSON(w))
+	default:
+		return fmt.Errorf("unknown log format %q: must be %s or %s", format, Text, JSON)
+	}
+	return nil
+}
+
+// NewJSON returns a logger writing JSON lines to w. It writes every level
+// it is given, since klog checks the verbosity before calling it.
+func NewJSON(w io.Writer) logr.Logger {
+	return funcr.NewJSON(func(obj string) {
+		fmt.Fprintln(w, obj)
+	}, funcr.Options{
+		LogCaller:    funcr.All,
+		LogTimestamp: true,
+		Verbosity:    math.MaxInt32,
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	klog "k8s.io/klog/v2"
+)
+
+func TestSetupJSON(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, Setup(JSON, &buf))
+	t.Cleanup(klog.ClearLogger)
+
+	logger := klog.LoggerWithValues(klog.Background(), "uid", "4584308f", "namespace", "default")
+	ctx := klog.NewContext(context.Background(), logger)
+	klog.FromContext(ctx).Info("Cloned image", "source", "alpine:3.12", "destination", "gauravgahlot/alpine:3.12")
+	klog.ErrorS(errors.New("error image pull"), "Failed to clone image", "source", "alpine:3.13")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var info map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &info))
+	assert.Equal(t, "Cloned image", info["msg"])
+	assert.Equal(t, "4584308f", info["uid"])
+	assert.Equal(t, "default", info["namespace"])
+	assert.Equal(t, "alpine:3.12", info["source"])
+	assert.Equal(t, "gauravgahlot/alpine:3.12", info["destination"])
+	assert.Contains(t, info, "ts")
+	assert.Contains(t, info, "caller")
+
+	var failure map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &failure))
+	assert.Equal(t, "Failed to clone image", failure["msg"])
+	assert.Equal(t, "error image pull", failure["error"])
+	assert.Equal(t, "alpine:3.13", failure["source"])
+}
+
+func TestSetupUnknownFormat(t *testing.T) {
+	assert.EqualError(t, Setup("yaml", &bytes.Buffer{}), `unknown log format "yaml": must be text or json`)
+}
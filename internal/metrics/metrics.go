@@ -0,0 +1,187 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics defines the Prometheus metrics of image cloner.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "image_cloner"
+
+// Registry holds the metrics of image cloner, along with the Go runtime and
+// process metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// AdmissionRequests counts the admission requests by the kind and
+	// operation of the object, and whether it was allowed.
+	AdmissionRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "admission",
+		Name:      "requests_total",
+		Help:      "Number of admission requests by kind, operation and result.",
+	}, []string{"kind", "operation", "result"})
+
+	// Clones counts the images copied to the backup registry.
+	Clones = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "clone",
+		Name:      "images_total",
+		Help:      "Number of images copied to the backup registry.",
+	})
+
+	// CloneFailures counts the clones that failed by the stage that failed.
+	CloneFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "clone",
+		Name:      "failures_total",
+		Help:      "Number of clones that failed by the stage that failed.",
+	}, []string{"stage"})
+
+	// BackupLookups counts whether the backup tag of a cloned image already
+	// held it, in which case the push uploads no layer.
+	BackupLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "clone",
+		Name:      "backup_lookups_total",
+		Help:      "Number of lookups of the backup tag of cloned images, by whether it already held the image.",
+	}, []string{"result"})
+
+	// DockerDuration observes how long the operations of the Docker daemon
+	// took.
+	DockerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "docker",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of the pulls, tags and pushes of the Docker daemon by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"operation", "result"})
+
+	// DockerBytes counts the bytes of the layers pulled and pushed; layers
+	// the daemon or registry already had are not counted.
+	DockerBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "docker",
+		Name:      "transferred_bytes_total",
+		Help:      "Bytes of the image layers pulled and pushed.",
+	}, []string{"operation"})
+)
+
+var (
+	// UpstreamSources counts the original images of the backups by the
+	// status of their source.
+	UpstreamSources = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "sources",
+		Help:      "Number of original images of backups by the status of their source.",
+	}, []string{"status"})
+
+	// UpstreamSourceUnavailable is 1 for each original image whose source
+	// is not available as it was cloned.
+	UpstreamSourceUnavailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "source_unavailable",
+		Help:      "Original images whose source is gone, changed, rate limited or could not be checked.",
+	}, []string{"image", "status"})
+
+	// UpstreamLastCheck is the time the sources were last checked.
+	UpstreamLastCheck = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "last_check_timestamp_seconds",
+		Help:      "Unix time the sources of the backups were last checked.",
+	})
+)
+
+var (
+	// VerifiedBackups counts the backups by the result of their last
+	// verification.
+	VerifiedBackups = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "verify",
+		Name:      "backups",
+		Help:      "Number of backups by the result of their last verification.",
+	}, []string{"status", "source"})
+
+	// VerifyFailure is 1 for each backup that failed verification.
+	VerifyFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "verify",
+		Name:      "failure",
+		Help:      "Backups that are missing or corrupt, or do not match their source.",
+	}, []string{"backup", "status", "source"})
+
+	// VerifyLastRun is the time the backups were last verified.
+	VerifyLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "verify",
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix time the backups were last verified.",
+	})
+)
+
+var (
+	// Notifications counts the events sent to each notifier by whether the
+	// receiver accepted them.
+	Notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "notify",
+		Name:      "events_total",
+		Help:      "Number of events sent to each notifier by result.",
+	}, []string{"notifier", "result"})
+
+	// NotificationsDropped counts the events dropped because the queue of
+	// a notifier was full.
+	NotificationsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "notify",
+		Name:      "dropped_total",
+		Help:      "Number of events dropped because the queue of the notifier was full.",
+	}, []string{"notifier"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		AdmissionRequests,
+		Clones,
+		CloneFailures,
+		BackupLookups,
+		DockerDuration,
+		DockerBytes,
+		UpstreamSources,
+		UpstreamSourceUnavailable,
+		UpstreamLastCheck,
+		VerifiedBackups,
+		VerifyFailure,
+		VerifyLastRun,
+		Notifications,
+		NotificationsDropped,
+	)
+	registerQueueMetrics()
+}
+
+// Handler serves the metrics in Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// The metrics of the named work queues, such as the queue of the workloads
+// the controller syncs.
+var (
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Number of items waiting in the work queue.",
+	}, []string{"name"})
+
+	queueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Number of items added to the work queue.",
+	}, []string{"name"})
+
+	queueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Number of items added back to the work queue after a failure.",
+	}, []string{"name"})
+
+	queueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "How long items wait in the work queue before being processed.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 10, 7),
+	}, []string{"name"})
+
+	queueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "How long processing an item of the work queue takes.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 10, 7),
+	}, []string{"name"})
+
+	queueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "Seconds spent on the items of the work queue still being processed.",
+	}, []string{"name"})
+
+	queueLongestRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "Seconds the longest item of the work queue still being processed has run.",
+	}, []string{"name"})
+)
+
+func registerQueueMetrics() {
+	Registry.MustRegister(
+		queueDepth,
+		queueAdds,
+		queueRetries,
+		queueLatency,
+		queueWorkDuration,
+		queueUnfinishedWork,
+		queueLongestRunning,
+	)
+	workqueue.SetProvider(queueMetrics{})
+}
+
+// queueMetrics provides the metrics of the named work queues.
+type queueMetrics struct{}
+
+func (queueMetrics) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return queueDepth.WithLabelValues(name)
+}
+
+func (queueMetrics) NewAddsMetric(name string) workqueue.CounterMetric {
+	return queueAdds.WithLabelValues(name)
+}
+
+func (queueMetrics) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return queueLatency.WithLabelValues(name)
+}
+
+func (queueMetrics) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return queueWorkDuration.WithLabelValues(name)
+}
+
+func (queueMetrics) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return queueUnfinishedWork.WithLabelValues(name)
+}
+
+func (queueMetrics) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return queueLongestRunning.WithLabelValues(name)
+}
+
+func (queueMetrics) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return queueRetries.WithLabelValues(name)
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Types of sinks.
+const (
+	SinkHTTP        = "http"
+	SinkCloudEvents = "cloudevents"
+)
+
+// Config configures a notifier and its sink.
+type Config struct {
+	// Name identifies the notifier in logs and metrics.
+	Name string `json:"name"`
+
+	// Type of the sink, http or cloudevents, and URL it POSTs to.
+	Type string `json:"type"`
+	URL  string `json:"url"`
+
+	// Headers are added to each request. Values are expanded from the
+	// environment, as in "Bearer ${TOKEN}", so that secrets can be kept out
+	// of the file.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Source is the source attribute of CloudEvents.
+	Source string `json:"source,omitempty"`
+
+	// Events are patterns of the types of the events sent, and Namespaces
+	// the namespaces of their workloads; all if empty.
+	Events     []string `json:"events,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	BatchSize int             `json:"batchSize,omitempty"`
+	BatchWait metav1.Duration `json:"batchWait,omitempty"`
+
+	// Retries defaults to DefaultRetries; 0 disables retries.
+	Retries   *int            `json:"retries,omitempty"`
+	Backoff   metav1.Duration `json:"backoff,omitempty"`
+	QueueSize int             `json:"queueSize,omitempty"`
+}
+
+type notifiersFile struct {
+	Notifiers []Config `json:"notifiers"`
+}
+
+// Load returns the notifiers configured in the YAML or JSON file at path.
+// An empty path configures none.
+func Load(path string) (Notifiers, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f notifiersFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid notifiers file %s: %v", path, err)
+	}
+
+	ns := Notifiers{}
+	names := map[string]bool{}
+	for _, c := range f.Notifiers {
+		if names[c.Name] {
+			return nil, fmt.Errorf("notifier %s: duplicate name", c.Name)
+		}
+		names[c.Name] = true
+
+		n, err := NewFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// NewFromConfig returns the Notifier configured by c.
+func NewFromConfig(c Config) (*Notifier, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("notifier of %s: name is required", c.URL)
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("notifier %s: url must be an http or https URL", c.Name)
+	}
+
+	for _, p := range c.Events {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("notifier %s: invalid event pattern %q: %v", c.Name, p, err)
+		}
+	}
+
+	header := http.Header{}
+	for k, v := range c.Headers {
+		header.Set(k, os.ExpandEnv(v))
+	}
+
+	var sink Sink
+	switch c.Type {
+	case SinkHTTP:
+		sink = HTTPSink{URL: c.URL, Header: header}
+	case SinkCloudEvents:
+		sink = CloudEventsSink{URL: c.URL, Source: c.Source, Header: header}
+	default:
+		return nil, fmt.Errorf("notifier %s: type must be %s or %s", c.Name, SinkHTTP, SinkCloudEvents)
+	}
+
+	retries := DefaultRetries
+	if c.Retries != nil {
+		retries = *c.Retries
+	}
+	return New(c.Name, sink, Options{
+		Types:      c.Events,
+		Namespaces: c.Namespaces,
+		BatchSize:  c.BatchSize,
+		BatchWait:  c.BatchWait.Duration,
+		Retries:    retries,
+		Backoff:    c.Backoff.Duration,
+		QueueSize:  c.QueueSize,
+	}), nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	os.Setenv("NOTIFY_TOKEN", "secret")
+	defer os.Unsetenv("NOTIFY_TOKEN")
+
+	path := filepath.Join(t.TempDir(), "notifiers.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+notifiers:
+  - name: chat
+    type: http
+    url: https://chat.example.com/hooks/1
+    headers:
+      Authorization: Bearer ${NOTIFY_TOKEN}
+    events: [clone.failed, upstream.gone]
+    batchWait: 30s
+    retries: 0
+  - name: broker
+    type: cloudevents
+    url: http://broker.knative-eventing.svc/default/default
+    source: prod-cluster
+    namespaces: [prod]
+`), 0o600))
+
+	ns, err := Load(path)
+	assert.NoError(t, err)
+	assert.Len(t, ns, 2)
+
+	chat := ns[0]
+	assert.Equal(t, "chat", chat.name)
+	assert.Equal(t, "Bearer secret", chat.sink.(HTTPSink).Header.Get("Authorization"))
+	assert.Equal(t, []string{"clone.failed", "upstream.gone"}, chat.opts.Types)
+	assert.Equal(t, 30*time.Second, chat.opts.BatchWait)
+	assert.Equal(t, 0, chat.opts.Retries)
+
+	broker := ns[1]
+	assert.Equal(t, "prod-cluster", broker.sink.(CloudEventsSink).Source)
+	assert.Equal(t, []string{"prod"}, broker.opts.Namespaces)
+	assert.Equal(t, DefaultRetries, broker.opts.Retries)
+	assert.Equal(t, DefaultBatchSize, broker.opts.BatchSize)
+}
+
+func TestNewFromConfigErrors(t *testing.T) {
+	cases := map[string]Config{
+		"no-name":     {Type: SinkHTTP, URL: "https://example.com"},
+		"bad-type":    {Name: "chat", Type: "smtp", URL: "https://example.com"},
+		"bad-url":     {Name: "chat", Type: SinkHTTP, URL: "example.com"},
+		"bad-pattern": {Name: "chat", Type: SinkHTTP, URL: "https://example.com", Events: []string{"clone.["}},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewFromConfig(c)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadEmpty(t *testing.T) {
+	ns, err := Load("")
+	assert.NoError(t, err)
+	assert.Empty(t, ns)
+}
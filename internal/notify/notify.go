@@ -0,0 +1,319 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notify sends the events of the clones and of the upstream checks
+// to receivers outside the cluster, such as the webhook of a chat.
+package notify
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+)
+
+// Type of an event.
+type Type string
+
+// Types of the events of a clone. The events of an upstream check are of
+// type "upstream." followed by the status of the source, such as
+// upstream.gone.
+const (
+	CloneSucceeded Type = "clone.succeeded"
+	CloneSkipped   Type = "clone.skipped"
+	CloneFailed    Type = "clone.failed"
+)
+
+// Upstream returns the type of the events of a source whose status changed
+// to status.
+func Upstream(status string) Type {
+	return Type("upstream." + status)
+}
+
+// Event is something that happened to an image of a workload.
+type Event struct {
+	// ID is unique to the event, and the same each time it is sent, so
+	// that receivers can drop the events of a batch sent again.
+	ID   string    `json:"id"`
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Container string `json:"container,omitempty"`
+
+	// Source is the image of the container, Digest the digest of the image
+	// cloned, and Destination its backup.
+	Source      string `json:"source,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Destination string `json:"destination,omitempty"`
+
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Sink sends batches of events to a receiver.
+type Sink interface {
+	Send(ctx context.Context, events []Event) error
+}
+
+// PermanentError is returned by a Sink for a batch that would be refused
+// again, which is not retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Defaults of Options.
+const (
+	DefaultBatchSize = 10
+	DefaultBatchWait = 5 * time.Second
+	DefaultRetries   = 5
+	DefaultBackoff   = time.Second
+	DefaultQueueSize = 1000
+)
+
+// Options configures which events a Notifier sends, and how.
+type Options struct {
+	// Types are path.Match patterns of the types of the events sent, such
+	// as clone.failed or upstream.*; all if empty.
+	Types []string
+
+	// Namespaces of the workloads whose events are sent; all if empty.
+	Namespaces []string
+
+	// BatchSize is the most events sent at once, and BatchWait how long an
+	// event waits for others to be sent along with it.
+	BatchSize int
+	BatchWait time.Duration
+
+	// Retries is how many times a batch that failed is sent again, waiting
+	// Backoff before the first retry and twice as long before each next one.
+	Retries int
+	Backoff time.Duration
+
+	// QueueSize is the most events waiting to be sent; events are dropped
+	// while the queue is full.
+	QueueSize int
+}
+
+// Notifier sends the events matching its options to a Sink, in batches.
+type Notifier struct {
+	name   string
+	sink   Sink
+	opts   Options
+	events chan Event
+}
+
+// New returns a Notifier, named name in logs and metrics, that sends
+// events to sink. Options left zero take their default.
+func New(name string, sink Sink, opts Options) *Notifier {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.BatchWait <= 0 {
+		opts.BatchWait = DefaultBatchWait
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	return &Notifier{name: name, sink: sink, opts: opts, events: make(chan Event, opts.QueueSize)}
+}
+
+// Notify queues e if it matches the options of n; it never blocks.
+func (n *Notifier) Notify(e Event) {
+	if !n.matches(e) {
+		return
+	}
+	if e.ID == "" {
+		e.ID = string(uuid.NewUUID())
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	select {
+	case n.events <- e:
+	default:
+		metrics.NotificationsDropped.WithLabelValues(n.name).Inc()
+	}
+}
+
+func (n *Notifier) matches(e Event) bool {
+	if len(n.opts.Types) > 0 && !anyMatch(n.opts.Types, string(e.Type)) {
+		return false
+	}
+	if len(n.opts.Namespaces) > 0 && !contains(n.opts.Namespaces, e.Namespace) {
+		return false
+	}
+	return true
+}
+
+// Run sends the queued events until ctx is done, and then sends the events
+// still queued, for at most BatchWait. It blocks while a batch is retried,
+// during which events are queued.
+func (n *Notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.opts.BatchWait)
+	defer ticker.Stop()
+
+	var batch []Event
+	for {
+		select {
+		case e := <-n.events:
+			batch = append(batch, e)
+			if len(batch) < n.opts.BatchSize && ctx.Err() == nil {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-ctx.Done():
+		}
+
+		// A batch interrupted by ctx is sent along with the events still
+		// queued, rather than dropped.
+		if ctx.Err() != nil || !n.send(ctx, batch) {
+			n.flush(batch)
+			return
+		}
+		batch = nil
+	}
+}
+
+// flush sends batch along with the events queued until the queue is empty,
+// in batches of at most BatchSize.
+func (n *Notifier) flush(batch []Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.opts.BatchWait)
+	defer cancel()
+
+	for {
+		for len(batch) < n.opts.BatchSize {
+			select {
+			case e := <-n.events:
+				batch = append(batch, e)
+				continue
+			default:
+			}
+			break
+		}
+		if len(batch) == 0 {
+			return
+		}
+		n.send(ctx, batch)
+		batch = nil
+	}
+}
+
+// send sends batch, retrying with an exponential backoff unless the sink
+// returns a PermanentError. It returns false, without dropping batch, if
+// ctx is canceled before batch is sent.
+func (n *Notifier) send(ctx context.Context, batch []Event) bool {
+	logger := klog.FromContext(ctx).WithValues("notifier", n.name, "events", len(batch))
+	backoff := wait.Backoff{Duration: n.opts.Backoff, Factor: 2, Jitter: 0.1, Steps: n.opts.Retries + 1}
+
+	var err error
+	attempts := 0
+	werr := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		attempts++
+		err = n.sink.Send(ctx, batch)
+		var permanent PermanentError
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.As(err, &permanent):
+			return false, err
+		}
+		logger.Info("Failed to send events", "attempt", attempts, "err", err)
+		return false, nil
+	})
+	if err == nil {
+		// The batch was not sent if ctx was done before.
+		err = werr
+	}
+
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	if err != nil {
+		logger.Error(err, "Dropping events that could not be sent", "attempts", attempts)
+		metrics.Notifications.WithLabelValues(n.name, "error").Add(float64(len(batch)))
+		return true
+	}
+	metrics.Notifications.WithLabelValues(n.name, "sent").Add(float64(len(batch)))
+	return true
+}
+
+// Notifiers sends events to each of its notifiers.
+type Notifiers []*Notifier
+
+// Notify queues e to each of ns whose options it matches.
+func (ns Notifiers) Notify(e Event) {
+	for _, n := range ns {
+		n.Notify(e)
+	}
+}
+
+// Run runs each of ns until ctx is done, and returns once they are all
+// done.
+func (ns Notifiers) Run(ctx context.Context) {
+	done := make(chan struct{}, len(ns))
+	for _, n := range ns {
+		go func(n *Notifier) {
+			n.Run(ctx)
+			done <- struct{}{}
+		}(n)
+	}
+	for range ns {
+		<-done
+	}
+}
+
+func anyMatch(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
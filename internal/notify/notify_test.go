@@ -0,0 +1,273 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const alpine = "alpine:3.12"
+
+// receiver is an httptest receiver recording the batches POSTed to it,
+// and responding with the status codes of responses, then 200.
+type receiver struct {
+	mu          sync.Mutex
+	batches     [][]Event
+	contentType string
+	header      http.Header
+	responses   []int
+	received    chan struct{}
+}
+
+func newReceiver(t *testing.T, responses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{responses: responses, received: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		defer func() { r.received <- struct{}{} }()
+
+		r.contentType, r.header = req.Header.Get("Content-Type"), req.Header
+		if len(r.responses) > 0 {
+			code := r.responses[0]
+			r.responses = r.responses[1:]
+			w.WriteHeader(code)
+			return
+		}
+
+		var batch []Event
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		r.batches = append(r.batches, batch)
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func (r *receiver) wait(t *testing.T, requests int) {
+	for i := 0; i < requests; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d requests", i, requests)
+		}
+	}
+}
+
+func (r *receiver) Batches() [][]Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batches
+}
+
+func run(t *testing.T, n *Notifier) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func failed(namespace, source string) Event {
+	return Event{Type: CloneFailed, Kind: "Deployment", Namespace: namespace, Name: "alpine", Container: "alpine", Source: source}
+}
+
+func TestNotifierBatches(t *testing.T) {
+	r, srv := newReceiver(t)
+	n := New("test", HTTPSink{URL: srv.URL}, Options{BatchSize: 2, BatchWait: 50 * time.Millisecond})
+	run(t, n)
+
+	n.Notify(failed("default", "alpine:3.12"))
+	n.Notify(failed("default", "alpine:3.13"))
+	n.Notify(failed("default", "alpine:3.14"))
+	r.wait(t, 2)
+
+	batches := r.Batches()
+	assert.Len(t, batches, 2)
+	assert.Len(t, batches[0], 2)
+	assert.Equal(t, "alpine:3.13", batches[0][1].Source)
+	// The last event is sent once it waited BatchWait.
+	assert.Len(t, batches[1], 1)
+	assert.Equal(t, "alpine:3.14", batches[1][0].Source)
+	assert.False(t, batches[1][0].Time.IsZero())
+}
+
+func TestNotifierFlushesOnStop(t *testing.T) {
+	r, srv := newReceiver(t)
+	n := New("test", HTTPSink{URL: srv.URL}, Options{BatchSize: 10, BatchWait: time.Hour})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx)
+		close(done)
+	}()
+
+	n.Notify(failed("default", alpine))
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Len(t, r.Batches(), 1)
+}
+
+func TestNotifierDrainsOnStop(t *testing.T) {
+	r, srv := newReceiver(t)
+	n := New("test", HTTPSink{URL: srv.URL}, Options{BatchSize: 2, BatchWait: time.Hour})
+
+	// The events are queued but not read by Run before ctx is done.
+	n.Notify(failed("default", "alpine:3.12"))
+	n.Notify(failed("default", "alpine:3.13"))
+	n.Notify(failed("default", "alpine:3.14"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n.Run(ctx)
+
+	sources := []string{}
+	for _, b := range r.Batches() {
+		assert.LessOrEqual(t, len(b), 2)
+		for _, e := range b {
+			sources = append(sources, e.Source)
+		}
+	}
+	assert.Equal(t, []string{"alpine:3.12", "alpine:3.13", "alpine:3.14"}, sources)
+}
+
+func TestNotifierRetriesWithSameID(t *testing.T) {
+	ids := make(chan string, 3)
+	attempts := 0
+	sink := sinkFunc(func(ctx context.Context, events []Event) error {
+		ids <- events[0].ID
+		if attempts++; attempts < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	n := New("test", sink, Options{BatchSize: 1, Retries: 3, Backoff: time.Millisecond})
+	run(t, n)
+
+	n.Notify(failed("default", alpine))
+	first := <-ids
+	assert.NotEmpty(t, first)
+	assert.Equal(t, first, <-ids)
+	assert.Equal(t, first, <-ids)
+}
+
+func TestNotifierRetries(t *testing.T) {
+	cases := map[string]struct {
+		responses []int
+		retries   int
+		requests  int
+		sent      bool
+	}{
+		"unavailable":  {responses: []int{503, 503}, retries: 3, requests: 3, sent: true},
+		"rate-limited": {responses: []int{429}, retries: 3, requests: 2, sent: true},
+		"exhausted":    {responses: []int{500, 500, 500}, retries: 2, requests: 3, sent: false},
+		"bad-request":  {responses: []int{400}, retries: 3, requests: 1, sent: false},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, srv := newReceiver(t, tc.responses...)
+			n := New("test", HTTPSink{URL: srv.URL}, Options{
+				BatchSize: 1,
+				Retries:   tc.retries,
+				Backoff:   time.Millisecond,
+			})
+			run(t, n)
+
+			n.Notify(failed("default", alpine))
+			r.wait(t, tc.requests)
+
+			// No request follows the last one expected.
+			select {
+			case <-r.received:
+				t.Fatal("unexpected request")
+			case <-time.After(50 * time.Millisecond):
+			}
+			assert.Equal(t, tc.sent, len(r.Batches()) == 1)
+		})
+	}
+}
+
+func TestNotifierFilters(t *testing.T) {
+	n := New("test", HTTPSink{}, Options{
+		Types:      []string{"clone.failed", "upstream.*"},
+		Namespaces: []string{"default", "prod"},
+	})
+
+	n.Notify(failed("default", alpine))
+	n.Notify(failed("dev", alpine))
+	n.Notify(Event{Type: CloneSucceeded, Namespace: "default"})
+	n.Notify(Event{Type: Upstream("gone"), Namespace: "prod"})
+
+	assert.Len(t, n.events, 2)
+	assert.Equal(t, CloneFailed, (<-n.events).Type)
+	assert.Equal(t, Type("upstream.gone"), (<-n.events).Type)
+}
+
+func TestNotifierQueueFull(t *testing.T) {
+	n := New("test", HTTPSink{}, Options{QueueSize: 1})
+	n.Notify(failed("default", alpine))
+	n.Notify(failed("default", alpine))
+	assert.Len(t, n.events, 1)
+}
+
+type sinkFunc func(ctx context.Context, events []Event) error
+
+func (f sinkFunc) Send(ctx context.Context, events []Event) error {
+	return f(ctx, events)
+}
+
+func TestNotifiers(t *testing.T) {
+	sent := make(chan string, 2)
+	sink := func(name string) Sink {
+		return sinkFunc(func(ctx context.Context, events []Event) error {
+			sent <- name
+			return PermanentError{errors.New("unused")}
+		})
+	}
+	ns := Notifiers{
+		New("failures", sink("failures"), Options{Types: []string{"clone.failed"}, BatchSize: 1}),
+		New("all", sink("all"), Options{BatchSize: 1}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ns.Run(ctx)
+		close(done)
+	}()
+
+	ns.Notify(Event{Type: CloneSucceeded})
+	assert.Equal(t, "all", <-sent)
+	cancel()
+	<-done
+	assert.Empty(t, sent)
+}
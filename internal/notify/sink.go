@@ -0,0 +1,154 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// sinkTimeout bounds each request of a sink.
+const sinkTimeout = 10 * time.Second
+
+// HTTPSink POSTs each batch as a JSON array of events.
+type HTTPSink struct {
+	URL string
+
+	// Header is added to each request, such as an Authorization header.
+	Header http.Header
+
+	// Client sends the requests; a client with a timeout if nil.
+	Client *http.Client
+}
+
+// Send POSTs events to s.URL.
+func (s HTTPSink) Send(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return PermanentError{err}
+	}
+	return post(ctx, s.Client, s.URL, s.Header, "application/json", body)
+}
+
+// DefaultCloudEventsSource is the source of the CloudEvents of a
+// CloudEventsSink without one.
+const DefaultCloudEventsSource = "image-cloner"
+
+// cloudEventTypePrefix prefixes the type of an event in its CloudEvent, as
+// in io.image-cloner.clone.failed.
+const cloudEventTypePrefix = "io.image-cloner."
+
+// CloudEventsSink POSTs each batch as CloudEvents 1.0 in the batched
+// content mode of the HTTP binding, with the event as data.
+type CloudEventsSink struct {
+	URL string
+
+	// Source is the source attribute of the CloudEvents;
+	// DefaultCloudEventsSource if empty.
+	Source string
+
+	// Header is added to each request, such as an Authorization header.
+	Header http.Header
+
+	// Client sends the requests; a client with a timeout if nil.
+	Client *http.Client
+}
+
+// cloudEvent is an event in the JSON format of CloudEvents 1.0.
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Event     `json:"data"`
+}
+
+// Send POSTs events to s.URL.
+func (s CloudEventsSink) Send(ctx context.Context, events []Event) error {
+	source := s.Source
+	if source == "" {
+		source = DefaultCloudEventsSource
+	}
+
+	batch := make([]cloudEvent, 0, len(events))
+	for _, e := range events {
+		id := e.ID
+		if id == "" {
+			id = string(uuid.NewUUID())
+		}
+		ce := cloudEvent{
+			SpecVersion:     "1.0",
+			ID:              id,
+			Source:          source,
+			Type:            cloudEventTypePrefix + string(e.Type),
+			Time:            e.Time,
+			DataContentType: "application/json",
+			Data:            e,
+		}
+		if e.Kind != "" {
+			ce.Subject = fmt.Sprintf("%s %s/%s", e.Kind, e.Namespace, e.Name)
+		}
+		batch = append(batch, ce)
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return PermanentError{err}
+	}
+	return post(ctx, s.Client, s.URL, s.Header, "application/cloudevents-batch+json", body)
+}
+
+// post POSTs body to url. Responses other than 2xx are errors, permanent
+// unless the receiver may accept the request later.
+func post(ctx context.Context, client *http.Client, url string, header http.Header, contentType string, body []byte) error {
+	if client == nil {
+		client = &http.Client{Timeout: sinkTimeout}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return PermanentError{err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode == http.StatusRequestTimeout, res.StatusCode >= 500:
+		return fmt.Errorf("%s responded %s", url, res.Status)
+	}
+	return PermanentError{fmt.Errorf("%s responded %s", url, res.Status)}
+}
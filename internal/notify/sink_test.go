@@ -0,0 +1,102 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSink(t *testing.T) {
+	r, srv := newReceiver(t)
+	sink := HTTPSink{URL: srv.URL, Header: http.Header{"Authorization": {"Bearer token"}}}
+
+	e := failed("default", alpine)
+	e.Time = time.Date(2021, 6, 1, 10, 12, 3, 0, time.UTC)
+	assert.NoError(t, sink.Send(context.Background(), []Event{e}))
+
+	assert.Equal(t, "application/json", r.contentType)
+	assert.Equal(t, "Bearer token", r.header.Get("Authorization"))
+	assert.Equal(t, [][]Event{{e}}, r.Batches())
+}
+
+func TestHTTPSinkErrors(t *testing.T) {
+	cases := map[string]struct {
+		code      int
+		permanent bool
+	}{
+		"not-found":   {code: 404, permanent: true},
+		"unavailable": {code: 503, permanent: false},
+		"throttled":   {code: 429, permanent: false},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, srv := newReceiver(t, tc.code)
+			err := HTTPSink{URL: srv.URL}.Send(context.Background(), []Event{failed("default", alpine)})
+			assert.Error(t, err)
+			assert.Equal(t, tc.permanent, errors.As(err, &PermanentError{}))
+		})
+	}
+}
+
+func TestCloudEventsSink(t *testing.T) {
+	var body []byte
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentType = req.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer srv.Close()
+
+	e := failed("default", alpine)
+	e.Error = "failed to pull docker image: not found"
+	e.Time = time.Date(2021, 6, 1, 10, 12, 3, 0, time.UTC)
+	sink := CloudEventsSink{URL: srv.URL}
+	assert.NoError(t, sink.Send(context.Background(), []Event{e, e}))
+
+	assert.Equal(t, "application/cloudevents-batch+json", contentType)
+	var batch []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &batch))
+	assert.Len(t, batch, 2)
+
+	ce := batch[0]
+	assert.Equal(t, "1.0", ce["specversion"])
+	assert.Equal(t, "image-cloner", ce["source"])
+	assert.Equal(t, "io.image-cloner.clone.failed", ce["type"])
+	assert.Equal(t, "Deployment default/alpine", ce["subject"])
+	assert.Equal(t, "2021-06-01T10:12:03Z", ce["time"])
+	assert.Equal(t, "application/json", ce["datacontenttype"])
+	assert.NotEmpty(t, ce["id"])
+	assert.NotEqual(t, ce["id"], batch[1]["id"])
+
+	// The ID of an event is kept.
+	e.ID = "0b6f3c1e-5a55-4c1c-9d3b-3f7b3f0f2a0e"
+	assert.NoError(t, sink.Send(context.Background(), []Event{e}))
+	assert.NoError(t, json.Unmarshal(body, &batch))
+	assert.Equal(t, e.ID, batch[0]["id"])
+
+	data := ce["data"].(map[string]interface{})
+	assert.Equal(t, alpine, data["source"])
+	assert.Equal(t, e.Error, data["error"])
+}
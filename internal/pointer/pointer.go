@@ -0,0 +1,65 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pointer resolves JSON pointers (RFC 6901) in decoded JSON
+// objects.
+package pointer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse splits a JSON pointer into its unescaped tokens.
+func Parse(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must start with /", p)
+	}
+
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// Escape escapes token for use in a JSON pointer.
+func Escape(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// Resolve returns the value at tokens in node, as decoded by encoding/json,
+// and whether it exists.
+func Resolve(node interface{}, tokens []string) (interface{}, bool) {
+	for _, t := range tokens {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			next, ok := v[t]
+			if !ok {
+				return nil, false
+			}
+			node = next
+		case []interface{}:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			node = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
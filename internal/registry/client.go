@@ -0,0 +1,423 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+var (
+	// ErrNotFound is returned when the requested manifest does not exist.
+	ErrNotFound = errors.New("manifest not found")
+
+	// ErrRateLimited is returned when the registry refuses a request
+	// because too many were made.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrCorrupt is returned when the content of a manifest or blob does
+	// not match its digest or size.
+	ErrCorrupt = errors.New("content does not match its descriptor")
+)
+
+// Client defines the operations that can be performed with the registry API
+// of the backup and source registries.
+type Client interface {
+	// ConfigDigest returns the digest of the config of the image ref points
+	// to, which is the ID Docker gives the image once pulled. platform, as
+	// os/arch[/variant], selects the image of an index; linux/amd64 if
+	// empty.
+	ConfigDigest(ctx context.Context, ref, platform string) (string, error)
+
+	// Head returns the digest of the manifest ref points to, without
+	// fetching the manifest.
+	Head(ctx context.Context, ref string) (string, error)
+
+	// Verify fetches the manifest ref points to and every blob it
+	// references, checking that their content matches their digest. The
+	// error wraps ErrCorrupt if one does not, and ErrNotFound if one is
+	// missing.
+	Verify(ctx context.Context, ref string) (Verified, error)
+
+	// ConfigDigests returns the digest of the config of the image ref
+	// points to, or of every image of the index it points to.
+	ConfigDigests(ctx context.Context, ref string) ([]string, error)
+
+	// Repositories returns the repositories of the backup registry under
+	// namespace, as listed by its catalog.
+	Repositories(ctx context.Context, namespace string) ([]string, error)
+
+	// Tags returns the tags of repo.
+	Tags(ctx context.Context, repo string) ([]string, error)
+
+	// Describe returns the manifest digest and creation time of the image
+	// ref points to.
+	Describe(ctx context.Context, ref string) (Manifest, error)
+
+	// Delete deletes the manifest of repo with digest, and with it every
+	// tag that points to it.
+	Delete(ctx context.Context, repo, digest string) error
+}
+
+// Manifest describes the image a tag points to.
+type Manifest struct {
+	Digest string
+
+	// Created is zero if the image does not record when it was created,
+	// as for an index of images.
+	Created time.Time
+}
+
+// Verified describes a verified manifest.
+type Verified struct {
+	Digest string
+
+	// Configs are the digests of the configs of the images verified; one
+	// unless the manifest is an index.
+	Configs []string
+
+	// Blobs and Bytes count the blobs fetched, and their size.
+	Blobs int
+	Bytes int64
+}
+
+type registry struct {
+	backup   name.Registry
+	keychain authn.Keychain
+}
+
+// CreateClient returns a Client that authenticates to host, the backup
+// registry, with username and password, and anonymously to any other
+// registry. An empty host is Docker Hub.
+func CreateClient(host, username, password string) (Client, error) {
+	backup, err := name.NewRegistry(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registry{
+		backup: backup,
+		keychain: keychain{
+			registry: backup.RegistryStr(),
+			auth:     &authn.Basic{Username: username, Password: password},
+		},
+	}, nil
+}
+
+func (r *registry) ConfigDigest(ctx context.Context, ref, platform string) (string, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	opts := r.options(ctx)
+	if platform != "" {
+		opts = append(opts, remote.WithPlatform(parsePlatform(platform)))
+	}
+	desc, err := remote.Get(parsed, opts...)
+	if err != nil {
+		return "", notFound(err)
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return "", err
+	}
+
+	config, err := img.ConfigName()
+	if err != nil {
+		return "", err
+	}
+	return config.String(), nil
+}
+
+func (r *registry) Head(ctx context.Context, ref string) (string, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	desc, err := remote.Head(parsed, r.options(ctx)...)
+	if err != nil {
+		return "", notFound(err)
+	}
+	return desc.Digest.String(), nil
+}
+
+func (r *registry) Verify(ctx context.Context, ref string) (Verified, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return Verified{}, err
+	}
+
+	desc, err := remote.Get(parsed, r.options(ctx)...)
+	if err != nil {
+		return Verified{}, corrupt(notFound(err))
+	}
+
+	v := Verified{Digest: desc.Digest.String(), Configs: []string{}}
+	images, err := images(desc)
+	if err != nil {
+		return Verified{}, err
+	}
+	for _, img := range images {
+		if err := verifyImage(img, &v); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// verifyImage fetches the config and layers of img, whose content is
+// checked against their digest as they are read, and adds them to v.
+func verifyImage(img v1.Image, v *Verified) error {
+	config, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("config %s: %w", config, corrupt(notFound(err)))
+	}
+	v.Configs = append(v.Configs, config.String())
+	v.Blobs++
+	v.Bytes += int64(len(raw))
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		digest, err := l.Digest()
+		if err != nil {
+			return err
+		}
+
+		rc, err := l.Compressed()
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", digest, notFound(err))
+		}
+		n, err := io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", digest, corrupt(err))
+		}
+		v.Blobs++
+		v.Bytes += n
+	}
+	return nil
+}
+
+func (r *registry) ConfigDigests(ctx context.Context, ref string) ([]string, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := remote.Get(parsed, r.options(ctx)...)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	images, err := images(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := []string{}
+	for _, img := range images {
+		config, err := img.ConfigName()
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config.String())
+	}
+	return configs, nil
+}
+
+// images returns the image desc describes, or the images of the index it
+// describes.
+func images(desc *remote.Descriptor) ([]v1.Image, error) {
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		return []v1.Image{img}, nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []v1.Image{}
+	for _, m := range manifest.Manifests {
+		if !m.MediaType.IsImage() {
+			continue
+		}
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func (r *registry) Repositories(ctx context.Context, namespace string) ([]string, error) {
+	repos, err := remote.Catalog(ctx, r.backup, remote.WithAuthFromKeychain(r.keychain))
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, repo := range repos {
+		if !strings.HasPrefix(repo, namespace+"/") {
+			continue
+		}
+		parsed, err := name.NewRepository(r.backup.RegistryStr() + "/" + repo)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, parsed.Name())
+	}
+	return names, nil
+}
+
+func (r *registry) Tags(ctx context.Context, repo string) ([]string, error) {
+	parsed, err := name.NewRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := remote.List(parsed, r.options(ctx)...)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return tags, nil
+}
+
+func (r *registry) Describe(ctx context.Context, ref string) (Manifest, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	desc, err := remote.Get(parsed, r.options(ctx)...)
+	if err != nil {
+		return Manifest{}, notFound(err)
+	}
+
+	m := Manifest{Digest: desc.Digest.String()}
+	if !desc.MediaType.IsImage() {
+		return m, nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return Manifest{}, err
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return Manifest{}, err
+	}
+	m.Created = config.Created.Time
+	return m, nil
+}
+
+func (r *registry) Delete(ctx context.Context, repo, digest string) error {
+	ref, err := name.NewDigest(repo + "@" + digest)
+	if err != nil {
+		return err
+	}
+	return notFound(remote.Delete(ref, r.options(ctx)...))
+}
+
+func (r *registry) options(ctx context.Context) []remote.Option {
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(r.keychain),
+	}
+}
+
+// parsePlatform parses a platform written as os/arch[/variant].
+func parsePlatform(s string) v1.Platform {
+	var p v1.Platform
+	parts := strings.SplitN(s, "/", 3)
+	p.OS = parts[0]
+	if len(parts) > 1 {
+		p.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return p
+}
+
+// notFound translates a response with status 404 to ErrNotFound, and with
+// status 429 to ErrRateLimited.
+func notFound(err error) error {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		switch terr.StatusCode {
+		case http.StatusNotFound:
+			return ErrNotFound
+		case http.StatusTooManyRequests:
+			return ErrRateLimited
+		}
+	}
+	return err
+}
+
+// corrupt returns ErrCorrupt wrapping err if err reports content that does
+// not match its digest or size, as checked by go-containerregistry while
+// reading it, and err otherwise.
+func corrupt(err error) error {
+	msg := err.Error()
+	if strings.Contains(msg, "error verifying") || strings.Contains(msg, "does not match") {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return err
+}
+
+// keychain resolves the credentials of the backup registry.
+type keychain struct {
+	registry string
+	auth     authn.Authenticator
+}
+
+func (k keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if target.RegistryStr() == k.registry {
+		return k.auth, nil
+	}
+	return authn.Anonymous, nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRegistry starts an in-memory registry and returns its host.
+func testRegistry(t *testing.T) string {
+	srv := httptest.NewServer(ggcrregistry.New())
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func TestConfigDigest(t *testing.T) {
+	host := testRegistry(t)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/gauravgahlot/alpine:3.12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	config, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := CreateClient(host, "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.ConfigDigest(context.Background(), ref.String(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, config.String(), got)
+
+	_, err = c.ConfigDigest(context.Background(), host+"/gauravgahlot/alpine:3.13", "")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRepositoriesTagsAndDelete(t *testing.T) {
+	host := testRegistry(t)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{"gauravgahlot/alpine:3.12", "gauravgahlot/busybox:1.33", "other/alpine:3.12"} {
+		ref, err := name.ParseReference(host + "/" + r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := CreateClient(host, "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	repos, err := c.Repositories(ctx, "gauravgahlot")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{host + "/gauravgahlot/alpine", host + "/gauravgahlot/busybox"}, repos)
+
+	tags, err := c.Tags(ctx, host+"/gauravgahlot/alpine")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3.12"}, tags)
+
+	m, err := c.Describe(ctx, host+"/gauravgahlot/alpine:3.12")
+	assert.NoError(t, err)
+	assert.Equal(t, Manifest{Digest: digest.String(), Created: config.Created.Time}, m)
+
+	assert.NoError(t, c.Delete(ctx, host+"/gauravgahlot/alpine", digest.String()))
+	_, err = c.Describe(ctx, host+"/gauravgahlot/alpine@"+digest.String())
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, c.Delete(ctx, host+"/gauravgahlot/alpine", digest.String()), ErrNotFound)
+}
+
+func TestHead(t *testing.T) {
+	host := testRegistry(t)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/library/alpine:3.12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(limited.Close)
+
+	c, err := CreateClient("", "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	got, err := c.Head(ctx, ref.String())
+	assert.NoError(t, err)
+	assert.Equal(t, digest.String(), got)
+
+	_, err = c.Head(ctx, host+"/library/alpine:3.13")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = c.Head(ctx, strings.TrimPrefix(limited.URL, "http://")+"/library/alpine:3.12")
+	assert.ErrorIs(t, err, ErrRateLimited)
+}
+
+func TestVerify(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted, err := layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The registry serves the second layer with different content once
+	// corrupt is set, and refuses to serve it once denied is set.
+	corrupt, denied := false, false
+	backend := ggcrregistry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+corrupted.String()) {
+			switch {
+			case corrupt:
+				_, _ = w.Write(make([]byte, 1024))
+				return
+			case denied:
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	ref, err := name.ParseReference(host + "/gauravgahlot/alpine:3.12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := CreateClient(host, "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	v, err := c.Verify(ctx, ref.String())
+	assert.NoError(t, err)
+	assert.Equal(t, digest.String(), v.Digest)
+	assert.Equal(t, []string{config.String()}, v.Configs)
+	assert.Equal(t, 3, v.Blobs)
+
+	configs, err := c.ConfigDigests(ctx, ref.String())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{config.String()}, configs)
+
+	corrupt = true
+	_, err = c.Verify(ctx, ref.String())
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// A blob that cannot be fetched is not reported as corrupt.
+	corrupt, denied = false, true
+	_, err = c.Verify(ctx, ref.String())
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrCorrupt))
+
+	_, err = c.Verify(ctx, host+"/gauravgahlot/alpine:3.13")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestConfigDigestsIndex(t *testing.T) {
+	host := testRegistry(t)
+
+	idx, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/library/alpine:3.12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{}
+	for _, m := range manifest.Manifests {
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := img.ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, config.String())
+	}
+
+	c, err := CreateClient("", "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.ConfigDigests(context.Background(), ref.String())
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestConfigDigestPlatform(t *testing.T) {
+	host := testRegistry(t)
+
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}}
+	idx := v1.ImageIndex(empty.Index)
+	configs := []string{}
+	for i := range platforms {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := img.ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config.String())
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platforms[i]},
+		})
+	}
+	ref, err := name.ParseReference(host + "/library/alpine:3.12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := CreateClient("", "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	got, err := c.ConfigDigest(ctx, ref.String(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, configs[0], got)
+
+	got, err = c.ConfigDigest(ctx, ref.String(), "linux/arm64/v8")
+	assert.NoError(t, err)
+	assert.Equal(t, configs[1], got)
+
+	_, err = c.ConfigDigest(ctx, ref.String(), "windows/amd64")
+	assert.Error(t, err)
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+
+	"github.com/gauravgahlot/image-cloner/internal/tracing"
+)
+
+// Traced returns a Client recording a span for each call to c.
+func Traced(c Client) Client {
+	return traced{c: c}
+}
+
+type traced struct {
+	c Client
+}
+
+func (t traced) ConfigDigest(ctx context.Context, ref, platform string) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "registry.ConfigDigest", tracing.Image.String(ref))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ConfigDigest(ctx, ref, platform)
+}
+
+func (t traced) Head(ctx context.Context, ref string) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "registry.Head", tracing.Image.String(ref))
+	defer func() { tracing.End(span, err) }()
+	return t.c.Head(ctx, ref)
+}
+
+func (t traced) Verify(ctx context.Context, ref string) (_ Verified, err error) {
+	ctx, span := tracing.Start(ctx, "registry.Verify", tracing.Image.String(ref))
+	defer func() { tracing.End(span, err) }()
+	return t.c.Verify(ctx, ref)
+}
+
+func (t traced) ConfigDigests(ctx context.Context, ref string) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "registry.ConfigDigests", tracing.Image.String(ref))
+	defer func() { tracing.End(span, err) }()
+	return t.c.ConfigDigests(ctx, ref)
+}
+
+func (t traced) Repositories(ctx context.Context, namespace string) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "registry.Repositories", tracing.Image.String(namespace))
+	defer func() { tracing.End(span, err) }()
+	return t.c.Repositories(ctx, namespace)
+}
+
+func (t traced) Tags(ctx context.Context, repo string) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "registry.Tags", tracing.Image.String(repo))
+	defer func() { tracing.End(span, err) }()
+	return t.c.Tags(ctx, repo)
+}
+
+func (t traced) Describe(ctx context.Context, ref string) (_ Manifest, err error) {
+	ctx, span := tracing.Start(ctx, "registry.Describe", tracing.Image.String(ref))
+	defer func() { tracing.End(span, err) }()
+	return t.c.Describe(ctx, ref)
+}
+
+func (t traced) Delete(ctx context.Context, repo, digest string) (err error) {
+	ctx, span := tracing.Start(ctx, "registry.Delete", tracing.Image.String(repo+"@"+digest))
+	defer func() { tracing.End(span, err) }()
+	return t.c.Delete(ctx, repo, digest)
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/pointer"
+)
+
+// containersPath is the path of the containers of the pod template of the
+// built-in workloads, where the images recorded without a path are.
+const containersPath = "/spec/template/spec/containers"
+
+// Options selects the workloads to revert.
+type Options struct {
+	// Namespace to revert; all namespaces if empty.
+	Namespace string
+
+	// Selector is a label selector the workloads must match.
+	Selector string
+
+	// Kinds are the kinds registered in the workloads config, whose objects
+	// are reverted along with the Deployments and DaemonSets.
+	Kinds []schema.GroupVersionKind
+
+	// DryRun reports what would be reverted without patching.
+	DryRun bool
+}
+
+// Result describes the revert of a workload.
+type Result struct {
+	Kind      string
+	Namespace string
+	Name      string
+
+	// Images maps the name of each reverted container to its original image.
+	Images map[string]string
+
+	Err error
+}
+
+// Run restores the original images recorded in the annotations of the
+// workloads selected by opts, and removes the annotation. Workloads without
+// the annotation are left alone. The objects are listed and patched with
+// dyn, and the resources of opts.Kinds resolved with the discovery API of
+// cs.
+func Run(ctx context.Context, cs kubernetes.Interface, dyn dynamic.Interface, opts Options) ([]Result, error) {
+	registered, err := kube.Resources(cs, opts.Kinds)
+	if err != nil {
+		return nil, err
+	}
+	resources := append([]schema.GroupVersionResource{kube.DeploymentResource, kube.DaemonSetResource}, registered...)
+
+	results := []Result{}
+	for _, gvr := range resources {
+		client := dyn.Resource(gvr)
+		list, err := client.Namespace(opts.Namespace).List(ctx, metav1.ListOptions{LabelSelector: opts.Selector})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range list.Items {
+			if _, ok := obj.GetAnnotations()[annotation.OriginalImages]; !ok {
+				continue
+			}
+
+			res := Result{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+			images, patch, err := revertPatch(obj)
+			if err != nil {
+				res.Err = err
+				results = append(results, res)
+				continue
+			}
+
+			res.Images = images
+			if !opts.DryRun {
+				_, res.Err = client.Namespace(obj.GetNamespace()).Patch(ctx, obj.GetName(), types.JSONPatchType, patch, metav1.PatchOptions{})
+			}
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// revertPatch returns the original image of each container of obj that no
+// longer uses it, along with the JSON patch restoring them at their
+// recorded path and removing the annotation. The patch fails if an image
+// or the annotation changed since obj was read.
+func revertPatch(obj unstructured.Unstructured) (map[string]string, []byte, error) {
+	originals, err := annotation.Decode(obj.GetAnnotations())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	containers := make([]string, 0, len(originals))
+	for c := range originals {
+		containers = append(containers, c)
+	}
+	sort.Strings(containers)
+
+	images := map[string]string{}
+	patches := []patchOp{}
+	for _, c := range containers {
+		o := originals[c]
+		path := o.Path
+		if path == "" {
+			if path = containerImagePath(obj, c); path == "" {
+				continue
+			}
+		}
+		tokens, err := pointer.Parse(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("container %s: %v", c, err)
+		}
+
+		current, ok := pointer.Resolve(obj.Object, tokens)
+		if !ok || current == o.Image {
+			continue
+		}
+		images[c] = o.Image
+		patches = append(patches,
+			patchOp{Op: "test", Path: path, Value: current},
+			patchOp{Op: "replace", Path: path, Value: o.Image},
+		)
+	}
+
+	annotationPath := "/metadata/annotations/" + pointer.Escape(annotation.OriginalImages)
+	patches = append(patches,
+		patchOp{Op: "test", Path: annotationPath, Value: obj.GetAnnotations()[annotation.OriginalImages]},
+		patchOp{Op: "remove", Path: annotationPath},
+	)
+	patch, err := json.Marshal(patches)
+	if err != nil {
+		return nil, nil, err
+	}
+	return images, patch, nil
+}
+
+// containerImagePath returns the path of the image of the container named
+// name in the pod template of obj, or "" if there is none.
+func containerImagePath(obj unstructured.Unstructured, name string) string {
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	for i, c := range containers {
+		if m, ok := c.(map[string]interface{}); ok && m["name"] == name {
+			return fmt.Sprintf("%s/%d/image", containersPath, i)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revert
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+// originals records the image of the alpine container by its path, and
+// that of the removed container without one, as recorded before paths were.
+const originals = `{"alpine":{"image":"alpine:3.12","digest":"sha256:abc","path":"/spec/template/spec/containers/0/image"},"removed":{"image":"busybox:1.33"}}`
+
+var taskResource = schema.GroupVersionResource{Group: "tekton.dev", Version: "v1beta1", Resource: "tasks"}
+
+func deployment(namespace, name string, labels, annotations map[string]string, images ...string) *appsv1.Deployment {
+	d := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: kube.Deployment},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels, Annotations: annotations},
+	}
+	d.Spec.Template.Spec.Containers = containers(images...)
+	return d
+}
+
+func daemonSet(namespace, name string, annotations map[string]string, images ...string) *appsv1.DaemonSet {
+	d := &appsv1.DaemonSet{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: kube.DaemonSet},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+	}
+	d.Spec.Template.Spec.Containers = containers(images...)
+	return d
+}
+
+// task is a Tekton Task, whose images are those of its steps.
+func task(namespace, name string, annotations map[string]string, image string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "tekton.dev/v1beta1",
+		"kind":       "Task",
+		"spec": map[string]interface{}{"steps": []interface{}{
+			map[string]interface{}{"name": "build", "image": image},
+		}},
+	}}
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func containers(images ...string) []corev1.Container {
+	names := []string{"alpine", "sidecar"}
+	cs := []corev1.Container{}
+	for i, img := range images {
+		cs = append(cs, corev1.Container{Name: names[i], Image: img})
+	}
+	return cs
+}
+
+func objects() []runtime.Object {
+	annotated := map[string]string{annotation.OriginalImages: originals, "team": "platform"}
+	return []runtime.Object{
+		deployment("default", "alpine", map[string]string{"app": "alpine"}, annotated,
+			"gauravgahlot/alpine:3.12", "envoyproxy/envoy:v1.20"),
+		deployment("default", "untouched", nil, nil, "nginx:1.21"),
+		deployment("staging", "alpine", map[string]string{"app": "other"}, annotated,
+			"gauravgahlot/alpine:3.12"),
+		daemonSet("default", "agent", annotated, "gauravgahlot/alpine:3.12"),
+		task("default", "build", map[string]string{
+			annotation.OriginalImages: `{"build":{"image":"golang:1.16","path":"/spec/steps/0/image"}}`,
+		}, "gauravgahlot/golang:1.16"),
+	}
+}
+
+// clients returns the clients of a cluster serving Tekton Tasks, with the
+// objects.
+func clients(objs ...runtime.Object) (*fake.Clientset, *fakedynamic.FakeDynamicClient) {
+	cs := fake.NewSimpleClientset()
+	cs.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "tekton.dev/v1beta1",
+		APIResources: []metav1.APIResource{{Name: "tasks", Namespaced: true, Kind: "Task"}},
+	}}
+	dyn := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme,
+		map[schema.GroupVersionResource]string{taskResource: "TaskList"}, objs...)
+	return cs, dyn
+}
+
+func get(t *testing.T, dyn *fakedynamic.FakeDynamicClient, gvr schema.GroupVersionResource, namespace, name string) *unstructured.Unstructured {
+	obj, err := dyn.Resource(gvr).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	return obj
+}
+
+func images(t *testing.T, obj *unstructured.Unstructured, fields ...string) []string {
+	list, _, err := unstructured.NestedSlice(obj.Object, fields...)
+	assert.NoError(t, err)
+	images := []string{}
+	for _, c := range list {
+		images = append(images, c.(map[string]interface{})["image"].(string))
+	}
+	return images
+}
+
+func TestRun(t *testing.T) {
+	cs, dyn := clients(objects()...)
+	kinds := []schema.GroupVersionKind{{Group: "tekton.dev", Version: "v1beta1", Kind: "Task"}}
+
+	results, err := Run(context.Background(), cs, dyn, Options{Namespace: "default", Kinds: kinds})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []Result{
+		{Kind: kube.Deployment, Namespace: "default", Name: "alpine", Images: map[string]string{"alpine": "alpine:3.12"}},
+		{Kind: kube.DaemonSet, Namespace: "default", Name: "agent", Images: map[string]string{"alpine": "alpine:3.12"}},
+		{Kind: "Task", Namespace: "default", Name: "build", Images: map[string]string{"build": "golang:1.16"}},
+	}, results)
+
+	d := get(t, dyn, kube.DeploymentResource, "default", "alpine")
+	assert.Equal(t, map[string]string{"team": "platform"}, d.GetAnnotations())
+	assert.Equal(t, []string{"alpine:3.12", "envoyproxy/envoy:v1.20"}, images(t, d, "spec", "template", "spec", "containers"))
+
+	ds := get(t, dyn, kube.DaemonSetResource, "default", "agent")
+	assert.Equal(t, []string{"alpine:3.12"}, images(t, ds, "spec", "template", "spec", "containers"))
+
+	build := get(t, dyn, taskResource, "default", "build")
+	assert.Empty(t, build.GetAnnotations())
+	assert.Equal(t, []string{"golang:1.16"}, images(t, build, "spec", "steps"))
+
+	staging := get(t, dyn, kube.DeploymentResource, "staging", "alpine")
+	assert.Equal(t, []string{"gauravgahlot/alpine:3.12"}, images(t, staging, "spec", "template", "spec", "containers"))
+}
+
+func TestRunUnregisteredKinds(t *testing.T) {
+	cs, dyn := clients(objects()...)
+
+	// The objects of the kinds not registered are left alone.
+	results, err := Run(context.Background(), cs, dyn, Options{Namespace: "default"})
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+
+	build := get(t, dyn, taskResource, "default", "build")
+	assert.Equal(t, []string{"gauravgahlot/golang:1.16"}, images(t, build, "spec", "steps"))
+}
+
+func TestRunLegacyAnnotation(t *testing.T) {
+	// Annotations recorded without paths revert the containers of the pod
+	// template by name.
+	cs, dyn := clients(deployment("default", "alpine", nil,
+		map[string]string{annotation.OriginalImages: `{"sidecar":{"image":"envoyproxy/envoy:v1.20"}}`},
+		"alpine:3.12", "gauravgahlot/envoy:v1.20"))
+
+	results, err := Run(context.Background(), cs, dyn, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, []Result{
+		{Kind: kube.Deployment, Namespace: "default", Name: "alpine", Images: map[string]string{"sidecar": "envoyproxy/envoy:v1.20"}},
+	}, results)
+
+	d := get(t, dyn, kube.DeploymentResource, "default", "alpine")
+	assert.Equal(t, []string{"alpine:3.12", "envoyproxy/envoy:v1.20"}, images(t, d, "spec", "template", "spec", "containers"))
+}
+
+func TestRunSelector(t *testing.T) {
+	cs, dyn := clients(objects()...)
+
+	results, err := Run(context.Background(), cs, dyn, Options{Selector: "app=other"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Result{
+		{Kind: kube.Deployment, Namespace: "staging", Name: "alpine", Images: map[string]string{"alpine": "alpine:3.12"}},
+	}, results)
+}
+
+func TestRunDryRun(t *testing.T) {
+	cs, dyn := clients(objects()...)
+
+	results, err := Run(context.Background(), cs, dyn, Options{DryRun: true})
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+
+	for _, a := range dyn.Actions() {
+		assert.NotEqual(t, "patch", a.GetVerb())
+	}
+}
+
+func TestRunInvalidAnnotation(t *testing.T) {
+	cs, dyn := clients(
+		deployment("default", "alpine", nil, map[string]string{annotation.OriginalImages: "alpine:3.12"}, "gauravgahlot/alpine:3.12"),
+	)
+
+	results, err := Run(context.Background(), cs, dyn, Options{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+}
@@ -0,0 +1,279 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/jobs"
+)
+
+const (
+	// maxAPIRequestBytes bounds the size of the body of an API request.
+	maxAPIRequestBytes = 64 * 1024
+
+	// onDemandTimeout bounds a clone requested through the API, which
+	// outlives the request.
+	onDemandTimeout = 30 * time.Minute
+)
+
+// cloneRequest is the body of POST /clones.
+type cloneRequest struct {
+	Image string `json:"image"`
+}
+
+// resyncResponse is the resync of a source, in the response of POST
+// /resync.
+type resyncResponse struct {
+	Source    string   `json:"source"`
+	Digest    string   `json:"digest"`
+	Backup    string   `json:"backup,omitempty"`
+	RolledOut []string `json:"rolledOut"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// loadTokens reads the bearer tokens of the API from the file at path, one
+// per line.
+func loadTokens(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if t := strings.TrimSpace(line); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no token in %s", path)
+	}
+	return tokens, nil
+}
+
+// newAPIServer returns the HTTPS server of the API at addr. Requests must
+// carry one of tokens as a bearer token.
+func (s *server) newAPIServer(addr string, tlsConfig *tls.Config, tokens []string) *http.Server {
+	return &http.Server{Addr: addr, TLSConfig: tlsConfig, Handler: authenticate(tokens, s.apiHandler())}
+}
+
+func (s *server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clones", s.handleClones)
+	mux.HandleFunc("/clones/", s.handleClone)
+	mux.HandleFunc("/cache/", s.handleCache)
+	mux.HandleFunc("/resync", s.handleResync)
+	mux.HandleFunc("/explain", s.handleExplain)
+	mux.Handle("/upstream", s.upstream)
+	mux.Handle("/verify", s.verifier)
+	return mux
+}
+
+// authenticate serves the requests carrying one of tokens as a bearer token
+// with next, and refuses the others.
+func authenticate(tokens []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			got := []byte(strings.TrimPrefix(auth, "Bearer "))
+			for _, t := range tokens {
+				if subtle.ConstantTimeCompare(got, []byte(t)) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="image-cloner"`)
+		writeStatus(w, http.StatusUnauthorized, metav1.StatusReasonUnauthorized, "a valid bearer token is required")
+	})
+}
+
+// handleClones lists the clone jobs matching the query on GET, and starts
+// the clone of an image on POST.
+func (s *server) handleClones(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		writeJSON(w, http.StatusOK, s.jobs.List(jobs.Filter{
+			Status:      jobs.Status(q.Get("status")),
+			Source:      q.Get("source"),
+			Destination: q.Get("destination"),
+			Kind:        q.Get("kind"),
+			Namespace:   q.Get("namespace"),
+			Name:        q.Get("name"),
+		}))
+	case http.MethodPost:
+		var req cloneRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIRequestBytes)).Decode(&req); err != nil {
+			writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid request: %v", err))
+			return
+		}
+		if _, err := name.ParseReference(req.Image); err != nil {
+			writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid image: %v", err))
+			return
+		}
+		if s.isUsingBackupRegistry(req.Image) {
+			writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest,
+				fmt.Sprintf("image %s is already in the backup registry", req.Image))
+			return
+		}
+
+		job := s.cloneOnDemand(req.Image)
+		w.Header().Set("Location", "/clones/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// cloneOnDemand starts the clone of src in the background, and returns its
+// job.
+func (s *server) cloneOnDemand(src string) jobs.Job {
+	img := image{ref: src}
+	id := s.startJob(eventTarget{}, img)
+	job, _ := s.jobs.Get(id)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), onDemandTimeout)
+		defer cancel()
+		if _, _, err := s.runJob(ctx, id, eventTarget{}, img); err != nil {
+			klog.ErrorS(err, "Failed to clone image on demand", "job", id, "source", src)
+		}
+	}()
+	return job
+}
+
+// handleClone writes the clone job whose ID follows /clones/ in the path,
+// or streams its progress under /clones/{id}/progress.
+func (s *server) handleClone(w http.ResponseWriter, r *http.Request) {
+	id, rest := splitClonePath(r.URL.Path)
+	switch rest {
+	case "":
+	case "/progress":
+		s.handleProgress(w, r, id)
+		return
+	default:
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("path %s not found", r.URL.Path))
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	job, ok := s.jobs.Get(id)
+	if !ok {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("clone %q not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleCache removes the image referenced by the rest of the path from
+// the local Docker daemon, unless a clone is using it.
+func (s *server) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ref := strings.TrimPrefix(r.URL.Path, "/cache/")
+	if _, err := name.ParseReference(ref); err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid image: %v", err))
+		return
+	}
+
+	err := s.removeCached(r.Context(), ref)
+	switch {
+	case errors.Is(err, errImageNotCached):
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, err.Error())
+	case errors.Is(err, errImageInUse):
+		writeStatus(w, http.StatusConflict, metav1.StatusReasonConflict, err.Error())
+	case err != nil:
+		klog.ErrorS(err, "Failed to remove image", "image", ref)
+		writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleResync resyncs the sources whose tag moved, as the periodic resync
+// of the leader does, and writes the sources resynced. Only the leader
+// resyncs, so that it does not copy and roll out the same sources as the
+// periodic resync at the same time.
+func (s *server) handleResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+	if s.resyncer == nil {
+		writeStatus(w, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable,
+			"resync requires a lease namespace")
+		return
+	}
+	if !s.isLeader() {
+		writeStatus(w, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable,
+			"resync runs on the leader, and this replica is not the leader; retry on the replica holding the image-cloner Lease")
+		return
+	}
+
+	results, err := s.resync(r.Context())
+	if err != nil {
+		klog.ErrorS(err, "Resync failed")
+		writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+		return
+	}
+
+	res := make([]resyncResponse, 0, len(results))
+	for _, r := range results {
+		rr := resyncResponse{Source: r.image, Digest: r.digest, Backup: r.backup, RolledOut: r.rolled}
+		if r.err != nil {
+			rr.Error = r.err.Error()
+		}
+		res = append(res, rr)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed,
+		fmt.Sprintf("method %s is not allowed", r.Method))
+}
+
+// writeJSON writes v as JSON with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.ErrorS(err, "Failed to write the response")
+	}
+}
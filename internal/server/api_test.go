@@ -0,0 +1,214 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/gauravgahlot/image-cloner/internal/jobs"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/upstream"
+	"github.com/gauravgahlot/image-cloner/internal/verify"
+)
+
+const apiToken = "secret"
+
+// apiRequest sends a request with the API token to the API served by srv,
+// and decodes the JSON response into v, unless it is nil.
+func apiRequest(t *testing.T, srv *httptest.Server, method, path, body string, v interface{}) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	if v != nil {
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(v))
+	}
+	return res
+}
+
+func testAPI(t *testing.T, s *server) *httptest.Server {
+	srv := httptest.NewServer(s.newAPIServer("", nil, []string{"other", apiToken}).Handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	srv := testAPI(t, testServer(t, dockerClient()))
+
+	for name, auth := range map[string]string{
+		"missing": "",
+		"wrong":   "Bearer nope",
+		"basic":   "Basic " + apiToken,
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/clones", nil)
+			assert.NoError(t, err)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+
+			res, err := srv.Client().Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+			assert.NotEmpty(t, res.Header.Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestAPIReports(t *testing.T) {
+	s := testServer(t, dockerClient())
+	s.upstream = upstream.NewChecker(nil, upstreamQPS)
+	s.verifier = verify.NewVerifier(nil)
+	srv := testAPI(t, s)
+
+	var checked upstream.Report
+	res := apiRequest(t, srv, http.MethodGet, "/upstream", "", &checked)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, checked.Sources)
+
+	var verified verify.Report
+	res = apiRequest(t, srv, http.MethodGet, "/verify", "", &verified)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, verified.Results)
+
+	// The reports are not served without a token.
+	res, err := srv.Client().Get(srv.URL + "/upstream")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestAPIClones(t *testing.T) {
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser))
+	s.jobs = jobs.NewStore(10)
+	srv := testAPI(t, s)
+
+	var job jobs.Job
+	res := apiRequest(t, srv, http.MethodPost, "/clones", `{"image":"alpine:3.12"}`, &job)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.Equal(t, "/clones/"+job.ID, res.Header.Get("Location"))
+	assert.Equal(t, alpine, job.Source)
+
+	assert.Eventually(t, func() bool {
+		apiRequest(t, srv, http.MethodGet, "/clones/"+job.ID, "", &job)
+		return job.Status != jobs.Running
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, jobs.Succeeded, job.Status)
+	assert.Equal(t, "gauravgahlot/alpine:3.12", job.Destination)
+	assert.Equal(t, digest, job.Digest)
+
+	// A clone of a workload is listed along with the clone on demand.
+	d := testDeployment("default", "busybox", "busybox:1.33")
+	_, err := s.tryCreatePatches(context.Background(), workloadTarget(kube.DeploymentWorkload(d)),
+		containerImages(containersPath, d.Spec.Template.Spec.Containers), nil)
+	assert.NoError(t, err)
+
+	list := []jobs.Job{}
+	apiRequest(t, srv, http.MethodGet, "/clones", "", &list)
+	assert.Len(t, list, 2)
+
+	apiRequest(t, srv, http.MethodGet, "/clones?namespace=default&name=busybox&status=succeeded", "", &list)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "busybox:1.33", list[0].Source)
+	assert.Equal(t, "alpine", list[0].Container)
+
+	apiRequest(t, srv, http.MethodGet, "/clones?status=failed", "", &list)
+	assert.Empty(t, list)
+
+	res = apiRequest(t, srv, http.MethodGet, "/clones/unknown", "", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestAPICloneInvalid(t *testing.T) {
+	srv := testAPI(t, testServer(t, dockerClient(), withRegistryUser(registryUser)))
+
+	cases := map[string]struct {
+		method, body string
+		code         int
+	}{
+		"not-json":    {http.MethodPost, `alpine`, http.StatusBadRequest},
+		"invalid-ref": {http.MethodPost, `{"image":"Alpine:3.12"}`, http.StatusBadRequest},
+		"backup":      {http.MethodPost, `{"image":"gauravgahlot/alpine:3.12"}`, http.StatusBadRequest},
+		"method":      {http.MethodPut, `{"image":"alpine:3.12"}`, http.StatusMethodNotAllowed},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			res := apiRequest(t, srv, tc.method, "/clones", tc.body, nil)
+			assert.Equal(t, tc.code, res.StatusCode)
+		})
+	}
+}
+
+func TestAPIRemoveCached(t *testing.T) {
+	removed := []string{}
+	s := testServer(t, localDockerClient(map[string]bool{alpine: true}, &removed), withLocalImages())
+	srv := testAPI(t, s)
+
+	res := apiRequest(t, srv, http.MethodDelete, "/cache/busybox:1.33", "", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// An image pulled by a running clone is not removed.
+	s.local.inFlight[alpine] = 1
+	res = apiRequest(t, srv, http.MethodDelete, "/cache/"+alpine, "", nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	assert.Empty(t, removed)
+
+	delete(s.local.inFlight, alpine)
+	res = apiRequest(t, srv, http.MethodDelete, "/cache/"+alpine, "", nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, []string{alpine}, removed)
+}
+
+func TestAPIResync(t *testing.T) {
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser), withRegistryClient(mockRegistryClient{
+		HeadFunc: func(ctx context.Context, ref string) (string, error) { return digest, nil },
+	}))
+	srv := testAPI(t, s)
+
+	res := apiRequest(t, srv, http.MethodPost, "/resync", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	s.kube = fake.NewSimpleClientset(resyncObjects()...)
+	s.resyncer = &resyncer{policy: ResyncBackup, copied: map[string]string{}}
+
+	// Replicas that are not the leader do not resync.
+	res = apiRequest(t, srv, http.MethodPost, "/resync", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	s.leading = 1
+
+	results := []resyncResponse{}
+	res = apiRequest(t, srv, http.MethodPost, "/resync", "", &results)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []resyncResponse{{
+		Source:    "alpine:latest",
+		Digest:    digest,
+		Backup:    "gauravgahlot/alpine:latest-d4ff818577bc",
+		RolledOut: []string{"Deployment rolling/alpine"},
+	}}, results)
+}
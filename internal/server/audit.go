@@ -0,0 +1,84 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+
+	v1 "k8s.io/api/admission/v1"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/audit"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+)
+
+// admission is the admission request that images are cloned for, along
+// with the audit records of the decisions on its images.
+type admission struct {
+	req     *v1.AdmissionRequest
+	records []audit.Record
+}
+
+// auditDecisions maps the type of the outcome of a clone to the decision
+// recorded in the audit log.
+var auditDecisions = map[notify.Type]audit.Decision{
+	notify.CloneSucceeded: audit.Rewritten,
+	notify.CloneSkipped:   audit.Skipped,
+	notify.CloneFailed:    audit.Denied,
+}
+
+// add adds the audit record of the outcome e of a clone for a.
+func (a *admission) add(e notify.Event) {
+	r := audit.Record{
+		UID: string(a.req.UID),
+		User: audit.User{
+			Username: a.req.UserInfo.Username,
+			UID:      a.req.UserInfo.UID,
+			Groups:   a.req.UserInfo.Groups,
+		},
+		Operation: string(a.req.Operation),
+		Kind:      e.Kind,
+		Namespace: e.Namespace,
+		Name:      e.Name,
+		Container: e.Container,
+		OldImage:  e.Source,
+		NewImage:  e.Destination,
+		Digest:    e.Digest,
+		Decision:  auditDecisions[e.Type],
+	}
+	if r.Decision != audit.Rewritten {
+		r.Reason = e.Message
+	}
+	a.records = append(a.records, r)
+}
+
+// writeAudit writes the audit records of a once the webhook decided whether
+// the object is allowed. The images of an object that was denied are not
+// rewritten, even those that were cloned.
+func (s *server) writeAudit(ctx context.Context, a *admission, allowed bool) {
+	if s.audit == nil {
+		return
+	}
+
+	for _, r := range a.records {
+		if !allowed && r.Decision == audit.Rewritten {
+			r.Decision, r.NewImage = audit.Denied, ""
+			r.Reason = "Another image of the object could not be cloned"
+		}
+		if err := s.audit.Write(r); err != nil {
+			klog.FromContext(ctx).Error(err, "Failed to write the audit record", "container", r.Container)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/admission/v1"
+
+	"github.com/gauravgahlot/image-cloner/internal/audit"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+)
+
+// readAudit returns the records of the audit log at path, after verifying
+// their hash chain.
+func readAudit(t *testing.T, path string) []audit.Record {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	_, _, err = audit.Verify(bytes.NewReader(data), "")
+	assert.NoError(t, err)
+
+	records := []audit.Record{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r audit.Record
+		assert.NoError(t, json.Unmarshal([]byte(line), &r))
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestCloneImageAudit(t *testing.T) {
+	failing := dockerClient()
+	failing.ImagePullFunc = func(ctx context.Context, image string) error { return errors.New("not found") }
+
+	cases := map[string]struct {
+		d        mockDockerClient
+		body     []byte
+		decision audit.Decision
+		newImage string
+		digest   string
+		reason   string
+	}{
+		"rewritten": {
+			d:        dockerClient(),
+			body:     []byte(admissionReviewRequestDeployment),
+			decision: audit.Rewritten,
+			newImage: "gauravgahlot/alpine:3.12",
+			digest:   digest,
+		},
+		"denied": {
+			d:        failing,
+			body:     []byte(admissionReviewRequestDeployment),
+			decision: audit.Denied,
+			reason:   "Failed to clone image alpine:3.12 of container alpine: failed to pull docker image: not found",
+		},
+		"unchanged": {
+			d:        dockerClient(),
+			body:     updateReviewRequest(t, admissionReviewRequestDeployment, alpine),
+			decision: audit.Skipped,
+			reason:   "Images of the containers are unchanged",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			log, err := audit.Open(audit.Options{Path: path, HashChain: true})
+			assert.NoError(t, err)
+			s := testServer(t, tc.d, withRegistryUser(registryUser))
+			s.audit = log
+
+			req := httptest.NewRequest(http.MethodPost, "/clone-image", bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			http.HandlerFunc(s.cloneImage).ServeHTTP(httptest.NewRecorder(), req)
+			assert.NoError(t, log.Close())
+
+			records := readAudit(t, path)
+			assert.Len(t, records, 1)
+			r := records[0]
+			assert.Equal(t, "4584308f-b307-455b-ab11-5765b4548b71", r.UID)
+			assert.Equal(t, "minikube-user", r.User.Username)
+			assert.Equal(t, []string{"system:masters", "system:authenticated"}, r.User.Groups)
+			assert.Equal(t, deployment, r.Kind)
+			assert.Equal(t, "default", r.Namespace)
+			assert.Equal(t, "alpine", r.Name)
+			assert.Equal(t, tc.decision, r.Decision)
+			assert.Equal(t, tc.newImage, r.NewImage)
+			assert.Equal(t, tc.digest, r.Digest)
+			assert.Equal(t, tc.reason, r.Reason)
+			if tc.decision != audit.Skipped {
+				assert.Equal(t, "CREATE", r.Operation)
+				assert.Equal(t, "alpine", r.Container)
+				assert.Equal(t, alpine, r.OldImage)
+			}
+		})
+	}
+}
+
+func TestWriteAuditDenied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.Open(audit.Options{Path: path})
+	assert.NoError(t, err)
+	s := testServer(t, dockerClient())
+	s.audit = log
+
+	a := &admission{req: &v1.AdmissionRequest{UID: "1234", Operation: v1.Create}}
+	a.add(notify.Event{Type: notify.CloneSucceeded, Container: "alpine", Source: alpine, Destination: "gauravgahlot/alpine:3.12"})
+	a.add(notify.Event{Type: notify.CloneFailed, Container: "sidecar", Source: "busybox:1.33", Message: "Failed"})
+	s.writeAudit(context.Background(), a, false)
+	assert.NoError(t, log.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+
+	// The image cloned before another one failed is not rewritten.
+	var r audit.Record
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &r))
+	assert.Equal(t, audit.Denied, r.Decision)
+	assert.Empty(t, r.NewImage)
+	assert.Equal(t, "Another image of the object could not be cloned", r.Reason)
+}
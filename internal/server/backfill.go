@@ -0,0 +1,300 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/flowcontrol"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+// BackfillOptions selects the workloads to backfill, and how fast they are
+// cloned and patched.
+type BackfillOptions struct {
+	// Namespace to backfill; all namespaces if empty.
+	Namespace string
+
+	// Selector is a label selector the workloads must match.
+	Selector string
+
+	// QPS and Burst limit the rate at which workloads are cloned and
+	// patched.
+	QPS   float32
+	Burst int
+
+	// DryRun reports the images that would be cloned without cloning them.
+	DryRun bool
+}
+
+// BackfillResult describes the backfill of a workload.
+type BackfillResult struct {
+	Kind      string
+	Namespace string
+	Name      string
+
+	// Images are the images that were cloned, or would be in a dry run.
+	Images []string
+
+	Err error
+}
+
+// BackfillReport summarizes a backfill.
+type BackfillReport struct {
+	Results []BackfillResult
+
+	// Patched counts the workloads that were patched, or would be in a dry
+	// run; Skipped the workloads already using the backup registry.
+	Patched int
+	Skipped int
+	Failed  int
+}
+
+// Backfill clones the images of the workloads admitted before the webhook
+// existed, and patches them to use the backup registry. The objects of the
+// kinds registered in the workloads config are listed and patched with dyn.
+func Backfill(ctx context.Context, cfg Config, cs kubernetes.Interface, dyn dynamic.Interface, opts BackfillOptions) (BackfillReport, error) {
+	s, err := newServer(cfg)
+	if err != nil {
+		return BackfillReport{}, err
+	}
+	s.dynamic = dyn
+	if cfg.LeaseNamespace != "" {
+		if err := s.useLeases(cs, cfg.LeaseNamespace); err != nil {
+			return BackfillReport{}, err
+		}
+	}
+
+	return s.backfill(ctx, cs, opts)
+}
+
+// backfillCandidate is a workload to backfill, either built-in or of a
+// registered kind.
+type backfillCandidate struct {
+	kind      string
+	namespace string
+	name      string
+	images    []image
+
+	// backfill clones the images and patches the workload.
+	backfill func(ctx context.Context) error
+}
+
+func (s *server) backfill(ctx context.Context, cs kubernetes.Interface, opts BackfillOptions) (BackfillReport, error) {
+	workloads, err := informerWorkloads(ctx, cs, opts.Namespace, opts.Selector)
+	if err != nil {
+		return BackfillReport{}, err
+	}
+
+	candidates := []backfillCandidate{}
+	for _, w := range workloads {
+		w := w
+		images := containerImages(containersPath, w.Containers)
+		candidates = append(candidates, backfillCandidate{
+			kind:      w.Kind,
+			namespace: w.Namespace,
+			name:      w.Name,
+			images:    images,
+			backfill: func(ctx context.Context) error {
+				return s.backfillWorkload(ctx, cs, w, images)
+			},
+		})
+	}
+
+	registered, err := s.registeredCandidates(ctx, cs, opts)
+	if err != nil {
+		return BackfillReport{}, err
+	}
+	candidates = append(candidates, registered...)
+
+	limiter := flowcontrol.NewTokenBucketRateLimiter(opts.QPS, opts.Burst)
+	defer limiter.Stop()
+
+	report := BackfillReport{Results: []BackfillResult{}}
+	for _, c := range candidates {
+		res := BackfillResult{Kind: c.kind, Namespace: c.namespace, Name: c.name, Images: []string{}}
+		for _, img := range c.images {
+			if !s.isUsingBackupRegistry(img.ref) {
+				res.Images = append(res.Images, img.ref)
+			}
+		}
+
+		if len(res.Images) == 0 {
+			report.Skipped++
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := limiter.Wait(ctx); err != nil {
+				return report, err
+			}
+			res.Err = c.backfill(objectContext(ctx, c.kind, c.namespace, c.name))
+		}
+
+		if res.Err != nil {
+			klog.ErrorS(res.Err, "Failed to backfill workload", "kind", c.kind, "namespace", c.namespace, "name", c.name)
+			report.Failed++
+		} else {
+			report.Patched++
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, nil
+}
+
+// registeredCandidates lists the objects of the kinds registered in the
+// workloads config that match opts. Their resources are resolved with the
+// discovery API of cs.
+func (s *server) registeredCandidates(ctx context.Context, cs kubernetes.Interface, opts BackfillOptions) ([]backfillCandidate, error) {
+	candidates := []backfillCandidate{}
+	if len(s.workloads) == 0 {
+		return candidates, nil
+	}
+	if s.dynamic == nil {
+		return nil, fmt.Errorf("listing the kinds registered in the workloads config requires a dynamic client")
+	}
+
+	kinds := s.workloads.kinds()
+	resources, err := kube.Resources(cs, kinds)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, gvk := range kinds {
+		client := s.dynamic.Resource(resources[i])
+		list, err := client.Namespace(opts.Namespace).List(ctx, metav1.ListOptions{LabelSelector: opts.Selector})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range list.Items {
+			raw, err := obj.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			images, err := unstructuredImages(raw, s.workloads.paths(gvk))
+			if err != nil {
+				return nil, fmt.Errorf("%s %s/%s: %v", gvk.Kind, obj.GetNamespace(), obj.GetName(), err)
+			}
+
+			target := admittedTarget(metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+				obj.GetNamespace(), metav1.ObjectMeta{Name: obj.GetName(), UID: obj.GetUID()})
+			namespace, name, annotations := obj.GetNamespace(), obj.GetName(), obj.GetAnnotations()
+			candidates = append(candidates, backfillCandidate{
+				kind:      gvk.Kind,
+				namespace: namespace,
+				name:      name,
+				images:    images,
+				backfill: func(ctx context.Context) error {
+					p, err := s.backfillPatch(ctx, target, images, annotations)
+					if err != nil {
+						return err
+					}
+					_, err = client.Namespace(namespace).Patch(ctx, name, types.JSONPatchType, p, metav1.PatchOptions{})
+					return err
+				},
+			})
+		}
+	}
+	return candidates, nil
+}
+
+// workloadContext returns ctx whose logger carries the fields identifying
+// w.
+func workloadContext(ctx context.Context, w kube.Workload) context.Context {
+	return objectContext(ctx, w.Kind, w.Namespace, w.Name)
+}
+
+func objectContext(ctx context.Context, kind, namespace, name string) context.Context {
+	return klog.NewContext(ctx, klog.LoggerWithValues(klog.FromContext(ctx),
+		"kind", kind, "namespace", namespace, "name", name))
+}
+
+// backfillWorkload clones the images of w and patches it with the same
+// patches the webhook would have created. The patch fails if an image was
+// changed since w was listed.
+func (s *server) backfillWorkload(ctx context.Context, cs kubernetes.Interface, w kube.Workload, images []image) error {
+	p, err := s.backfillPatch(ctx, workloadTarget(w), images, w.Annotations)
+	if err != nil {
+		return err
+	}
+	return kube.PatchWorkload(ctx, cs, w, types.JSONPatchType, p, metav1.PatchOptions{})
+}
+
+// backfillPatch clones images and returns the JSON patch the webhook would
+// have created, preceded by tests that the images were not changed since
+// they were listed.
+func (s *server) backfillPatch(ctx context.Context, target eventTarget, images []image, annotations map[string]string) ([]byte, error) {
+	patches, err := s.tryCreatePatches(ctx, target, images, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	tests := []patch{}
+	for _, img := range images {
+		if !s.isUsingBackupRegistry(img.ref) {
+			tests = append(tests, patch{Op: "test", Path: img.path, Value: img.ref})
+		}
+	}
+	return json.Marshal(append(tests, patches...))
+}
+
+// informerWorkloads lists the Deployments and DaemonSets in namespace that
+// match selector from the cache of shared informers.
+func informerWorkloads(ctx context.Context, cs kubernetes.Interface, namespace, selector string) ([]kube.Workload, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = selector }))
+	deploys := factory.Apps().V1().Deployments().Lister()
+	daemonsets := factory.Apps().V1().DaemonSets().Lister()
+
+	factory.Start(ctx.Done())
+	for typ, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync informer for %v", typ)
+		}
+	}
+
+	workloads := []kube.Workload{}
+	ds, err := deploys.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range ds {
+		workloads = append(workloads, kube.DeploymentWorkload(d))
+	}
+
+	dss, err := daemonsets.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dss {
+		workloads = append(workloads, kube.DaemonSetWorkload(d))
+	}
+	return workloads, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+func testDeployment(namespace, name string, images ...string) *appsv1.Deployment {
+	d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	for i, img := range images {
+		d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers,
+			v1.Container{Name: []string{"alpine", "sidecar"}[i], Image: img})
+	}
+	return d
+}
+
+func testDaemonSet(namespace, name string, images ...string) *appsv1.DaemonSet {
+	d := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	for _, img := range images {
+		d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers, v1.Container{Name: "alpine", Image: img})
+	}
+	return d
+}
+
+func backfillObjects() []runtime.Object {
+	return []runtime.Object{
+		testDeployment("default", "alpine", alpine, "gauravgahlot/busybox:1.33"),
+		testDeployment("default", "backed-up", "gauravgahlot/alpine:3.12"),
+		testDaemonSet("default", "agent", "busybox:1.33"),
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	cs := fake.NewSimpleClientset(backfillObjects()...)
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser))
+
+	report, err := s.backfill(context.Background(), cs, BackfillOptions{QPS: 100, Burst: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Patched)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 0, report.Failed)
+	assert.ElementsMatch(t, []BackfillResult{
+		{Kind: kube.Deployment, Namespace: "default", Name: "alpine", Images: []string{alpine}},
+		{Kind: kube.DaemonSet, Namespace: "default", Name: "agent", Images: []string{"busybox:1.33"}},
+	}, report.Results)
+
+	d, err := cs.AppsV1().Deployments("default").Get(context.Background(), "alpine", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "gauravgahlot/alpine:3.12", d.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "gauravgahlot/busybox:1.33", d.Spec.Template.Spec.Containers[1].Image)
+
+	originals, err := annotation.Decode(d.Annotations)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]annotation.Original{"alpine": {Image: alpine, Digest: digest, Path: "/spec/template/spec/containers/0/image"}}, originals)
+
+	ds, err := cs.AppsV1().DaemonSets("default").Get(context.Background(), "agent", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "gauravgahlot/busybox:1.33", ds.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestBackfillDryRun(t *testing.T) {
+	cs := fake.NewSimpleClientset(backfillObjects()...)
+	s := testServer(t, mockDockerClient{}, withRegistryUser(registryUser))
+
+	report, err := s.backfill(context.Background(), cs, BackfillOptions{Namespace: "default", QPS: 100, Burst: 10, DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Patched)
+	assert.Equal(t, 1, report.Skipped)
+
+	for _, a := range cs.Actions() {
+		assert.NotEqual(t, "patch", a.GetVerb())
+	}
+}
+
+func TestBackfillFailure(t *testing.T) {
+	cs := fake.NewSimpleClientset(backfillObjects()...)
+	d := dockerClient()
+	d.ImagePullFunc = func(ctx context.Context, image string) error {
+		if image == alpine {
+			return errors.New("error image pull")
+		}
+		return nil
+	}
+	s := testServer(t, d, withRegistryUser(registryUser))
+
+	report, err := s.backfill(context.Background(), cs, BackfillOptions{QPS: 100, Burst: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Patched)
+	assert.Equal(t, 1, report.Failed)
+
+	dep, err := cs.AppsV1().Deployments("default").Get(context.Background(), "alpine", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, alpine, dep.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestBackfillRegisteredKinds(t *testing.T) {
+	cs := fake.NewSimpleClientset(backfillObjects()...)
+	cs.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "tekton.dev/v1beta1",
+		APIResources: []metav1.APIResource{{Name: "tasks", Namespaced: true, Kind: "Task"}},
+	}}
+
+	task := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "tekton.dev/v1beta1",
+		"kind":       "Task",
+		"metadata":   map[string]interface{}{"namespace": "default", "name": "build"},
+		"spec": map[string]interface{}{"steps": []interface{}{
+			map[string]interface{}{"name": "build", "image": alpine},
+		}},
+	}}
+	tasks := schema.GroupVersionResource{Group: "tekton.dev", Version: "v1beta1", Resource: "tasks"}
+	dyn := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{tasks: "TaskList"}, task)
+
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser),
+		withWorkloads(workloads{{Group: "tekton.dev", Version: "v1beta1", Kind: "Task"}: {"/spec/steps"}}))
+
+	// The objects of the registered kinds are not known without a dynamic
+	// client.
+	_, err := s.backfill(context.Background(), cs, BackfillOptions{QPS: 100, Burst: 10})
+	assert.Error(t, err)
+
+	s.dynamic = dyn
+	report, err := s.backfill(context.Background(), cs, BackfillOptions{QPS: 100, Burst: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Patched)
+	assert.Contains(t, report.Results, BackfillResult{Kind: "Task", Namespace: "default", Name: "build", Images: []string{alpine}})
+
+	obj, err := dyn.Resource(tasks).Namespace("default").Get(context.Background(), "build", metav1.GetOptions{})
+	assert.NoError(t, err)
+	steps, _, _ := unstructured.NestedSlice(obj.Object, "spec", "steps")
+	assert.Equal(t, "gauravgahlot/alpine:3.12", steps[0].(map[string]interface{})["image"])
+
+	originals, err := annotation.Decode(obj.GetAnnotations())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]annotation.Original{"build": {Image: alpine, Digest: digest, Path: "/spec/steps/0/image"}}, originals)
+}
+
+// dockerClient returns a mock whose operations succeed.
+func dockerClient() mockDockerClient {
+	return mockDockerClient{
+		ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+		ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+		ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+		ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+		PlatformFunc:     func(ctx context.Context) (string, error) { return platform, nil },
+	}
+}
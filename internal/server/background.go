@@ -0,0 +1,74 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+// leaderLease is the Lease the webhook replicas compete for to run the
+// background tasks.
+const leaderLease = "image-cloner"
+
+// runBackground runs the background tasks of the server while this replica
+// is the leader, until ctx is done.
+func (s *server) runBackground(ctx context.Context) {
+	le := kube.LeaderElection{Name: leaderLease, Namespace: s.leaseNamespace}
+	err := kube.RunLeaderElected(ctx, s.kube, le, func(ctx context.Context) {
+		atomic.StoreInt32(&s.leading, 1)
+		defer atomic.StoreInt32(&s.leading, 0)
+
+		var wg sync.WaitGroup
+		for _, task := range s.background {
+			wg.Add(1)
+			go func(task func(context.Context)) {
+				defer wg.Done()
+				task(ctx)
+			}(task)
+		}
+		wg.Wait()
+	})
+	if err != nil {
+		klog.ErrorS(err, "Background tasks stopped")
+	}
+}
+
+// isLeader reports whether this replica is running the background tasks.
+func (s *server) isLeader() bool {
+	return atomic.LoadInt32(&s.leading) == 1
+}
+
+// periodicBackfill returns a task backfilling the workloads every interval.
+func (s *server) periodicBackfill(interval time.Duration) func(context.Context) {
+	return func(ctx context.Context) {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			report, err := s.backfill(ctx, s.kube, BackfillOptions{QPS: 1, Burst: 1})
+			if err != nil {
+				klog.ErrorS(err, "Backfill failed")
+				return
+			}
+			klog.InfoS("Backfill done",
+				"patched", report.Patched, "skipped", report.Skipped, "failed", report.Failed)
+		}, interval)
+	}
+}
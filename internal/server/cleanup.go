@@ -0,0 +1,239 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+)
+
+var (
+	errImageNotCached = errors.New("image is not in the local daemon")
+	errImageInUse     = errors.New("image is being cloned")
+)
+
+// removeCached removes ref from the local daemon, unless a clone is using
+// it. Clones are only tracked if local images are removed once pushed.
+func (s *server) removeCached(ctx context.Context, ref string) error {
+	exists, err := s.client.ImageExists(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", errImageNotCached, ref)
+	}
+
+	if s.local != nil {
+		return s.local.remove(ctx, ref)
+	}
+	return s.client.ImageRemove(ctx, ref)
+}
+
+// localImages tracks the references the server pulled or tagged in the
+// local Docker daemon only to clone an image, so that it removes them once
+// pushed. References the daemon had before are never removed, since the
+// node may be using them.
+type localImages struct {
+	client docker.Client
+
+	mu sync.Mutex
+	// inFlight counts the clones using a reference owned by the server.
+	inFlight map[string]int
+	// pending are the owned references that could not be removed, along
+	// with when they were first left behind, for the sweeper to retry.
+	pending map[string]time.Time
+	// removing are the references being removed, with a channel closed
+	// once they are. Clones wait for them before pulling the reference
+	// again.
+	removing map[string]chan struct{}
+}
+
+func newLocalImages(client docker.Client) *localImages {
+	return &localImages{
+		client:   client,
+		inFlight: map[string]int{},
+		pending:  map[string]time.Time{},
+		removing: map[string]chan struct{}{},
+	}
+}
+
+// acquire must be called before ref is pulled or tagged. It reports whether
+// the server owns ref, in which case release must be called once the clone
+// is done with it.
+func (l *localImages) acquire(ctx context.Context, ref string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		if err := l.awaitRemoval(ctx, ref); err != nil {
+			return false, err
+		}
+		if _, ok := l.pending[ref]; ok || l.inFlight[ref] > 0 {
+			delete(l.pending, ref)
+			l.inFlight[ref]++
+			return true, nil
+		}
+
+		// The daemon is asked without holding l.mu, so that other references
+		// are acquired and released meanwhile. ref may have been acquired, or
+		// be removed, by then, in which case its state is checked again.
+		l.mu.Unlock()
+		exists, err := l.client.ImageExists(ctx, ref)
+		l.mu.Lock()
+		if err != nil {
+			return false, err
+		}
+
+		_, removing := l.removing[ref]
+		_, pending := l.pending[ref]
+		if removing || pending || l.inFlight[ref] > 0 {
+			continue
+		}
+		if exists {
+			return false, nil
+		}
+		l.inFlight[ref]++
+		return true, nil
+	}
+}
+
+// release removes ref from the daemon once no clone is using it.
+func (l *localImages) release(ctx context.Context, ref string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[ref]--; l.inFlight[ref] > 0 {
+		return
+	}
+	delete(l.inFlight, ref)
+
+	if err := l.removeLocked(ctx, ref); err != nil {
+		klog.FromContext(ctx).Info("Failed to remove image, retrying later", "image", ref, "err", err)
+		l.pending[ref] = time.Now()
+	}
+}
+
+// remove removes ref from the daemon, unless a clone is using it.
+func (l *localImages) remove(ctx context.Context, ref string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.awaitRemoval(ctx, ref); err != nil {
+		return err
+	}
+	if l.inFlight[ref] > 0 {
+		return fmt.Errorf("%w: %s", errImageInUse, ref)
+	}
+	return l.removeLocked(ctx, ref)
+}
+
+// removeLocked removes ref, which no clone is using, from the daemon. l.mu
+// must be held; it is released while the daemon removes ref, so that other
+// references are acquired and released meanwhile, and clones acquiring ref
+// wait for the removal.
+func (l *localImages) removeLocked(ctx context.Context, ref string) error {
+	done := make(chan struct{})
+	l.removing[ref] = done
+	l.mu.Unlock()
+
+	err := l.client.ImageRemove(ctx, ref)
+
+	l.mu.Lock()
+	delete(l.removing, ref)
+	close(done)
+	if err != nil {
+		return err
+	}
+	delete(l.pending, ref)
+	return nil
+}
+
+// awaitRemoval waits until ref is no longer being removed, or ctx is done.
+// l.mu must be held; it is released while waiting.
+func (l *localImages) awaitRemoval(ctx context.Context, ref string) error {
+	for {
+		done, ok := l.removing[ref]
+		if !ok {
+			return nil
+		}
+
+		l.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		l.mu.Lock()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// sweep retries the removal of the pending references, oldest first, when
+// the layers stored by the daemon exceed threshold bytes.
+func (l *localImages) sweep(ctx context.Context, threshold int64) {
+	usage, err := l.client.DiskUsage(ctx)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to get docker disk usage")
+		return
+	}
+	if usage < threshold {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	refs := make([]string, 0, len(l.pending))
+	for ref := range l.pending {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return l.pending[refs[i]].Before(l.pending[refs[j]]) })
+
+	for _, ref := range refs {
+		// ref may have been acquired by a clone, or removed by another
+		// call, while the lock was released to remove the previous one.
+		if _, ok := l.pending[ref]; !ok || l.removing[ref] != nil {
+			continue
+		}
+		if err := l.removeLocked(ctx, ref); err != nil {
+			klog.FromContext(ctx).Info("Failed to remove image", "image", ref, "err", err)
+		}
+	}
+
+	if usage, err := l.client.DiskUsage(ctx); err == nil && usage >= threshold {
+		klog.FromContext(ctx).Info("Docker layers above the threshold after removing the images pulled for cloning",
+			"usage", usage, "threshold", threshold)
+	}
+}
+
+// sweeper returns a task sweeping the local images every interval.
+func (l *localImages) sweeper(interval time.Duration, threshold int64) func(context.Context) {
+	return func(ctx context.Context) {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			l.sweep(ctx, threshold)
+		}, interval)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const backupImage = "gauravgahlot/alpine:3.12"
+
+// localDockerClient returns a mock whose daemon has the images in local,
+// and which records the images removed.
+func localDockerClient(local map[string]bool, removed *[]string) mockDockerClient {
+	d := dockerClient()
+	d.ImageExistsFunc = func(ctx context.Context, image string) (bool, error) {
+		return local[image], nil
+	}
+	d.ImageRemoveFunc = func(ctx context.Context, image string) error {
+		*removed = append(*removed, image)
+		return nil
+	}
+	return d
+}
+
+func TestCloneRemovesLocalImages(t *testing.T) {
+	cases := map[string]struct {
+		local   map[string]bool
+		removed []string
+	}{
+		"pulled-for-cloning": {
+			local:   map[string]bool{},
+			removed: []string{backupImage, alpine},
+		},
+		"used-by-node": {
+			local:   map[string]bool{alpine: true},
+			removed: []string{backupImage},
+		},
+		"backup-used-by-node": {
+			local:   map[string]bool{alpine: true, backupImage: true},
+			removed: []string{},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			removed := []string{}
+			s := testServer(t, localDockerClient(tc.local, &removed), withRegistryUser(registryUser), withLocalImages())
+
+			_, _, err := s.clone(context.Background(), alpine)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.removed, removed)
+		})
+	}
+}
+
+func TestCloneRemovesLocalImagesOnFailure(t *testing.T) {
+	removed := []string{}
+	d := localDockerClient(map[string]bool{}, &removed)
+	d.ImagePushFunc = func(ctx context.Context, image string) (string, error) {
+		return "", errors.New("error image push")
+	}
+	s := testServer(t, d, withRegistryUser(registryUser), withLocalImages())
+
+	_, _, err := s.clone(context.Background(), alpine)
+	assert.Error(t, err)
+	assert.Equal(t, []string{backupImage, alpine}, removed)
+}
+
+func TestLocalImagesInFlight(t *testing.T) {
+	removed := []string{}
+	l := newLocalImages(localDockerClient(map[string]bool{}, &removed))
+	ctx := context.Background()
+
+	// The second clone sees the image pulled by the first one, which it must
+	// not mistake for an image used by the node.
+	for i := 0; i < 2; i++ {
+		owned, err := l.acquire(ctx, alpine)
+		assert.NoError(t, err)
+		assert.True(t, owned)
+	}
+
+	l.release(ctx, alpine)
+	assert.Empty(t, removed)
+	l.release(ctx, alpine)
+	assert.Equal(t, []string{alpine}, removed)
+}
+
+func TestLocalImagesRemoveUnlocked(t *testing.T) {
+	// Removing alpine blocks until removed is closed.
+	removing, removed := make(chan struct{}), make(chan struct{})
+	d := localDockerClient(map[string]bool{}, &[]string{})
+	d.ImageRemoveFunc = func(ctx context.Context, image string) error {
+		if image == alpine {
+			removing <- struct{}{}
+			<-removed
+		}
+		return nil
+	}
+
+	l := newLocalImages(d)
+	ctx := context.Background()
+	_, err := l.acquire(ctx, alpine)
+	assert.NoError(t, err)
+	go l.release(ctx, alpine)
+	<-removing
+
+	// Other references are acquired while alpine is removed.
+	owned, err := l.acquire(ctx, backupImage)
+	assert.NoError(t, err)
+	assert.True(t, owned)
+
+	// alpine is acquired again once it is removed, and not before.
+	acquired := make(chan bool)
+	go func() {
+		owned, err := l.acquire(ctx, alpine)
+		assert.NoError(t, err)
+		acquired <- owned
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired an image being removed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(removed)
+	assert.True(t, <-acquired)
+
+	// A clone waiting for the removal gives up once ctx is done.
+	removed = make(chan struct{})
+	l.release(ctx, backupImage)
+	go l.release(ctx, alpine)
+	<-removing
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(timeout, alpine)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	close(removed)
+}
+
+func TestLocalImagesExistsUnlocked(t *testing.T) {
+	// The first lookup of alpine blocks until answered, and then finds the
+	// image pulled by the clone that acquired it meanwhile.
+	asked, answer := make(chan struct{}), make(chan struct{})
+	lookups := 0
+	d := localDockerClient(map[string]bool{}, &[]string{})
+	d.ImageExistsFunc = func(ctx context.Context, image string) (bool, error) {
+		if image != alpine {
+			return false, nil
+		}
+		if lookups++; lookups > 1 {
+			return false, nil
+		}
+		asked <- struct{}{}
+		<-answer
+		return true, nil
+	}
+
+	l := newLocalImages(d)
+	ctx := context.Background()
+	acquired := make(chan bool)
+	go func() {
+		owned, err := l.acquire(ctx, alpine)
+		assert.NoError(t, err)
+		acquired <- owned
+	}()
+	<-asked
+
+	// Other clones acquire references while the daemon is asked.
+	owned, err := l.acquire(ctx, backupImage)
+	assert.NoError(t, err)
+	assert.True(t, owned)
+	owned, err = l.acquire(ctx, alpine)
+	assert.NoError(t, err)
+	assert.True(t, owned)
+
+	// The first clone does not mistake the image pulled by the second one
+	// for an image used by the node.
+	close(answer)
+	assert.True(t, <-acquired)
+	assert.Equal(t, 2, l.inFlight[alpine])
+}
+
+func TestLocalImagesSweep(t *testing.T) {
+	usage := int64(200)
+	fail := true
+	removed := []string{}
+	d := localDockerClient(map[string]bool{}, &removed)
+	d.ImageRemoveFunc = func(ctx context.Context, image string) error {
+		if fail {
+			return errors.New("image is being used by running container")
+		}
+		removed = append(removed, image)
+		usage -= 100
+		return nil
+	}
+	d.DiskUsageFunc = func(ctx context.Context) (int64, error) { return usage, nil }
+
+	l := newLocalImages(d)
+	ctx := context.Background()
+	for _, ref := range []string{alpine, backupImage} {
+		_, err := l.acquire(ctx, ref)
+		assert.NoError(t, err)
+		l.release(ctx, ref)
+	}
+	assert.Len(t, l.pending, 2)
+
+	fail = false
+	l.sweep(ctx, 500)
+	assert.Empty(t, removed)
+
+	l.sweep(ctx, 150)
+	assert.Equal(t, []string{alpine, backupImage}, removed)
+	assert.Empty(t, l.pending)
+}
@@ -17,7 +17,11 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"time"
 
@@ -27,62 +31,183 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+	"github.com/gauravgahlot/image-cloner/internal/tracing"
 )
 
 const (
-	maxWebhookTimeout = 30
+	// maxWebhookTimeout is the longest timeout the API server allows a
+	// webhook, used if a review request does not carry its timeout.
+	maxWebhookTimeout = 30 * time.Second
+
+	// responseMargin is kept from the timeout of an admission to respond
+	// before the API server gives up on the webhook.
+	responseMargin = 5 * time.Second
+
+	// maxRequestBytes bounds the size of an admission review request. The
+	// API server limits objects to 3MiB, and a review of an UPDATE carries
+	// both the object and the old object.
+	maxRequestBytes = 7 * 1024 * 1024
+
+	errDecodingObject = "Failed to decode the admitted object: %v"
 
-	errValidatingReviewReq = "[error]: failed to validate review request: %v"
-	infoRequestReceived    = "[info]: request received for kind=%s, operation=%s, name=%s"
-	infoWritingResponse    = "[info]: writing admission review response"
+	containersPath = "/spec/template/spec/containers"
 )
 
 func (s *server) cloneImage(w http.ResponseWriter, req *http.Request) {
-	body, err := ioutil.ReadAll(req.Body)
+	ctx, span := tracing.Start(tracing.Extract(context.Background(), req.Header), "cloneImage")
+	defer span.End()
+
+	if req.Method != http.MethodPost {
+		writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed,
+			fmt.Sprintf("method %s is not allowed", req.Method))
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeStatus(w, http.StatusUnsupportedMediaType, metav1.StatusReasonUnsupportedMediaType,
+			fmt.Sprintf("content type %q is not supported; expected application/json", req.Header.Get("Content-Type")))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestBytes+1))
 	if err != nil {
-		klog.Errorf("[error]: %v", err)
+		klog.ErrorS(err, "Failed to read the review request")
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
+	}
+	if len(body) > maxRequestBytes {
+		writeStatus(w, http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge,
+			fmt.Sprintf("request body must not exceed %d bytes", maxRequestBytes))
+		return
 	}
 
 	review, err := validateReviewRequest(body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		klog.Errorf(errValidatingReviewReq, err)
+		klog.ErrorS(err, "Failed to validate the review request")
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
 	}
 
-	klog.Infof(infoRequestReceived, review.Request.Kind.Kind, review.Request.Operation, review.Request.Name)
+	// Every line logged for the admission carries the fields identifying it.
+	logger := klog.LoggerWithValues(klog.FromContext(ctx),
+		"uid", review.Request.UID,
+		"kind", review.Request.Kind.Kind,
+		"namespace", review.Request.Namespace,
+		"name", review.Request.Name,
+	)
+	ctx = klog.NewContext(ctx, logger)
+	logger.Info("Admission request received", "operation", review.Request.Operation)
+
+	span.SetAttributes(
+		tracing.Kind.String(review.Request.Kind.Kind),
+		tracing.Operation.String(string(review.Request.Operation)),
+		tracing.Namespace.String(review.Request.Namespace),
+		tracing.Name.String(review.Request.Name),
+		tracing.UID.String(string(review.Request.UID)),
+	)
+	ctx = tracing.WithUID(ctx, string(review.Request.UID))
+
+	// Requests whose object cannot be decoded are counted as errors.
+	result := "error"
+	defer func() {
+		metrics.AdmissionRequests.WithLabelValues(review.Request.Kind.Kind, string(review.Request.Operation), result).Inc()
+	}()
 
-	var res reviewResponse
-	ctx, cancel := context.WithTimeout(context.Background(), maxWebhookTimeout*time.Millisecond)
+	ctx, cancel := context.WithTimeout(ctx, cloneDeadline(req))
 	defer cancel()
 
-	switch review.Request.Kind.Kind {
-	case deployment:
-		var deploy appsv1.Deployment
-		err = json.Unmarshal(review.Request.Object.Raw, &deploy)
+	images, err := s.decodeImages(review.Request.Kind, review.Request.Object.Raw)
+	if err != nil {
+		logger.Error(err, "Failed to decode the images of the object")
+		writeAdmissionReviewResponse(ctx, w, review.APIVersion, createErrorResponse(review.Request.UID,
+			http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf(errDecodingObject, err)))
+		return
+	}
+
+	meta, err := decodeMetadata(review.Request.Object.Raw)
+	if err != nil {
+		logger.Error(err, "Failed to decode the metadata of the object")
+		writeAdmissionReviewResponse(ctx, w, review.APIVersion, createErrorResponse(review.Request.UID,
+			http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf(errDecodingObject, err)))
+		return
+	}
+
+	target := admittedTarget(review.Request.Kind, review.Request.Namespace, meta)
+	target.admission = &admission{req: review.Request}
+	if review.Request.Operation == v1.Update {
+		old, err := s.decodeImages(review.Request.Kind, review.Request.OldObject.Raw)
 		if err != nil {
-			klog.Errorf("[error]: %v", err)
+			logger.Error(err, "Failed to decode the images of the old object")
+			writeAdmissionReviewResponse(ctx, w, review.APIVersion, createErrorResponse(review.Request.UID,
+				http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf(errDecodingObject, err)))
+			return
 		}
 
-		res, err = s.createResponse(ctx, deploy.Spec.Template.Spec.Containers, review.Request.UID)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			klog.Errorf("[error]: %v", err)
+		images = changedImages(images, old)
+		if len(images) == 0 {
+			logger.Info("Images unchanged, skipping clone")
+			s.record(target, notify.Event{Type: notify.CloneSkipped, Message: "Images of the containers are unchanged"})
+			s.writeAudit(ctx, target.admission, true)
+			result = "allowed"
+			writeAdmissionReviewResponse(ctx, w, review.APIVersion, reviewResponse{uid: review.Request.UID, allowed: true})
+			return
 		}
+	}
+
+	// A failure to clone is reported in the admission response, which is
+	// how the API server learns why the object was rejected.
+	res, err := s.createResponse(ctx, target, images, meta.Annotations, review.Request.UID)
+	if err != nil {
+		logger.Error(err, "Failed to clone the images of the object")
+	}
+	result = "allowed"
+	if !res.allowed {
+		result = "denied"
+	}
+	s.writeAudit(ctx, target.admission, res.allowed)
+
+	writeAdmissionReviewResponse(ctx, w, review.APIVersion, res)
+}
+
+// decodeImages decodes raw as an object of the given kind and returns the
+// images used by its pod template, or found at the paths registered for the
+// kind.
+func (s *server) decodeImages(gvk metav1.GroupVersionKind, raw []byte) ([]image, error) {
+	if paths, ok := s.workloads[gvk]; ok {
+		return unstructuredImages(raw, paths)
+	}
+
+	switch gvk.Kind {
+	case deployment:
+		var deploy appsv1.Deployment
+		if err := json.Unmarshal(raw, &deploy); err != nil {
+			return nil, err
+		}
+		return containerImages(containersPath, deploy.Spec.Template.Spec.Containers), nil
 	case daemonset:
 		var daemonset appsv1.DaemonSet
-		err = json.Unmarshal(review.Request.Object.Raw, &daemonset)
-		if err != nil {
-			klog.Errorf("[error]: %v", err)
-		}
-
-		res, err = s.createResponse(ctx, daemonset.Spec.Template.Spec.Containers, review.Request.UID)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			klog.Errorf("[error]: %v", err)
+		if err := json.Unmarshal(raw, &daemonset); err != nil {
+			return nil, err
 		}
+		return containerImages(containersPath, daemonset.Spec.Template.Spec.Containers), nil
 	}
+	return nil, nil
+}
 
-	writeAdmissionReviewResponse(w, res)
+// decodeMetadata returns the metadata of raw. Its annotations are nil if
+// the object has none.
+func decodeMetadata(raw []byte) (metav1.ObjectMeta, error) {
+	var obj struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return metav1.ObjectMeta{}, err
+	}
+	return obj.Metadata, nil
 }
 
 func validateReviewRequest(body []byte) (v1.AdmissionReview, error) {
@@ -92,18 +217,27 @@ func validateReviewRequest(body []byte) (v1.AdmissionReview, error) {
 	if _, _, err := deserializer.Decode(body, nil, &reviewReq); err != nil {
 		return reviewReq, err
 	} else if reviewReq.Request == nil {
-		return reviewReq, err
+		return reviewReq, errors.New("review request is empty")
+	}
+
+	switch reviewReq.APIVersion {
+	case version, versionV1beta1:
+	default:
+		return reviewReq, fmt.Errorf("unsupported apiVersion %q", reviewReq.APIVersion)
 	}
 
 	return reviewReq, nil
 }
 
-func writeAdmissionReviewResponse(w http.ResponseWriter, r reviewResponse) {
-	const ()
+// writeAdmissionReviewResponse writes r as an AdmissionReview of apiVersion,
+// which must match the version of the review request.
+func writeAdmissionReviewResponse(ctx context.Context, w http.ResponseWriter, apiVersion string, r reviewResponse) {
+	logger := klog.FromContext(ctx)
+
 	response := v1.AdmissionReview{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       kind,
-			APIVersion: version,
+			APIVersion: apiVersion,
 		},
 		Response: &v1.AdmissionResponse{
 			UID:     r.uid,
@@ -117,7 +251,6 @@ func writeAdmissionReviewResponse(w http.ResponseWriter, r reviewResponse) {
 	}
 
 	if r.patch != nil {
-		klog.Infof("[info]: applying patch")
 		var patchType v1.PatchType = jsonPatch
 		response.Response.Patch = r.patch
 		response.Response.PatchType = &patchType
@@ -125,13 +258,57 @@ func writeAdmissionReviewResponse(w http.ResponseWriter, r reviewResponse) {
 
 	res, err := json.Marshal(&response)
 	if err != nil {
+		logger.Error(err, "Failed to marshal the review response")
+		writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+		return
+	}
+
+	logger.Info("Writing admission review response", "allowed", r.allowed, "patched", r.patch != nil)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(res)
+	if err != nil {
+		logger.Error(err, "Failed to write the review response")
+	}
+}
+
+// writeStatus writes a failed metav1.Status for requests that could not be
+// turned into an admission review.
+func writeStatus(w http.ResponseWriter, code int32, reason metav1.StatusReason, msg string) {
+	res, err := json.Marshal(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Reason:  reason,
+		Message: msg,
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to marshal the status")
 		w.WriteHeader(http.StatusInternalServerError)
-		klog.Errorf("[error]: %v", err)
+		return
 	}
 
-	klog.Infof(infoWritingResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(code))
 	_, err = w.Write(res)
 	if err != nil {
-		klog.Errorf("[error]: %v", err)
+		klog.ErrorS(err, "Failed to write the status")
+	}
+}
+
+// cloneDeadline returns how long the images of an admission may take to
+// clone, given the timeout the API server sets on the request: the cloning
+// stops early enough for the webhook to respond, with half of the timeout
+// if it is too short to keep responseMargin.
+func cloneDeadline(req *http.Request) time.Duration {
+	timeout, err := time.ParseDuration(req.URL.Query().Get("timeout"))
+	if err != nil || timeout <= 0 || timeout > maxWebhookTimeout {
+		timeout = maxWebhookTimeout
+	}
+	if timeout <= 2*responseMargin {
+		return timeout / 2
 	}
+	return timeout - responseMargin
 }
@@ -18,20 +18,37 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	v1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/logging"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/tracing"
 )
 
 func TestCloneImage(t *testing.T) {
 	d := mockDockerClient{
-		ImagePullFunc: func(ctx context.Context, image string) error { return nil },
-		ImageTagFunc:  func(ctx context.Context, src, dst string) error { return nil },
-		ImagePushFunc: func(ctx context.Context, image string) error { return nil },
+		ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+		ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+		ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+		ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
 	}
 	mods := []serverModifier{withRegistryUser(registryUser)}
 	s := testServer(t, d, mods...)
@@ -56,6 +73,7 @@ func TestCloneImage(t *testing.T) {
 			if err != nil {
 				t.Error(err)
 			}
+			req.Header.Set("Content-Type", "application/json")
 
 			rr := httptest.NewRecorder()
 			http.HandlerFunc(s.cloneImage).ServeHTTP(rr, req)
@@ -68,6 +86,435 @@ func TestCloneImage(t *testing.T) {
 	}
 }
 
+func TestCloneImageMetrics(t *testing.T) {
+	d := dockerClient()
+	pullErr := error(nil)
+	d.ImagePullFunc = func(ctx context.Context, image string) error { return pullErr }
+	s := testServer(t, d, withRegistryUser(registryUser))
+
+	allowed := metrics.AdmissionRequests.WithLabelValues("Deployment", "CREATE", "allowed")
+	denied := metrics.AdmissionRequests.WithLabelValues("Deployment", "CREATE", "denied")
+	pullFailures := metrics.CloneFailures.WithLabelValues("pull")
+	misses := metrics.BackupLookups.WithLabelValues("miss")
+	before := []float64{testutil.ToFloat64(allowed), testutil.ToFloat64(denied),
+		testutil.ToFloat64(pullFailures), testutil.ToFloat64(misses), testutil.ToFloat64(metrics.Clones)}
+
+	admit := func() {
+		req := httptest.NewRequest(http.MethodPost, "/clone-image", strings.NewReader(admissionReviewRequestDeployment))
+		req.Header.Set("Content-Type", "application/json")
+		http.HandlerFunc(s.cloneImage).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	admit()
+	pullErr = errors.New("error image pull")
+	admit()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(allowed)-before[0])
+	assert.Equal(t, 1.0, testutil.ToFloat64(denied)-before[1])
+	assert.Equal(t, 1.0, testutil.ToFloat64(pullFailures)-before[2])
+	assert.Equal(t, 1.0, testutil.ToFloat64(misses)-before[3])
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Clones)-before[4])
+}
+
+func TestCloneImageTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	s := testServer(t, docker.Traced(dockerClient()), withRegistryUser(registryUser))
+
+	req := httptest.NewRequest(http.MethodPost, "/clone-image", strings.NewReader(admissionReviewRequestDeployment))
+	req.Header.Set("Content-Type", "application/json")
+	http.HandlerFunc(s.cloneImage).ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]tracetest.SpanStub{}
+	names := []string{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"docker.ImagePull", "docker.ImageInspect", "docker.ImageTag", "docker.ImagePush",
+		"clone", "createResponse", "cloneImage"}, names)
+
+	uid := tracing.UID.String("4584308f-b307-455b-ab11-5765b4548b71")
+	for _, span := range spans {
+		assert.Contains(t, span.Attributes, uid, span.Name)
+	}
+	assert.Contains(t, spans["cloneImage"].Attributes, tracing.Kind.String("Deployment"))
+	assert.Contains(t, spans["clone"].Attributes, tracing.Container.String("alpine"))
+	assert.Contains(t, spans["clone"].Attributes, tracing.Destination.String("gauravgahlot/alpine:3.12"))
+
+	assert.Equal(t, spans["cloneImage"].SpanContext.SpanID(), spans["createResponse"].Parent.SpanID())
+	assert.Equal(t, spans["createResponse"].SpanContext.SpanID(), spans["clone"].Parent.SpanID())
+	assert.Equal(t, spans["clone"].SpanContext.SpanID(), spans["docker.ImagePush"].Parent.SpanID())
+}
+
+func TestCloneImageLogs(t *testing.T) {
+	var buf bytes.Buffer
+	klog.SetLogger(logging.NewJSON(&buf))
+	t.Cleanup(klog.ClearLogger)
+
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser))
+	req := httptest.NewRequest(http.MethodPost, "/clone-image", strings.NewReader(admissionReviewRequestDeployment))
+	req.Header.Set("Content-Type", "application/json")
+	http.HandlerFunc(s.cloneImage).ServeHTTP(httptest.NewRecorder(), req)
+
+	var cloned map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		assert.Equal(t, "4584308f-b307-455b-ab11-5765b4548b71", entry["uid"], line)
+		if entry["msg"] == "Cloned image" {
+			cloned = entry
+		}
+	}
+
+	assert.Equal(t, "Deployment", cloned["kind"])
+	assert.Equal(t, "default", cloned["namespace"])
+	assert.Equal(t, "alpine", cloned["name"])
+	assert.Equal(t, "alpine", cloned["container"])
+	assert.Equal(t, alpine, cloned["source"])
+	assert.Equal(t, "gauravgahlot/alpine:3.12", cloned["destination"])
+}
+
+func TestCloneImageEvents(t *testing.T) {
+	failing := dockerClient()
+	failing.ImagePullFunc = func(ctx context.Context, image string) error { return errors.New("not found") }
+
+	cases := map[string]struct {
+		d      mockDockerClient
+		body   []byte
+		events []string
+	}{
+		"cloned": {
+			d:    dockerClient(),
+			body: []byte(admissionReviewRequestDeployment),
+			events: []string{"Normal ImageCloned Deployment alpine: Cloned image alpine:3.12 of container alpine to gauravgahlot/alpine:3.12" +
+				" involvedObject{kind=Namespace,apiVersion=v1}"},
+		},
+		"failed": {
+			d:    failing,
+			body: []byte(admissionReviewRequestDeployment),
+			events: []string{"Warning CloneFailed Deployment alpine: Failed to clone image alpine:3.12 of container alpine: " +
+				"failed to pull docker image: not found involvedObject{kind=Namespace,apiVersion=v1}"},
+		},
+		"unchanged": {
+			d:      dockerClient(),
+			body:   updateReviewRequest(t, admissionReviewRequestDeployment, alpine),
+			events: []string{"Normal CloneSkipped Deployment alpine: Images of the containers are unchanged involvedObject{kind=Namespace,apiVersion=v1}"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			recorder.IncludeObject = true
+			s := testServer(t, tc.d, withRegistryUser(registryUser))
+			s.recorder = recorder
+
+			req := httptest.NewRequest(http.MethodPost, "/clone-image", bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			http.HandlerFunc(s.cloneImage).ServeHTTP(httptest.NewRecorder(), req)
+
+			close(recorder.Events)
+			events := []string{}
+			for e := range recorder.Events {
+				events = append(events, e)
+			}
+			assert.Equal(t, tc.events, events)
+		})
+	}
+}
+
+func TestCloneImageMalformedRequest(t *testing.T) {
+	s := testServer(t, mockDockerClient{}, withRegistryUser(registryUser))
+
+	badObject := `{
+		"kind": "AdmissionReview",
+		"apiVersion": "admission.k8s.io/v1",
+		"request": {
+			"uid": "4584308f-b307-455b-ab11-5765b4548b71",
+			"kind": { "group": "apps", "version": "v1", "kind": "Deployment" },
+			"operation": "CREATE",
+			"object": { "spec": "alpine" }
+		}
+	}`
+
+	cases := map[string]struct {
+		method      string
+		contentType string
+		body        string
+		code        int
+		reason      metav1.StatusReason
+	}{
+		"method-not-allowed": {
+			method: http.MethodGet, contentType: "application/json",
+			code: http.StatusMethodNotAllowed, reason: metav1.StatusReasonMethodNotAllowed,
+		},
+		"unsupported-media-type": {
+			method: http.MethodPost, contentType: "text/plain", body: admissionReviewRequestDeployment,
+			code: http.StatusUnsupportedMediaType, reason: metav1.StatusReasonUnsupportedMediaType,
+		},
+		"request-entity-too-large": {
+			method: http.MethodPost, contentType: "application/json", body: strings.Repeat(" ", maxRequestBytes+1),
+			code: http.StatusRequestEntityTooLarge, reason: metav1.StatusReasonRequestEntityTooLarge,
+		},
+		"invalid-json": {
+			method: http.MethodPost, contentType: "application/json", body: "{",
+			code: http.StatusBadRequest, reason: metav1.StatusReasonBadRequest,
+		},
+		"nil-request": {
+			method: http.MethodPost, contentType: "application/json; charset=utf-8",
+			body: `{"kind": "AdmissionReview", "apiVersion": "admission.k8s.io/v1"}`,
+			code: http.StatusBadRequest, reason: metav1.StatusReasonBadRequest,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, "/clone-image", strings.NewReader(tc.body))
+			if err != nil {
+				t.Error(err)
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(s.cloneImage).ServeHTTP(rr, req)
+			assert.Equal(t, tc.code, rr.Code)
+
+			var status metav1.Status
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+			assert.Equal(t, metav1.StatusFailure, status.Status)
+			assert.Equal(t, int32(tc.code), status.Code)
+			assert.Equal(t, tc.reason, status.Reason)
+		})
+	}
+
+	t.Run("undecodable-object", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "/clone-image", strings.NewReader(badObject))
+		if err != nil {
+			t.Error(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.cloneImage).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var review v1.AdmissionReview
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &review))
+		assert.Equal(t, uid, review.Response.UID)
+		assert.False(t, review.Response.Allowed)
+		assert.Equal(t, int32(http.StatusBadRequest), review.Response.Result.Code)
+		assert.Equal(t, metav1.StatusReasonBadRequest, review.Response.Result.Reason)
+	})
+}
+
+// headerRecorder fails the test if the handler writes the status code more
+// than once.
+type headerRecorder struct {
+	*httptest.ResponseRecorder
+	t     *testing.T
+	calls int
+}
+
+func (r *headerRecorder) WriteHeader(code int) {
+	r.calls++
+	if r.calls > 1 {
+		r.t.Errorf("WriteHeader called %d times", r.calls)
+	}
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func FuzzCloneImage(f *testing.F) {
+	f.Add([]byte(admissionReviewRequestDeployment))
+	f.Add([]byte(admissionReviewRequestDaemonSet))
+	f.Add(updateReviewRequest(f, admissionReviewRequestDeployment, "alpine:3.11"))
+	f.Add(reviewRequestFixture(f, "deploy.json", versionV1beta1))
+	f.Add(reviewRequestFixture(f, "pod.json", version))
+	f.Add([]byte(`{"kind": "AdmissionReview", "apiVersion": "admission.k8s.io/v1", "request": null}`))
+	f.Add([]byte(`{"request": {"kind": {"kind": "Deployment"}, "operation": "UPDATE", "object": [], "oldObject": 1}}`))
+
+	d := mockDockerClient{
+		ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+		ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+		ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+		ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+	}
+	s := testServer(f, d, withRegistryUser(registryUser))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, err := http.NewRequest(http.MethodPost, "/clone-image", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := &headerRecorder{ResponseRecorder: httptest.NewRecorder(), t: t}
+		http.HandlerFunc(s.cloneImage).ServeHTTP(rr, req)
+
+		switch rr.Code {
+		case http.StatusOK:
+			var review v1.AdmissionReview
+			if err := json.Unmarshal(rr.Body.Bytes(), &review); err != nil || review.Response == nil {
+				t.Fatalf("invalid admission review response %q: %v", rr.Body.String(), err)
+			}
+		case http.StatusBadRequest:
+			var status metav1.Status
+			if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+				t.Fatalf("invalid status response %q: %v", rr.Body.String(), err)
+			}
+		default:
+			t.Fatalf("unexpected status code %d", rr.Code)
+		}
+	})
+}
+
+func TestCloneImageAPIVersions(t *testing.T) {
+	d := mockDockerClient{
+		ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+		ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+		ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+		ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+	}
+	s := testServer(t, d, withRegistryUser(registryUser))
+
+	cases := []struct {
+		fixture    string
+		apiVersion string
+		code       int
+		patch      []byte
+	}{
+		{fixture: "deploy.json", apiVersion: version, code: http.StatusOK, patch: getPatch("nginx", "nginx", "", registryUser)},
+		{fixture: "deploy.json", apiVersion: versionV1beta1, code: http.StatusOK, patch: getPatch("nginx", "nginx", "", registryUser)},
+		{fixture: "pod.json", apiVersion: version, code: http.StatusOK},
+		{fixture: "pod.json", apiVersion: versionV1beta1, code: http.StatusOK},
+		{fixture: "deploy.json", apiVersion: "admission.k8s.io/v2", code: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.fixture+"-"+tc.apiVersion, func(t *testing.T) {
+			body := reviewRequestFixture(t, tc.fixture, tc.apiVersion)
+			req, err := http.NewRequest("POST", "/clone-image", bytes.NewBuffer(body))
+			if err != nil {
+				t.Error(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(s.cloneImage).ServeHTTP(rr, req)
+			assert.Equal(t, tc.code, rr.Code)
+			if tc.code != http.StatusOK {
+				return
+			}
+
+			var review v1.AdmissionReview
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &review))
+			assert.Equal(t, kind, review.Kind)
+			assert.Equal(t, tc.apiVersion, review.APIVersion)
+			assert.True(t, review.Response.Allowed)
+			assert.Equal(t, tc.patch, review.Response.Patch)
+		})
+	}
+}
+
+// reviewRequestFixture reads an admission review request from the
+// example-review-requests directory and sets its apiVersion.
+func reviewRequestFixture(t testing.TB, name, apiVersion string) []byte {
+	data, err := os.ReadFile(filepath.Join("..", "..", "example-review-requests", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var review map[string]interface{}
+	if err := json.Unmarshal(data, &review); err != nil {
+		t.Fatal(err)
+	}
+	review["apiVersion"] = apiVersion
+
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestCloneImageUpdate(t *testing.T) {
+	cases := map[string]struct {
+		oldImage string
+		patch    bool
+	}{
+		"scale-only":    {oldImage: alpine, patch: false},
+		"image-changed": {oldImage: "alpine:3.11", patch: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			pulls := 0
+			d := mockDockerClient{
+				ImagePullFunc:    func(ctx context.Context, image string) error { pulls++; return nil },
+				ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+				ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+				ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+			}
+			s := testServer(t, d, withRegistryUser(registryUser))
+
+			body := updateReviewRequest(t, admissionReviewRequestDeployment, tc.oldImage)
+			req, err := http.NewRequest("POST", "/clone-image", bytes.NewBuffer(body))
+			if err != nil {
+				t.Error(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(s.cloneImage).ServeHTTP(rr, req)
+
+			var review v1.AdmissionReview
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &review))
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, review.Response.Allowed)
+			if tc.patch {
+				assert.Equal(t, 1, pulls)
+				assert.Equal(t, getPatch("alpine", alpine, "", registryUser), review.Response.Patch)
+			} else {
+				assert.Equal(t, 0, pulls)
+				assert.Nil(t, review.Response.Patch)
+			}
+		})
+	}
+}
+
+// updateReviewRequest turns the CREATE review request src into an UPDATE,
+// with an old object that uses oldImage for its only container.
+func updateReviewRequest(t testing.TB, src, oldImage string) []byte {
+	var review v1.AdmissionReview
+	if err := json.Unmarshal([]byte(src), &review); err != nil {
+		t.Fatal(err)
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(review.Request.Object.Raw, &obj); err != nil {
+		t.Fatal(err)
+	}
+	obj["spec"].(map[string]interface{})["replicas"] = 3
+	template := obj["spec"].(map[string]interface{})["template"].(map[string]interface{})
+	containers := template["spec"].(map[string]interface{})["containers"].([]interface{})
+	containers[0].(map[string]interface{})["image"] = oldImage
+
+	old, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	review.Request.Operation = v1.Update
+	review.Request.OldObject.Raw = old
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
 func expectedResponse() string {
 	var patchType v1.PatchType = jsonPatch
 	response := v1.AdmissionReview{
@@ -78,7 +525,7 @@ func expectedResponse() string {
 		Response: &v1.AdmissionResponse{
 			UID:       uid,
 			Allowed:   true,
-			Patch:     getPatch(alpine, "", registryUser),
+			Patch:     getPatch("alpine", alpine, "", registryUser),
 			PatchType: &patchType,
 			Result:    &metav1.Status{},
 		},
@@ -348,3 +795,19 @@ const (
   }
 `
 )
+
+func TestCloneDeadline(t *testing.T) {
+	cases := map[string]time.Duration{
+		"/clone-image":              25 * time.Second,
+		"/clone-image?timeout=10s":  5 * time.Second,
+		"/clone-image?timeout=20s":  15 * time.Second,
+		"/clone-image?timeout=2s":   time.Second,
+		"/clone-image?timeout=1m":   25 * time.Second,
+		"/clone-image?timeout=soon": 25 * time.Second,
+	}
+	for target, want := range cases {
+		t.Run(target, func(t *testing.T) {
+			assert.Equal(t, want, cloneDeadline(httptest.NewRequest(http.MethodPost, target, nil)))
+		})
+	}
+}
@@ -16,8 +16,12 @@ package server
 
 import (
 	"crypto/tls"
+	"time"
 
 	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/audit"
+	"github.com/gauravgahlot/image-cloner/internal/gc"
 )
 
 // Config defines the HTTP server
@@ -25,12 +29,96 @@ type Config struct {
 	CertFile string
 	KeyFile  string
 	Addr     string
+
+	// WorkloadsFile registers additional kinds and the paths of their
+	// images; see WorkloadConfig.
+	WorkloadsFile string
+
+	// PinDigest rewrites images to the digest of the backup instead of its
+	// tag.
+	PinDigest bool
+
+	// TagConflict names the TagConflictPolicy applied when a backup tag
+	// already exists with a different image; overwrite if empty.
+	TagConflict string
+
+	// NotifiersFile is the path to the YAML or JSON file configuring the
+	// notifiers the events of the clones and upstream checks are sent to;
+	// none if empty.
+	NotifiersFile string
+
+	// Audit configures the audit log of the decisions of the webhook on the
+	// images it admits; none if its path is empty.
+	Audit audit.Options
+
+	// KeepLocalImages keeps the images pulled and tagged for cloning in the
+	// local Docker daemon; they are removed once pushed otherwise.
+	KeepLocalImages bool
+
+	// SweepInterval is how often the images that could not be removed once
+	// pushed are removed again, if the image layers stored by the local
+	// daemon exceed SweepThreshold bytes; never if zero.
+	SweepInterval  time.Duration
+	SweepThreshold int64
+
+	// LeaseNamespace is the namespace of the Leases that replicas use to
+	// elect a leader for background work and to lock the images they
+	// clone. Replicas do not coordinate if it is empty.
+	LeaseNamespace string
+
+	// Kubeconfig is the path to the kubeconfig file used for Leases and
+	// Events; the in-cluster configuration is used if empty.
+	Kubeconfig string
+
+	// RecordEvents records the outcome of the clones as Events on the
+	// admitted objects, or on their namespace if they are being created.
+	// Events are always recorded when replicas coordinate through Leases.
+	RecordEvents bool
+
+	// BackfillInterval is how often the leader backfills the workloads that
+	// do not use the backup registry; never if zero.
+	BackfillInterval time.Duration
+
+	// GCInterval is how often the leader deletes the backups that are no
+	// longer used and not kept by GC; never if zero.
+	GCInterval time.Duration
+	GC         gc.Options
+
+	// UpstreamInterval is how often the leader checks that the original
+	// images of the backups are still available from their source; never
+	// if zero.
+	UpstreamInterval time.Duration
+
+	// ResyncInterval is how often the leader re-resolves the tags of the
+	// original images, and copies the images they moved to; never if zero.
+	// ResyncTags are path.Match patterns of the tags resynced; all if
+	// empty. ResyncPolicy names the ResyncPolicy of the namespaces that do
+	// not set one.
+	ResyncInterval time.Duration
+	ResyncTags     []string
+	ResyncPolicy   string
+
+	// VerifyInterval is how often the leader fetches the backups used by
+	// the workloads to check their integrity; never if zero.
+	VerifyInterval time.Duration
+
+	// APIAddr is the HTTPS address of the API inspecting the clones and
+	// running them on demand, served with the certificate of the webhook;
+	// none if empty. Requests must carry one of the bearer tokens listed in
+	// APITokenFile, one per line.
+	APIAddr      string
+	APITokenFile string
+
+	// MetricsAddr is the plain HTTP address serving the Prometheus metrics
+	// at /metrics; none if empty.
+	MetricsAddr string
 }
 
 func configTLS(c Config) *tls.Config {
 	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
 	if err != nil {
-		klog.Fatalf("[error]: %v", err)
+		klog.ErrorS(err, "Failed to load the TLS certificate", "cert", c.CertFile, "key", c.KeyFile)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 	return &tls.Config{
 		Certificates: []tls.Certificate{cert},
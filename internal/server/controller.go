@@ -0,0 +1,251 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+// ControllerOptions selects the workloads the controller watches, and the
+// Lease its replicas compete for.
+type ControllerOptions struct {
+	// Namespace to watch; all namespaces if empty.
+	Namespace string
+
+	// Selector is a label selector the workloads must match.
+	Selector string
+
+	// Workers is the number of workloads cloned and patched at a time.
+	Workers int
+
+	LeaderElection kube.LeaderElection
+}
+
+// controller clones the images of the Deployments and DaemonSets it
+// watches, and patches them to use the backup registry.
+type controller struct {
+	s  *server
+	cs kubernetes.Interface
+
+	queue       workqueue.RateLimitingInterface
+	deployments listersv1.DeploymentLister
+	daemonsets  listersv1.DaemonSetLister
+}
+
+// RunController watches workloads instead of admitting them, for clusters
+// that do not allow mutating webhooks. Only the replica holding the Lease
+// watches; RunController blocks until ctx is done. The kinds registered in
+// the workloads config are not watched, so registering any is an error
+// rather than leaving their objects on the original registry unnoticed.
+func RunController(ctx context.Context, cfg Config, cs kubernetes.Interface, opts ControllerOptions) error {
+	if cfg.WorkloadsFile != "" {
+		return fmt.Errorf("the controller only watches Deployments and DaemonSets; admit the kinds registered in the workloads config with the webhook")
+	}
+
+	s, err := newServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.LeaseNamespace != "" {
+		if err := s.useLeases(cs, cfg.LeaseNamespace); err != nil {
+			return err
+		}
+	}
+	if s.recorder == nil {
+		s.recorder = kube.NewRecorder(cs)
+	}
+
+	// Every replica serves its own metrics, whether it leads or not.
+	if srv := metricsServer(cfg.MetricsAddr); srv != nil {
+		go listen("metrics", srv)
+	}
+
+	// Every replica sweeps the images it left in its own node's daemon.
+	if s.sweeper != nil {
+		go s.sweeper(ctx)
+	}
+
+	// The notifiers send the events still queued once ctx is done, which
+	// RunController waits for before returning on shutdown.
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		if len(s.notifiers) > 0 {
+			s.notifiers.Run(ctx)
+		}
+	}()
+
+	err = kube.RunLeaderElected(ctx, cs, opts.LeaderElection, func(ctx context.Context) {
+		if err := s.runController(ctx, cs, opts); err != nil {
+			klog.ErrorS(err, "Controller stopped")
+		}
+	})
+	if ctx.Err() != nil {
+		<-notified
+	}
+	return err
+}
+
+func (s *server) runController(ctx context.Context, cs kubernetes.Interface, opts ControllerOptions) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 10*time.Minute,
+		informers.WithNamespace(opts.Namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = opts.Selector }))
+
+	c := &controller{
+		s:           s,
+		cs:          cs,
+		queue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "image-cloner"),
+		deployments: factory.Apps().V1().Deployments().Lister(),
+		daemonsets:  factory.Apps().V1().DaemonSets().Lister(),
+	}
+	defer c.queue.ShutDown()
+
+	factory.Apps().V1().Deployments().Informer().AddEventHandler(c.handler(kube.Deployment))
+	factory.Apps().V1().DaemonSets().Informer().AddEventHandler(c.handler(kube.DaemonSet))
+
+	factory.Start(ctx.Done())
+	for typ, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync informer for %v", typ)
+		}
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+
+	klog.InfoS("Controller watching workloads", "namespace", opts.Namespace, "selector", opts.Selector)
+	<-ctx.Done()
+	return nil
+}
+
+// handler enqueues the workloads of kind as "kind/namespace/name" when they
+// are added or updated.
+func (c *controller) handler(kind string) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			klog.ErrorS(err, "Failed to get the key of workload", "kind", kind)
+			return
+		}
+		c.queue.Add(kind + "/" + key)
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+	}
+}
+
+func (c *controller) worker(ctx context.Context) {
+	for c.processNext(ctx) {
+	}
+}
+
+func (c *controller) processNext(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key.(string)); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to sync workload", "key", key)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync clones the images of the workload at key that are not yet in the
+// backup registry. The patch fails, and the workload is synced again, if
+// its images were changed meanwhile; for instance by the webhook.
+func (c *controller) sync(ctx context.Context, key string) error {
+	w, err := c.workload(key)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	images := containerImages(containersPath, w.Containers)
+	pending := false
+	for _, img := range images {
+		if !c.s.isUsingBackupRegistry(img.ref) {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		return nil
+	}
+
+	ctx = workloadContext(ctx, w)
+	if err := c.s.backfillWorkload(ctx, c.cs, w, images); err != nil {
+		return err
+	}
+	klog.FromContext(ctx).Info("Patched workload to use the backup registry")
+	return nil
+}
+
+func (c *controller) workload(key string) (kube.Workload, error) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return kube.Workload{}, fmt.Errorf("invalid key %q", key)
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(parts[1])
+	if err != nil {
+		return kube.Workload{}, err
+	}
+
+	switch parts[0] {
+	case kube.Deployment:
+		d, err := c.deployments.Deployments(namespace).Get(name)
+		if err != nil {
+			return kube.Workload{}, err
+		}
+		return kube.DeploymentWorkload(d), nil
+	case kube.DaemonSet:
+		d, err := c.daemonsets.DaemonSets(namespace).Get(name)
+		if err != nil {
+			return kube.Workload{}, err
+		}
+		return kube.DaemonSetWorkload(d), nil
+	}
+	return kube.Workload{}, fmt.Errorf("unsupported kind %s", parts[0])
+}
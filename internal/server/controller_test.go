@@ -0,0 +1,81 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+func TestController(t *testing.T) {
+	cs := fake.NewSimpleClientset(backfillObjects()...)
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.runController(ctx, cs, ControllerOptions{Workers: 2}) }()
+
+	image := func(kind, name string) string {
+		if kind == kube.DaemonSet {
+			ds, err := cs.AppsV1().DaemonSets("default").Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return ""
+			}
+			return ds.Spec.Template.Spec.Containers[0].Image
+		}
+		d, err := cs.AppsV1().Deployments("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return ""
+		}
+		return d.Spec.Template.Spec.Containers[0].Image
+	}
+
+	assert.Eventually(t, func() bool {
+		return image(kube.Deployment, "alpine") == "gauravgahlot/alpine:3.12" &&
+			image(kube.DaemonSet, "agent") == "gauravgahlot/busybox:1.33"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Workloads created while the controller runs are patched too.
+	_, err := cs.AppsV1().Deployments("default").Create(ctx, testDeployment("default", "nginx", "nginx:1.21"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return image(kube.Deployment, "nginx") == "gauravgahlot/nginx:1.21"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, a := range cs.Actions() {
+		if a.GetVerb() == "patch" {
+			assert.NotEqual(t, "backed-up", a.(clienttesting.PatchAction).GetName())
+		}
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestRunControllerRegisteredKinds(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+
+	err := RunController(context.Background(), Config{WorkloadsFile: "workloads.yaml"}, cs, ControllerOptions{})
+	assert.EqualError(t, err, "the controller only watches Deployments and DaemonSets; admit the kinds registered in the workloads config with the webhook")
+	assert.Empty(t, cs.Actions())
+}
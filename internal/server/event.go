@@ -0,0 +1,109 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+)
+
+// Reasons of the Events recorded on the objects whose images are cloned.
+const (
+	reasonImageCloned  = "ImageCloned"
+	reasonCloneSkipped = "CloneSkipped"
+	reasonCloneFailed  = "CloneFailed"
+)
+
+// eventTarget is the object the Events of a clone are recorded on. An
+// object admitted on CREATE has no UID yet, so its Events are recorded on
+// its namespace, and their message names the object.
+type eventTarget struct {
+	ref *corev1.ObjectReference
+
+	// kind, namespace and name identify the object, whether the Events are
+	// recorded on it or on its namespace.
+	kind, namespace, name string
+
+	// admission is the admission of the object by the webhook, if any.
+	admission *admission
+}
+
+// workloadTarget returns the target of the Events of w.
+func workloadTarget(w kube.Workload) eventTarget {
+	return eventTarget{ref: w.Reference(), kind: w.Kind, namespace: w.Namespace, name: w.Name}
+}
+
+// admittedTarget returns the target of the Events of the object of kind
+// gvk admitted in namespace, whose metadata is meta.
+func admittedTarget(gvk metav1.GroupVersionKind, namespace string, meta metav1.ObjectMeta) eventTarget {
+	t := eventTarget{kind: gvk.Kind, namespace: namespace, name: meta.Name}
+	if meta.UID != "" {
+		t.ref = &corev1.ObjectReference{
+			APIVersion: schema.GroupVersion{Group: gvk.Group, Version: gvk.Version}.String(),
+			Kind:       gvk.Kind,
+			Namespace:  namespace,
+			Name:       meta.Name,
+			UID:        meta.UID,
+		}
+		return t
+	}
+
+	// The name of an object created with generateName is not known either.
+	if t.name == "" {
+		t.name = meta.GenerateName + "*"
+	}
+	t.ref = &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Namespace:  namespace,
+		Name:       namespace,
+	}
+	return t
+}
+
+// record records e as an Event on t, sends it to the notifiers, and adds
+// it to the audit records of the admission of t. No Event is recorded if
+// the server has no recorder, or t no object.
+func (s *server) record(t eventTarget, e notify.Event) {
+	e.Kind, e.Namespace, e.Name = t.kind, t.namespace, t.name
+	s.notifiers.Notify(e)
+	if t.admission != nil {
+		t.admission.add(e)
+	}
+
+	if s.recorder == nil || t.ref == nil {
+		return
+	}
+
+	eventType, reason := corev1.EventTypeNormal, reasonImageCloned
+	switch e.Type {
+	case notify.CloneSkipped:
+		reason = reasonCloneSkipped
+	case notify.CloneFailed:
+		eventType, reason = corev1.EventTypeWarning, reasonCloneFailed
+	}
+
+	msg := e.Message
+	if t.ref.Kind != t.kind {
+		msg = fmt.Sprintf("%s %s: %s", t.kind, t.name, msg)
+	}
+	s.recorder.Event(t.ref, eventType, reason, msg)
+}
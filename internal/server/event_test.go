@@ -0,0 +1,123 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+)
+
+func TestAdmittedTarget(t *testing.T) {
+	gvk := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: deployment}
+
+	cases := map[string]struct {
+		meta   metav1.ObjectMeta
+		target eventTarget
+	}{
+		"existing": {
+			meta: metav1.ObjectMeta{Name: "alpine", UID: "1234"},
+			target: eventTarget{
+				ref: &corev1.ObjectReference{
+					APIVersion: "apps/v1", Kind: deployment, Namespace: "default", Name: "alpine", UID: "1234",
+				},
+				kind: deployment, namespace: "default", name: "alpine",
+			},
+		},
+		"created": {
+			meta: metav1.ObjectMeta{Name: "alpine"},
+			target: eventTarget{
+				ref:  &corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Namespace: "default", Name: "default"},
+				kind: deployment, namespace: "default", name: "alpine",
+			},
+		},
+		"generated-name": {
+			meta: metav1.ObjectMeta{GenerateName: "alpine-"},
+			target: eventTarget{
+				ref:  &corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Namespace: "default", Name: "default"},
+				kind: deployment, namespace: "default", name: "alpine-*",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.target, admittedTarget(gvk, "default", tc.meta))
+		})
+	}
+}
+
+func TestTryCreatePatchesEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser))
+	s.recorder = recorder
+
+	d := testDeployment("default", "alpine", "gauravgahlot/alpine:3.12", "busybox:1.33")
+	images := containerImages(containersPath, d.Spec.Template.Spec.Containers)
+	target := workloadTarget(kube.DeploymentWorkload(d))
+
+	_, err := s.tryCreatePatches(context.Background(), target, images, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Normal CloneSkipped Image gauravgahlot/alpine:3.12 of container alpine is already in the backup registry", <-recorder.Events)
+	assert.Equal(t, "Normal ImageCloned Cloned image busybox:1.33 of container sidecar to gauravgahlot/busybox:1.33", <-recorder.Events)
+
+	// Nothing is recorded without a target.
+	_, err = s.tryCreatePatches(context.Background(), eventTarget{}, images, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, recorder.Events)
+}
+
+type notifySink chan []notify.Event
+
+func (s notifySink) Send(ctx context.Context, events []notify.Event) error {
+	s <- events
+	return nil
+}
+
+func TestTryCreatePatchesNotify(t *testing.T) {
+	sink := make(notifySink, 1)
+	failing := dockerClient()
+	failing.ImagePullFunc = func(ctx context.Context, image string) error { return errors.New("not found") }
+	s := testServer(t, failing, withRegistryUser(registryUser))
+	s.notifiers = notify.Notifiers{notify.New("test", sink, notify.Options{Types: []string{"clone.failed"}, BatchSize: 1})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.notifiers.Run(ctx)
+
+	d := testDeployment("default", "alpine", "gauravgahlot/alpine:3.12", "busybox:1.33")
+	images := containerImages(containersPath, d.Spec.Template.Spec.Containers)
+	_, err := s.tryCreatePatches(context.Background(), workloadTarget(kube.DeploymentWorkload(d)), images, nil)
+	assert.Error(t, err)
+
+	// The skipped image is filtered out.
+	events := <-sink
+	assert.Len(t, events, 1)
+	assert.Equal(t, notify.CloneFailed, events[0].Type)
+	assert.Equal(t, deployment, events[0].Kind)
+	assert.Equal(t, "default", events[0].Namespace)
+	assert.Equal(t, "alpine", events[0].Name)
+	assert.Equal(t, "sidecar", events[0].Container)
+	assert.Equal(t, "busybox:1.33", events[0].Source)
+	assert.Equal(t, "failed to pull docker image: not found", events[0].Error)
+}
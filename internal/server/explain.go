@@ -0,0 +1,202 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+// What the webhook would do to an explained image.
+const (
+	explainIgnore  = "ignore"
+	explainSkip    = "skip"
+	explainRewrite = "rewrite"
+	explainDeny    = "deny"
+)
+
+// explanation tells what the webhook would do to an image of a container of
+// an object of kind in namespace, and why.
+type explanation struct {
+	Image     string           `json:"image"`
+	Reference explainReference `json:"reference"`
+	Kind      string           `json:"kind"`
+	Namespace string           `json:"namespace,omitempty"`
+
+	// Rules are the rules that applied to the image, in the order they were
+	// evaluated.
+	Rules []explainRule `json:"rules"`
+
+	// Destination is the backup the image would be rewritten to, and
+	// DestinationExists whether its tag exists; unknown if it could not be
+	// checked.
+	Destination       string `json:"destination,omitempty"`
+	DestinationExists *bool  `json:"destinationExists,omitempty"`
+
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+// explainReference is the parsed reference of an explained image.
+type explainReference struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+type explainRule struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// handleExplain writes what the webhook would do to the image of the query,
+// without cloning it.
+func (s *server) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	ref, err := name.ParseReference(q.Get("image"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid image: %v", err))
+		return
+	}
+
+	kind := q.Get("kind")
+	if kind == "" {
+		kind = deployment
+	}
+	writeJSON(w, http.StatusOK, s.explain(r.Context(), ref, kind, q.Get("namespace")))
+}
+
+// explain evaluates the rules the webhook applies to ref in an object of
+// kind in namespace. It only reads the registries and the namespace, so
+// that nothing is cloned, pushed or recorded.
+func (s *server) explain(ctx context.Context, ref name.Reference, kind, namespace string) explanation {
+	src := ref.String()
+	e := explanation{
+		Image:     src,
+		Reference: explainReference{Registry: ref.Context().RegistryStr(), Repository: ref.Context().RepositoryStr()},
+		Kind:      kind,
+		Namespace: namespace,
+		Rules:     []explainRule{},
+	}
+	switch r := ref.(type) {
+	case name.Tag:
+		e.Reference.Tag = r.TagStr()
+	case name.Digest:
+		e.Reference.Digest = r.DigestStr()
+	}
+
+	rule, admitted := s.kindRule(kind)
+	e.rule("kind", rule)
+	if !admitted {
+		return e.decide(explainIgnore, fmt.Sprintf("The webhook does not admit %s objects, so their images are left as they are", kind))
+	}
+
+	if s.isUsingBackupRegistry(src) {
+		e.rule("backup-registry", "The image is already in the backup registry")
+		return e.decide(explainSkip, "The image would be left as it is")
+	}
+
+	if s.resyncer != nil && namespace != "" && s.resyncer.mutable(src) {
+		policy := s.namespacePolicy(ctx, map[string]ResyncPolicy{}, namespace)
+		e.rule("resync", fmt.Sprintf("The tag is resynced with the %s policy of namespace %s", policy, namespace))
+	}
+
+	// The daemon pulls the image of its own platform from an index.
+	platform, err := s.client.Platform(ctx)
+	if err != nil {
+		e.rule("platform", fmt.Sprintf("The platform of the Docker daemon could not be read, so the image for linux/amd64 is resolved: %v", err))
+	}
+
+	id, err := s.registryClient.ConfigDigest(ctx, src, platform)
+	if err != nil {
+		return e.decide(explainDeny, fmt.Sprintf("The image could not be resolved, so cloning it would fail: %v", err))
+	}
+
+	e.Destination = newImage(src, s.registry, s.registryUser)
+	e.rule("destination", fmt.Sprintf("The backup of the image is named after its last path element, in the repository of %s", s.registryUser))
+
+	existing, err := s.registryClient.ConfigDigest(ctx, e.Destination, platform)
+	if err == nil || errors.Is(err, registry.ErrNotFound) {
+		exists := err == nil
+		e.DestinationExists = &exists
+	}
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		// The backup is pushed to a new tag.
+	case err != nil:
+		if s.tagConflict != TagConflictOverwrite {
+			e.rule("tag-conflict", fmt.Sprintf("The backup tag could not be checked, which the %s policy refuses: %v", s.tagConflict, err))
+			return e.decide(explainDeny, fmt.Sprintf("failed to check backup tag %s: %v", e.Destination, err))
+		}
+		e.rule("tag-conflict", fmt.Sprintf("The backup tag could not be checked, so the %s policy overwrites it: %v", s.tagConflict, err))
+	case existing == id:
+		e.rule("backup-exists", "The backup tag already has the image, which would be pushed again")
+	default:
+		switch s.tagConflict {
+		case TagConflictKeep:
+			e.rule("tag-conflict", fmt.Sprintf("The backup tag has image %s, so the keep policy pushes to a tag suffixed with image %s", existing, id))
+			if e.Destination, err = digestSuffixedTag(e.Destination, id); err != nil {
+				return e.decide(explainDeny, err.Error())
+			}
+		case TagConflictRefuse:
+			e.rule("tag-conflict", fmt.Sprintf("The backup tag has image %s, which the refuse policy does not overwrite", existing))
+			return e.decide(explainDeny, errTagConflict{dst: e.Destination, existing: existing, id: id}.Error())
+		default:
+			e.rule("tag-conflict", fmt.Sprintf("The backup tag has image %s, which the overwrite policy pushes over", existing))
+		}
+	}
+
+	if s.pinDigest {
+		e.rule("pin-digest", "The container would use the backup by the digest of its push rather than its tag")
+	}
+	return e.decide(explainRewrite, fmt.Sprintf("The image would be cloned to %s, and the container rewritten to use it", e.Destination))
+}
+
+// kindRule reports whether the webhook admits objects of kind, and how.
+func (s *server) kindRule(kind string) (string, bool) {
+	for gvk, paths := range s.workloads {
+		if gvk.Kind == kind {
+			return fmt.Sprintf("%s is registered in the workloads config, with its images at %v", kind, paths), true
+		}
+	}
+
+	switch kind {
+	case deployment, daemonset:
+		return fmt.Sprintf("%s is a built-in workload, with its images in its pod template", kind), true
+	}
+	return fmt.Sprintf("%s is neither a built-in workload nor registered in the workloads config", kind), false
+}
+
+func (e *explanation) rule(name, msg string) {
+	e.Rules = append(e.Rules, explainRule{Name: name, Message: msg})
+}
+
+func (e explanation) decide(action, msg string) explanation {
+	e.Action, e.Message = action, msg
+	return e
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+const otherID = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// explainRegistry returns a registry client whose images for the platform
+// of the daemon have the config digests in configs, and no others.
+func explainRegistry(configs map[string]string) mockRegistryClient {
+	return mockRegistryClient{ConfigDigestFunc: func(ctx context.Context, ref, p string) (string, error) {
+		if id, ok := configs[ref]; ok && p == platform {
+			return id, nil
+		}
+		return "", registry.ErrNotFound
+	}}
+}
+
+func TestExplain(t *testing.T) {
+	notExists, exists := false, true
+
+	cases := map[string]struct {
+		image     string
+		kind      string
+		modifiers []serverModifier
+		rules     []string
+		dst       string
+		exists    *bool
+		action    string
+	}{
+		"new-backup": {
+			image:     alpine,
+			modifiers: []serverModifier{withRegistryClient(explainRegistry(map[string]string{alpine: digest}))},
+			rules:     []string{"kind", "destination"},
+			dst:       "gauravgahlot/alpine:3.12",
+			exists:    &notExists,
+			action:    explainRewrite,
+		},
+		"existing-backup": {
+			image: alpine,
+			modifiers: []serverModifier{
+				withRegistryClient(explainRegistry(map[string]string{alpine: digest, "gauravgahlot/alpine:3.12": digest})),
+				withPinDigest(),
+			},
+			rules:  []string{"kind", "destination", "backup-exists", "pin-digest"},
+			dst:    "gauravgahlot/alpine:3.12",
+			exists: &exists,
+			action: explainRewrite,
+		},
+		"tag-conflict-keep": {
+			image: alpine,
+			modifiers: []serverModifier{
+				withRegistryClient(explainRegistry(map[string]string{alpine: digest, "gauravgahlot/alpine:3.12": otherID})),
+				withTagConflict(TagConflictKeep),
+			},
+			rules:  []string{"kind", "destination", "tag-conflict"},
+			dst:    "gauravgahlot/alpine:3.12-87703314048c",
+			exists: &exists,
+			action: explainRewrite,
+		},
+		"tag-conflict-refuse": {
+			image: alpine,
+			modifiers: []serverModifier{
+				withRegistryClient(explainRegistry(map[string]string{alpine: digest, "gauravgahlot/alpine:3.12": otherID})),
+				withTagConflict(TagConflictRefuse),
+			},
+			rules:  []string{"kind", "destination", "tag-conflict"},
+			dst:    "gauravgahlot/alpine:3.12",
+			exists: &exists,
+			action: explainDeny,
+		},
+		"check-failed-refuse": {
+			image: alpine,
+			modifiers: []serverModifier{
+				withRegistryClient(mockRegistryClient{ConfigDigestFunc: func(ctx context.Context, ref, platform string) (string, error) {
+					if ref == alpine {
+						return digest, nil
+					}
+					return "", errors.New("unauthorized")
+				}}),
+				withTagConflict(TagConflictRefuse),
+			},
+			rules:  []string{"kind", "destination", "tag-conflict"},
+			dst:    "gauravgahlot/alpine:3.12",
+			action: explainDeny,
+		},
+		"source-not-found": {
+			image:  alpine,
+			rules:  []string{"kind"},
+			action: explainDeny,
+		},
+		"backup-registry": {
+			image:  "gauravgahlot/alpine:3.12",
+			rules:  []string{"kind", "backup-registry"},
+			action: explainSkip,
+		},
+		"kind-not-admitted": {
+			image:  alpine,
+			kind:   "StatefulSet",
+			rules:  []string{"kind"},
+			action: explainIgnore,
+		},
+		"registered-kind": {
+			image: alpine,
+			kind:  "CronJob",
+			modifiers: []serverModifier{
+				withRegistryClient(explainRegistry(map[string]string{alpine: digest})),
+				withWorkloads(workloads{{Group: "batch", Version: "v1", Kind: "CronJob"}: {"/spec/jobTemplate/spec/template/spec/containers"}}),
+			},
+			rules:  []string{"kind", "destination"},
+			dst:    "gauravgahlot/alpine:3.12",
+			exists: &notExists,
+			action: explainRewrite,
+		},
+	}
+
+	for n, tc := range cases {
+		t.Run(n, func(t *testing.T) {
+			calls := 0
+			d := dockerClient()
+			d.ImagePullFunc = func(ctx context.Context, image string) error {
+				calls++
+				return nil
+			}
+			s := testServer(t, d, append([]serverModifier{withRegistryUser(registryUser)}, tc.modifiers...)...)
+
+			kind := tc.kind
+			if kind == "" {
+				kind = deployment
+			}
+			ref, err := name.ParseReference(tc.image)
+			assert.NoError(t, err)
+			e := s.explain(context.Background(), ref, kind, "default")
+
+			rules := []string{}
+			for _, r := range e.Rules {
+				rules = append(rules, r.Name)
+			}
+			assert.Equal(t, tc.rules, rules)
+			assert.Equal(t, tc.dst, e.Destination)
+			assert.Equal(t, tc.exists, e.DestinationExists)
+			assert.Equal(t, tc.action, e.Action)
+			assert.NotEmpty(t, e.Message)
+			assert.Zero(t, calls)
+		})
+	}
+}
+
+func TestExplainResync(t *testing.T) {
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser),
+		withRegistryClient(explainRegistry(map[string]string{"alpine:latest": digest})))
+	s.kube = fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name: "default", Annotations: map[string]string{annotation.ResyncPolicy: "rollout"},
+	}})
+	s.resyncer = &resyncer{policy: ResyncBackup, copied: map[string]string{}}
+
+	e := s.explain(context.Background(), name.MustParseReference("alpine:latest"), deployment, "default")
+	assert.Equal(t, explainRule{Name: "resync", Message: "The tag is resynced with the rollout policy of namespace default"}, e.Rules[1])
+	assert.Equal(t, explainReference{Registry: "index.docker.io", Repository: "library/alpine", Tag: "latest"}, e.Reference)
+	assert.Equal(t, explainRewrite, e.Action)
+}
+
+func TestAPIExplain(t *testing.T) {
+	srv := testAPI(t, testServer(t, dockerClient(), withRegistryUser(registryUser)))
+
+	res := apiRequest(t, srv, http.MethodGet, "/explain", "", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	var e explanation
+	res = apiRequest(t, srv, http.MethodGet, "/explain?image=gauravgahlot/alpine:3.12&namespace=default", "", &e)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, deployment, e.Kind)
+	assert.Equal(t, "default", e.Namespace)
+	assert.Equal(t, explainSkip, e.Action)
+}
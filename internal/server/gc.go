@@ -0,0 +1,152 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/gc"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+// GC deletes the backups that are not used by the workloads of the cluster
+// of cs, nor kept by opts. Repositories are named relative to the backup
+// registry and user, such as "alpine"; every repository of the user in the
+// catalog of the backup registry is collected if none is given. The objects
+// of the kinds registered in the workloads config are listed with dyn. The
+// push times of the backups are recorded in the lease namespace, if any.
+func GC(ctx context.Context, cfg Config, cs kubernetes.Interface, dyn dynamic.Interface, opts gc.Options) (gc.Report, error) {
+	s, err := newServer(cfg)
+	if err != nil {
+		return gc.Report{}, err
+	}
+	s.dynamic = dyn
+	if cfg.LeaseNamespace != "" {
+		s.pushes = kube.NewPushLog(cs, cfg.LeaseNamespace)
+	}
+	return s.gc(ctx, cs, opts)
+}
+
+func (s *server) gc(ctx context.Context, cs kubernetes.Interface, opts gc.Options) (gc.Report, error) {
+	repos := []string{}
+	for _, r := range opts.Repositories {
+		repos = append(repos, newImage(r, s.registry, s.registryUser))
+	}
+	if len(repos) == 0 {
+		var err error
+		repos, err = s.registryClient.Repositories(ctx, s.registryUser)
+		if err != nil {
+			return gc.Report{}, fmt.Errorf("failed to list the repositories of %s; list them explicitly if the registry has no catalog: %v", s.registryUser, err)
+		}
+	}
+	opts.Repositories = repos
+
+	if s.pushes != nil {
+		opts.PushLog = s.pushes
+	} else if opts.KeepWithin > 0 || opts.Grace > 0 {
+		return gc.Report{}, fmt.Errorf("keeping tags by their push time requires a lease namespace, where the push times are recorded")
+	}
+
+	images, err := kube.ListImages(ctx, cs)
+	if err != nil {
+		return gc.Report{}, err
+	}
+	custom, err := s.registeredImages(ctx, cs)
+	if err != nil {
+		return gc.Report{}, err
+	}
+	images = append(images, custom...)
+	return gc.Run(ctx, s.registryClient, images, opts), nil
+}
+
+// registeredImages returns the images of the objects of the kinds
+// registered in the workloads config, in all namespaces. Their resources
+// are resolved with the discovery API of cs.
+func (s *server) registeredImages(ctx context.Context, cs kubernetes.Interface) ([]string, error) {
+	images := []string{}
+	if len(s.workloads) == 0 {
+		return images, nil
+	}
+	if s.dynamic == nil {
+		return nil, fmt.Errorf("listing the kinds registered in the workloads config requires a dynamic client")
+	}
+
+	kinds := s.workloads.kinds()
+	resources, err := kube.Resources(cs, kinds)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, gvk := range kinds {
+		list, err := s.dynamic.Resource(resources[i]).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range list.Items {
+			raw, err := obj.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			found, err := unstructuredImages(raw, s.workloads.paths(gvk))
+			if err != nil {
+				return nil, fmt.Errorf("%s %s/%s: %v", gvk.Kind, obj.GetNamespace(), obj.GetName(), err)
+			}
+			for _, img := range found {
+				images = append(images, img.ref)
+			}
+		}
+	}
+	return images, nil
+}
+
+// recordPush records that backup was just pushed, so that the garbage
+// collection keeps it by its push time. A failure is only logged: the
+// collection then records the tag as pushed when it first lists it.
+func (s *server) recordPush(ctx context.Context, backup string) {
+	tag, err := name.NewTag(backup)
+	if err == nil {
+		err = s.pushes.Record(ctx, tag.Name(), time.Now())
+	}
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to record the push of the backup")
+	}
+}
+
+// periodicGC returns a task collecting the backups every interval. The tags
+// pushed since the previous collection are kept, since the workloads whose
+// admission pushed them may not be created yet.
+func (s *server) periodicGC(interval time.Duration, opts gc.Options) func(context.Context) {
+	opts.Grace = interval
+	return func(ctx context.Context) {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			report, err := s.gc(ctx, s.kube, opts)
+			if err != nil {
+				klog.ErrorS(err, "Garbage collection failed")
+				return
+			}
+			klog.InfoS("Garbage collection done",
+				"kept", len(report.Kept), "deleted", len(report.Deleted), "errors", len(report.Errors))
+		}, interval)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/gauravgahlot/image-cloner/internal/gc"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+func gcRegistryClient(deleted *[]string) mockRegistryClient {
+	return mockRegistryClient{
+		RepositoriesFunc: func(ctx context.Context, namespace string) ([]string, error) {
+			return []string{"index.docker.io/" + namespace + "/alpine"}, nil
+		},
+		TagsFunc: func(ctx context.Context, repo string) ([]string, error) {
+			return []string{"3.12", "3.13"}, nil
+		},
+		DescribeFunc: func(ctx context.Context, ref string) (registry.Manifest, error) {
+			return registry.Manifest{Digest: map[string]string{
+				"index.docker.io/gauravgahlot/alpine:3.12": digest,
+				"index.docker.io/gauravgahlot/alpine:3.13": pushDigest,
+				"gauravgahlot/alpine:3.12":                 digest,
+				"gauravgahlot/alpine:3.13":                 pushDigest,
+			}[ref]}, nil
+		},
+		DeleteFunc: func(ctx context.Context, repo, digest string) error {
+			*deleted = append(*deleted, repo+"@"+digest)
+			return nil
+		},
+	}
+}
+
+func TestGC(t *testing.T) {
+	cs := fake.NewSimpleClientset(testDeployment("default", "alpine", "gauravgahlot/alpine:3.12"))
+
+	cases := map[string]struct {
+		opts gc.Options
+		repo string
+	}{
+		"catalog":    {opts: gc.Options{}, repo: "index.docker.io/gauravgahlot/alpine"},
+		"repository": {opts: gc.Options{Repositories: []string{"alpine"}}, repo: "gauravgahlot/alpine"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			deleted := []string{}
+			s := testServer(t, mockDockerClient{}, withRegistryUser(registryUser),
+				withRegistryClient(gcRegistryClient(&deleted)))
+
+			report, err := s.gc(context.Background(), cs, tc.opts)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{tc.repo + "@" + pushDigest}, deleted)
+			assert.Len(t, report.Kept, 1)
+			assert.Equal(t, gc.InUse, report.Kept[0].Reason)
+		})
+	}
+}
+
+func TestGCNoCatalog(t *testing.T) {
+	r := mockRegistryClient{RepositoriesFunc: func(ctx context.Context, namespace string) ([]string, error) {
+		return nil, errors.New("UNSUPPORTED")
+	}}
+	s := testServer(t, mockDockerClient{}, withRegistryUser(registryUser), withRegistryClient(r))
+
+	_, err := s.gc(context.Background(), fake.NewSimpleClientset(), gc.Options{})
+	assert.Error(t, err)
+}
+
+func TestGCMinimalConfig(t *testing.T) {
+	// The registry is not reached once the context is canceled, so only the
+	// setup of the server is tested.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := GC(ctx, Config{}, fake.NewSimpleClientset(), nil, gc.Options{Repositories: []string{"alpine"}, DryRun: true})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Deleted)
+}
+
+func TestGCRegisteredKinds(t *testing.T) {
+	cs := fake.NewSimpleClientset(testDeployment("default", "alpine", "gauravgahlot/alpine:3.12"))
+	cs.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "tekton.dev/v1beta1",
+		APIResources: []metav1.APIResource{{Name: "tasks", Namespaced: true, Kind: "Task"}},
+	}}
+
+	task := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "tekton.dev/v1beta1",
+		"kind":       "Task",
+		"metadata":   map[string]interface{}{"namespace": "default", "name": "build"},
+		"spec": map[string]interface{}{"steps": []interface{}{
+			map[string]interface{}{"name": "build", "image": "gauravgahlot/alpine:3.13"},
+		}},
+	}}
+	dyn := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{{Group: "tekton.dev", Version: "v1beta1", Resource: "tasks"}: "TaskList"}, task)
+
+	deleted := []string{}
+	s := testServer(t, mockDockerClient{}, withRegistryUser(registryUser), withRegistryClient(gcRegistryClient(&deleted)),
+		withWorkloads(workloads{{Group: "tekton.dev", Version: "v1beta1", Kind: "Task"}: {"/spec/steps"}}))
+
+	// The backups used by the registered kinds are not known without a
+	// dynamic client, so none is deleted.
+	_, err := s.gc(context.Background(), cs, gc.Options{})
+	assert.Error(t, err)
+	assert.Empty(t, deleted)
+
+	s.dynamic = dyn
+	report, err := s.gc(context.Background(), cs, gc.Options{})
+	assert.NoError(t, err)
+	assert.Empty(t, deleted)
+	assert.Len(t, report.Kept, 2)
+}
+
+func TestGCPushTimes(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	deleted := []string{}
+	r := gcRegistryClient(&deleted)
+	r.ConfigDigestFunc = func(ctx context.Context, ref, platform string) (string, error) {
+		return "", registry.ErrNotFound
+	}
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser), withRegistryClient(r))
+
+	// Tags are not kept by their push time without a push log.
+	_, err := s.gc(context.Background(), cs, gc.Options{KeepWithin: time.Hour})
+	assert.Error(t, err)
+
+	// The push of a clone is recorded, and keeps its tag, although its
+	// image was built long ago.
+	s.pushes = kube.NewPushLog(cs, "default")
+	_, _, err = s.clone(context.Background(), alpine)
+	assert.NoError(t, err)
+	pushes, err := s.pushes.Pushes(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, pushes, "index.docker.io/gauravgahlot/alpine:3.12")
+
+	assert.NoError(t, s.pushes.Record(context.Background(), "index.docker.io/gauravgahlot/alpine:3.13", time.Now().Add(-2*time.Hour)))
+	report, err := s.gc(context.Background(), cs, gc.Options{KeepWithin: time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"index.docker.io/gauravgahlot/alpine@" + pushDigest}, deleted)
+	assert.Len(t, report.Kept, 1)
+	assert.Equal(t, gc.Retained, report.Kept[0].Reason)
+}
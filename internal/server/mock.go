@@ -14,7 +14,12 @@
 
 package server
 
-import "context"
+import (
+	"context"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
 
 type serverModifier func(*server)
 
@@ -26,19 +31,120 @@ func withRegistryUser(user string) serverModifier {
 	return func(s *server) { s.registryUser = user }
 }
 
+func withPinDigest() serverModifier {
+	return func(s *server) { s.pinDigest = true }
+}
+
+func withRegistryClient(r mockRegistryClient) serverModifier {
+	return func(s *server) { s.registryClient = r }
+}
+
+func withTagConflict(p TagConflictPolicy) serverModifier {
+	return func(s *server) { s.tagConflict = p }
+}
+
+func withWorkloads(w workloads) serverModifier {
+	return func(s *server) { s.workloads = w }
+}
+
 type mockDockerClient struct {
 	ImagePullFunc func(ctx context.Context, image string) error
-	ImagePushFunc func(ctx context.Context, image string) error
+	ImagePushFunc func(ctx context.Context, image string) (string, error)
 	ImageTagFunc  func(ctx context.Context, src, dst string) error
+
+	ImageInspectFunc func(ctx context.Context, image string) (docker.Image, error)
+	ImageExistsFunc  func(ctx context.Context, image string) (bool, error)
+	ImageRemoveFunc  func(ctx context.Context, image string) error
+	DiskUsageFunc    func(ctx context.Context) (int64, error)
+	PlatformFunc     func(ctx context.Context) (string, error)
 }
 
 func (d mockDockerClient) ImagePull(ctx context.Context, image string) error {
 	return d.ImagePullFunc(ctx, image)
 }
-func (d mockDockerClient) ImagePush(ctx context.Context, image string) error {
+func (d mockDockerClient) ImagePush(ctx context.Context, image string) (string, error) {
 	return d.ImagePushFunc(ctx, image)
 }
 
 func (d mockDockerClient) ImageTag(ctx context.Context, src, dst string) error {
 	return d.ImageTagFunc(ctx, src, dst)
 }
+
+func (d mockDockerClient) ImageInspect(ctx context.Context, image string) (docker.Image, error) {
+	return d.ImageInspectFunc(ctx, image)
+}
+
+func (d mockDockerClient) ImageExists(ctx context.Context, image string) (bool, error) {
+	return d.ImageExistsFunc(ctx, image)
+}
+
+func (d mockDockerClient) ImageRemove(ctx context.Context, image string) error {
+	return d.ImageRemoveFunc(ctx, image)
+}
+
+func (d mockDockerClient) DiskUsage(ctx context.Context) (int64, error) {
+	return d.DiskUsageFunc(ctx)
+}
+
+func (d mockDockerClient) Platform(ctx context.Context) (string, error) {
+	return d.PlatformFunc(ctx)
+}
+
+type mockRegistryClient struct {
+	ConfigDigestFunc  func(ctx context.Context, ref, platform string) (string, error)
+	HeadFunc          func(ctx context.Context, ref string) (string, error)
+	VerifyFunc        func(ctx context.Context, ref string) (registry.Verified, error)
+	ConfigDigestsFunc func(ctx context.Context, ref string) ([]string, error)
+	RepositoriesFunc  func(ctx context.Context, namespace string) ([]string, error)
+	TagsFunc          func(ctx context.Context, repo string) ([]string, error)
+	DescribeFunc      func(ctx context.Context, ref string) (registry.Manifest, error)
+	DeleteFunc        func(ctx context.Context, repo, digest string) error
+}
+
+func (r mockRegistryClient) ConfigDigest(ctx context.Context, ref, platform string) (string, error) {
+	return r.ConfigDigestFunc(ctx, ref, platform)
+}
+
+func (r mockRegistryClient) Head(ctx context.Context, ref string) (string, error) {
+	return r.HeadFunc(ctx, ref)
+}
+
+func (r mockRegistryClient) Verify(ctx context.Context, ref string) (registry.Verified, error) {
+	return r.VerifyFunc(ctx, ref)
+}
+
+func (r mockRegistryClient) ConfigDigests(ctx context.Context, ref string) ([]string, error) {
+	return r.ConfigDigestsFunc(ctx, ref)
+}
+
+func (r mockRegistryClient) Repositories(ctx context.Context, namespace string) ([]string, error) {
+	return r.RepositoriesFunc(ctx, namespace)
+}
+
+func (r mockRegistryClient) Tags(ctx context.Context, repo string) ([]string, error) {
+	return r.TagsFunc(ctx, repo)
+}
+
+func (r mockRegistryClient) Describe(ctx context.Context, ref string) (registry.Manifest, error) {
+	return r.DescribeFunc(ctx, ref)
+}
+
+func (r mockRegistryClient) Delete(ctx context.Context, repo, digest string) error {
+	return r.DeleteFunc(ctx, repo, digest)
+}
+
+func withLocalImages() serverModifier {
+	return func(s *server) { s.local = newLocalImages(s.client) }
+}
+
+func withLocker(l mockLocker) serverModifier {
+	return func(s *server) { s.locker = l }
+}
+
+type mockLocker struct {
+	LockFunc func(ctx context.Context, image string) (context.Context, func(), error)
+}
+
+func (l mockLocker) Lock(ctx context.Context, image string) (context.Context, func(), error) {
+	return l.LockFunc(ctx, image)
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/jobs"
+)
+
+const (
+	// progressBuffer is the number of progress events buffered for a
+	// subscriber; more are dropped until it catches up.
+	progressBuffer = 64
+
+	// keepAliveInterval is how often a comment is sent on an idle stream, so
+	// that proxies do not close it.
+	keepAliveInterval = 15 * time.Second
+)
+
+// progressHub fans the progress of the layers of a clone out to the
+// subscribers of its job. The methods of a nil progressHub do nothing.
+type progressHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan docker.Progress]struct{}
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{subs: map[string]map[chan docker.Progress]struct{}{}}
+}
+
+// subscribe returns the channel receiving the progress of the job id, which
+// is closed once the job is done, and the function to unsubscribe.
+func (h *progressHub) subscribe(id string) (<-chan docker.Progress, func()) {
+	ch := make(chan docker.Progress, progressBuffer)
+	if h == nil {
+		close(ch)
+		return ch, func() {}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[id] == nil {
+		h.subs[id] = map[chan docker.Progress]struct{}{}
+	}
+	h.subs[id][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[id][ch]; ok {
+			delete(h.subs[id], ch)
+			if len(h.subs[id]) == 0 {
+				delete(h.subs, id)
+			}
+		}
+	}
+}
+
+// publish sends p to the subscribers of the job id, without waiting for
+// those that are behind.
+func (h *progressHub) publish(id string, p docker.Progress) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[id] {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// done closes the channels of the subscribers of the job id.
+func (h *progressHub) done(id string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[id] {
+		close(ch)
+	}
+	delete(h.subs, id)
+}
+
+// handleProgress streams the progress of the layers of the job id as
+// Server-Sent Events, each a progress event, followed by a done event with
+// the job once it is finished.
+func (s *server) handleProgress(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, "streaming is not supported")
+		return
+	}
+
+	// The job is looked up once subscribed, so that it cannot finish in
+	// between unnoticed.
+	ch, unsubscribe := s.progress.subscribe(id)
+	defer unsubscribe()
+	job, ok := s.jobs.Get(id)
+	if !ok {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("clone %q not found", id))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for job.Status == jobs.Running {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case p, ok := <-ch:
+			if !ok {
+				job, _ = s.jobs.Get(id)
+				continue
+			}
+			writeEvent(w, "progress", p)
+		}
+		flusher.Flush()
+	}
+
+	writeEvent(w, "done", job)
+	flusher.Flush()
+}
+
+// writeEvent writes v as the JSON data of a Server-Sent Event.
+func writeEvent(w http.ResponseWriter, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		klog.ErrorS(err, "Failed to encode event", "event", event)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// splitClonePath returns the ID of the job of a path under /clones/, and
+// the rest of the path.
+func splitClonePath(path string) (string, string) {
+	id := strings.TrimPrefix(path, "/clones/")
+	if i := strings.Index(id, "/"); i >= 0 {
+		return id[:i], id[i:]
+	}
+	return id, ""
+}
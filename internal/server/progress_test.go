@@ -0,0 +1,144 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/jobs"
+)
+
+func TestProgressHub(t *testing.T) {
+	h := newProgressHub()
+	p := docker.Progress{Operation: "pull", Image: alpine, Layer: "8d3ac3489996", Status: "Downloading", Current: 512, Total: 2048}
+
+	ch, unsubscribe := h.subscribe("1")
+	other, unsubscribeOther := h.subscribe("2")
+	h.publish("1", p)
+	assert.Equal(t, p, <-ch)
+	assert.Empty(t, other)
+
+	// A subscriber that is behind misses the events it has no room for.
+	for i := 0; i < progressBuffer+1; i++ {
+		h.publish("1", p)
+	}
+	assert.Len(t, ch, progressBuffer)
+
+	h.done("1")
+	for range ch {
+	}
+	unsubscribe()
+	unsubscribeOther()
+	assert.Empty(t, h.subs)
+
+	var nilHub *progressHub
+	ch, unsubscribe = nilHub.subscribe("1")
+	nilHub.publish("1", p)
+	nilHub.done("1")
+	unsubscribe()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+type sseEvent struct {
+	event string
+	data  string
+}
+
+// readEvent reads the next event of a Server-Sent Events stream, skipping
+// comments.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return e
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.event != "":
+			return e
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestAPIProgress(t *testing.T) {
+	layers := make(chan docker.Progress)
+	d := dockerClient()
+	d.ImagePullFunc = func(ctx context.Context, image string) error {
+		for p := range layers {
+			docker.ProgressFrom(ctx)(p)
+		}
+		return nil
+	}
+	s := testServer(t, d, withRegistryUser(registryUser))
+	s.jobs = jobs.NewStore(10)
+	s.progress = newProgressHub()
+	srv := testAPI(t, s)
+
+	res := apiRequest(t, srv, http.MethodGet, "/clones/unknown/progress", "", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	var job jobs.Job
+	apiRequest(t, srv, http.MethodPost, "/clones", `{"image":"alpine:3.12"}`, &job)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/clones/"+job.ID+"/progress", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	res, err = srv.Client().Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// The stream is subscribed once its headers are sent.
+	downloading := docker.Progress{Operation: "pull", Image: alpine, Layer: "8d3ac3489996", Status: "Downloading", Current: 512, Total: 2048}
+	complete := docker.Progress{Operation: "pull", Image: alpine, Layer: "8d3ac3489996", Status: "Pull complete"}
+	layers <- downloading
+	layers <- complete
+	close(layers)
+
+	body := bufio.NewReader(res.Body)
+	for _, want := range []docker.Progress{downloading, complete} {
+		e := readEvent(t, body)
+		assert.Equal(t, "progress", e.event)
+		var p docker.Progress
+		assert.NoError(t, json.Unmarshal([]byte(e.data), &p))
+		assert.Equal(t, want, p)
+	}
+
+	e := readEvent(t, body)
+	assert.Equal(t, "done", e.event)
+	assert.NoError(t, json.Unmarshal([]byte(e.data), &job))
+	assert.Equal(t, jobs.Succeeded, job.Status)
+
+	// A finished job only has its done event.
+	res, err = srv.Client().Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "done", readEvent(t, bufio.NewReader(res.Body)).event)
+}
@@ -25,6 +25,6 @@ func (s *server) readyz(w http.ResponseWriter, req *http.Request) {
 
 	_, err := w.Write([]byte("OK"))
 	if err != nil {
-		klog.Errorf("[error]: %v", err)
+		klog.ErrorS(err, "Failed to write the readiness response")
 	}
 }
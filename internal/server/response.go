@@ -17,12 +17,25 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	klog "k8s.io/klog/v2"
+
+	"github.com/docker/distribution/reference"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/jobs"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+	"github.com/gauravgahlot/image-cloner/internal/pointer"
+	"github.com/gauravgahlot/image-cloner/internal/tracing"
 )
 
 const (
@@ -31,14 +44,26 @@ const (
 	jsonPatch  = "JSONPatch"
 	kind       = "AdmissionReview"
 	version    = "admission.k8s.io/v1"
+
+	// versionV1beta1 is served for API servers and tools that still send
+	// the older AdmissionReview version; its wire format matches v1.
+	versionV1beta1 = "admission.k8s.io/v1beta1"
 )
 
 const (
-	errDockerOperation  = "[error]: failed to %s docker image: %v"
+	errDockerOperation  = "failed to %s docker image: %v"
 	errCreatingPatch    = "Internal server error creating a patch. Please check the logs."
 	errMarshallingPatch = "Internal server error marshalling the patch. Please check the logs."
 )
 
+// image is a container image found in an admitted object, along with the
+// JSON pointer to its image field.
+type image struct {
+	container string
+	ref       string
+	path      string
+}
+
 type patch struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
@@ -58,8 +83,14 @@ type status struct {
 	reason  metav1.StatusReason
 }
 
-func (s *server) createResponse(ctx context.Context, containers []v1.Container, uid types.UID) (reviewResponse, error) {
-	patches, err := s.tryCreatePatches(ctx, containers)
+func (s *server) createResponse(ctx context.Context, target eventTarget, images []image, annotations map[string]string, uid types.UID) (_ reviewResponse, err error) {
+	ctx, span := tracing.Start(ctx, "createResponse")
+	defer func() { tracing.End(span, err) }()
+
+	patches, err := s.tryCreatePatches(ctx, target, images, annotations)
+	if conflict := (errTagConflict{}); errors.As(err, &conflict) {
+		return createErrorResponse(uid, 409, metav1.StatusReasonConflict, conflict.Error()), err
+	}
 	if err != nil {
 		return createErrorResponse(uid, 500, metav1.StatusReasonInternalError, errCreatingPatch), err
 	}
@@ -81,37 +112,266 @@ func (s *server) createResponse(ctx context.Context, containers []v1.Container,
 	}, nil
 }
 
-func (s *server) tryCreatePatches(ctx context.Context, containers []v1.Container) ([]patch, error) {
+// tryCreatePatches clones the images that are not yet in the backup
+// registry, and returns the patches that rewrite them along with the patch
+// that records their original images in the object's annotations. The
+// outcome of each image is recorded as an Event on target.
+func (s *server) tryCreatePatches(ctx context.Context, target eventTarget, images []image, annotations map[string]string) ([]patch, error) {
 	patches := []patch{}
-	for i, c := range containers {
-		if s.isUsingBackupRegistry(c.Image) {
+	originals := map[string]annotation.Original{}
+	for _, img := range images {
+		if s.isUsingBackupRegistry(img.ref) {
+			s.record(target, notify.Event{
+				Type:      notify.CloneSkipped,
+				Container: img.container,
+				Source:    img.ref,
+				Message:   fmt.Sprintf("Image %s of container %s is already in the backup registry", img.ref, img.container),
+			})
 			continue
 		}
 
-		err := s.client.ImagePull(ctx, c.Image)
+		newImage, pulled, err := s.cloneContainer(ctx, target, img)
 		if err != nil {
-			return nil, fmt.Errorf(errDockerOperation, "pull", err)
+			return nil, err
 		}
 
-		newImage := newImage(c.Image, s.registry, s.registryUser)
-		err = s.client.ImageTag(ctx, c.Image, newImage)
+		patches = append(patches, patch{
+			Op:    "replace",
+			Path:  img.path,
+			Value: newImage,
+		})
+		originals[img.container] = annotation.Original{Image: img.ref, Digest: pulled.Digest, Path: img.path}
+	}
+
+	if len(originals) == 0 {
+		return patches, nil
+	}
+
+	p, err := originalImagesPatch(annotations, originals)
+	if err != nil {
+		return nil, err
+	}
+	return append(patches, p), nil
+}
+
+// cloneContainer clones the image of a container of the object of target,
+// and records the outcome. The clone is tracked as a job.
+func (s *server) cloneContainer(ctx context.Context, target eventTarget, img image) (string, docker.Image, error) {
+	return s.runJob(ctx, s.startJob(target, img), target, img)
+}
+
+// startJob adds the job of the clone of img, and returns its ID.
+func (s *server) startJob(target eventTarget, img image) string {
+	return s.jobs.Start(jobs.Job{
+		Source:    img.ref,
+		Kind:      target.kind,
+		Namespace: target.namespace,
+		Name:      target.name,
+		Container: img.container,
+	})
+}
+
+// runJob runs the job jobID cloning img, which has no container when it is
+// cloned on demand, and records the outcome.
+func (s *server) runJob(ctx context.Context, jobID string, target eventTarget, img image) (string, docker.Image, error) {
+	what := "image " + img.ref
+	if img.container != "" {
+		what += " of container " + img.container
+	}
+
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "container", img.container, "source", img.ref, "job", jobID)
+	cloneCtx, span := tracing.Start(klog.NewContext(ctx, logger), "clone",
+		tracing.Container.String(img.container), tracing.Source.String(img.ref))
+	cloneCtx = docker.WithProgress(cloneCtx, func(p docker.Progress) { s.progress.publish(jobID, p) })
+	newImage, pulled, err := s.clone(cloneCtx, img.ref)
+	if err == nil {
+		span.SetAttributes(tracing.Destination.String(newImage))
+	}
+	tracing.End(span, err)
+	s.jobs.Finish(jobID, newImage, pulled.Digest, err)
+	s.progress.done(jobID)
+
+	if err != nil {
+		s.record(target, notify.Event{
+			Type:      notify.CloneFailed,
+			Container: img.container,
+			Source:    img.ref,
+			Message:   fmt.Sprintf("Failed to clone %s: %v", what, err),
+			Error:     err.Error(),
+		})
+		return "", docker.Image{}, err
+	}
+
+	logger.Info("Cloned image", "destination", newImage)
+	s.record(target, notify.Event{
+		Type:        notify.CloneSucceeded,
+		Container:   img.container,
+		Source:      img.ref,
+		Digest:      pulled.Digest,
+		Destination: newImage,
+		Message:     fmt.Sprintf("Cloned %s to %s", what, newImage),
+	})
+	return newImage, pulled, nil
+}
+
+// clone copies src to the backup registry and returns the image to use
+// instead, along with the pulled image.
+func (s *server) clone(ctx context.Context, src string) (string, docker.Image, error) {
+	return s.cloneTo(ctx, src, func(pulled docker.Image) (string, error) {
+		return s.guardTag(ctx, newImage(src, s.registry, s.registryUser), pulled)
+	})
+}
+
+// cloneTo copies src to the backup tag returned by dst for the pulled
+// image. Replicas clone the same image one at a time when the server
+// has a locker.
+func (s *server) cloneTo(ctx context.Context, src string, dst func(pulled docker.Image) (string, error)) (string, docker.Image, error) {
+	if s.locker != nil {
+		locked, unlock, err := s.locker.Lock(ctx, src)
 		if err != nil {
-			return nil, fmt.Errorf(errDockerOperation, "tag", err)
+			return cloneFailed("lock", fmt.Errorf("failed to lock %s: %v", src, err))
 		}
+		defer unlock()
+		ctx = locked
+	}
+
+	release, err := s.ownLocal(ctx, src)
+	if err != nil {
+		return cloneFailed("inspect", err)
+	}
+	defer release()
+
+	err = s.client.ImagePull(ctx, src)
+	if err != nil {
+		return cloneFailed("pull", fmt.Errorf(errDockerOperation, "pull", err))
+	}
+
+	pulled, err := s.client.ImageInspect(ctx, src)
+	if err != nil {
+		return cloneFailed("inspect", fmt.Errorf(errDockerOperation, "inspect", err))
+	}
+
+	backup, err := dst(pulled)
+	if err != nil {
+		return cloneFailed("destination", err)
+	}
+	ctx = klog.NewContext(ctx, klog.LoggerWithValues(klog.FromContext(ctx), "destination", backup))
+
+	release, err = s.ownLocal(ctx, backup)
+	if err != nil {
+		return cloneFailed("inspect", err)
+	}
+	defer release()
 
-		err = s.client.ImagePush(ctx, newImage)
+	err = s.client.ImageTag(ctx, src, backup)
+	if err != nil {
+		return cloneFailed("tag", fmt.Errorf(errDockerOperation, "tag", err))
+	}
+
+	pushed, err := s.client.ImagePush(ctx, backup)
+	if err != nil {
+		return cloneFailed("push", fmt.Errorf(errDockerOperation, "push", err))
+	}
+	if s.pushes != nil {
+		s.recordPush(ctx, backup)
+	}
+
+	if s.pinDigest {
+		backup, err = pinnedImage(backup, pushed)
 		if err != nil {
-			return nil, fmt.Errorf(errDockerOperation, "push", err)
+			return cloneFailed("pin", err)
 		}
+	}
 
-		patches = append(patches, patch{
-			Op:    "replace",
-			Path:  fmt.Sprintf("/spec/template/spec/containers/%d/image", i),
-			Value: newImage,
+	metrics.Clones.Inc()
+	return backup, pulled, nil
+}
+
+// cloneFailed counts the failure of a clone at stage, and returns err.
+func cloneFailed(stage string, err error) (string, docker.Image, error) {
+	metrics.CloneFailures.WithLabelValues(stage).Inc()
+	return "", docker.Image{}, err
+}
+
+// ownLocal returns the function that removes ref from the local daemon
+// once the clone is done, if the server is the one adding ref to it.
+func (s *server) ownLocal(ctx context.Context, ref string) (func(), error) {
+	if s.local == nil {
+		return func() {}, nil
+	}
+
+	owned, err := s.local.acquire(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf(errDockerOperation, "inspect", err)
+	}
+	if !owned {
+		return func() {}, nil
+	}
+	// The clone may have been canceled, but the reference is removed anyway.
+	return func() { s.local.release(context.Background(), ref) }, nil
+}
+
+// originalImagesPatch returns the patch that records originals in the
+// OriginalImages annotation, keeping the entries already recorded for other
+// containers.
+func originalImagesPatch(annotations map[string]string, originals map[string]annotation.Original) (patch, error) {
+	recorded, err := annotation.Decode(annotations)
+	if err != nil {
+		klog.InfoS("Overwriting the original images annotation", "err", err)
+	}
+	for name, o := range originals {
+		recorded[name] = o
+	}
+
+	value, err := annotation.Encode(recorded)
+	if err != nil {
+		return patch{}, err
+	}
+
+	if annotations == nil {
+		return patch{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{annotation.OriginalImages: value},
+		}, nil
+	}
+	return patch{
+		Op:    "add",
+		Path:  "/metadata/annotations/" + pointer.Escape(annotation.OriginalImages),
+		Value: value,
+	}, nil
+}
+
+// containerImages returns the images of containers, where path is the JSON
+// pointer to the containers array in the admitted object.
+func containerImages(path string, containers []v1.Container) []image {
+	images := make([]image, 0, len(containers))
+	for i, c := range containers {
+		images = append(images, image{
+			container: c.Name,
+			ref:       c.Image,
+			path:      fmt.Sprintf("%s/%d/image", path, i),
 		})
 	}
+	return images
+}
+
+// changedImages returns the images that are either new or differ from the
+// image used by the container of the same name in old.
+func changedImages(images, old []image) []image {
+	prev := make(map[string]string, len(old))
+	for _, img := range old {
+		prev[img.container] = img.ref
+	}
 
-	return patches, nil
+	changed := []image{}
+	for _, img := range images {
+		if ref, ok := prev[img.container]; ok && ref == img.ref {
+			continue
+		}
+		changed = append(changed, img)
+	}
+	return changed
 }
 
 func (s *server) isUsingBackupRegistry(src string) bool {
@@ -129,6 +389,30 @@ func newImage(src, registry, user string) string {
 	return strings.Join([]string{registry, user, img[len(img)-1]}, "/")
 }
 
+// pinnedImage returns the reference to dst by digest, so that the image
+// used by the workload is not affected if the tag is pushed again.
+func pinnedImage(dst, digest string) (string, error) {
+	if digest == "" {
+		return "", fmt.Errorf("push of %s did not report a digest", dst)
+	}
+
+	named, err := reference.ParseNormalizedNamed(dst)
+	if err != nil {
+		return "", err
+	}
+
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		return "", err
+	}
+
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), d)
+	if err != nil {
+		return "", err
+	}
+	return reference.FamiliarString(pinned), nil
+}
+
 func createErrorResponse(uid types.UID, code int32, reason metav1.StatusReason, msg string) reviewResponse {
 	return reviewResponse{
 		uid:     uid,
@@ -22,22 +22,30 @@ import (
 	"strings"
 
 	"testing"
-	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
 	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
 	"github.com/stretchr/testify/assert"
 )
 
-var uid types.UID = "4584308f-b307-455b-ab11-5765b4548b71"
+var (
+	uid         types.UID = "4584308f-b307-455b-ab11-5765b4548b71"
+	pulledImage           = docker.Image{ID: imageID, Digest: digest, Platform: platform}
+)
 
 const (
-	alpine       = "alpine:3.12"
-	registryUser = "gauravgahlot"
-	registry     = "quay.io"
+	alpine         = "alpine:3.12"
+	platform       = "linux/arm64"
+	digest         = "sha256:87703314048c40236c6d674424159ee862e2b96ce1c37c62d877e21ed27a387e"
+	pushDigest     = "sha256:a9c28c813336ece5bb98b36af5b66209ed777a394f4f856c6e62267790883820"
+	imageID        = "sha256:d4ff818577bc193b309b355b02ebc9220427090057b54a59e73b79bdfe139b83"
+	registryUser   = "gauravgahlot"
+	backupRegistry = "quay.io"
 )
 
 type args struct {
@@ -59,10 +67,10 @@ func TestCreateResponse(t *testing.T) {
 		"image-with-backup-registry": {
 			args: args{
 				dc:   mockDockerClient{},
-				mods: []serverModifier{withRegistryUser(registryUser), withRegistry(registry)},
+				mods: []serverModifier{withRegistryUser(registryUser), withRegistry(backupRegistry)},
 				containers: []v1.Container{
 					{
-						Image: strings.Join([]string{registry, registryUser, alpine}, "/"),
+						Image: strings.Join([]string{backupRegistry, registryUser, alpine}, "/"),
 					},
 				},
 			},
@@ -88,7 +96,23 @@ func TestCreateResponse(t *testing.T) {
 					},
 				},
 				mods:       []serverModifier{withRegistryUser(registryUser)},
-				containers: []v1.Container{{Image: alpine}},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
+			},
+			want: want{
+				err: true,
+				res: errorResponse(errCreatingPatch),
+			},
+		},
+		"error-image-digest": {
+			args: args{
+				dc: mockDockerClient{
+					ImagePullFunc: func(ctx context.Context, image string) error { return nil },
+					ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) {
+						return docker.Image{}, errors.New("error image inspect")
+					},
+				},
+				mods:       []serverModifier{withRegistryUser(registryUser)},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
 			},
 			want: want{
 				err: true,
@@ -102,9 +126,10 @@ func TestCreateResponse(t *testing.T) {
 					ImageTagFunc: func(ctx context.Context, src, dst string) error {
 						return errors.New("error image tag")
 					},
+					ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
 				},
 				mods:       []serverModifier{withRegistryUser(registryUser)},
-				containers: []v1.Container{{Image: alpine}},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
 			},
 			want: want{
 				err: true,
@@ -116,12 +141,13 @@ func TestCreateResponse(t *testing.T) {
 				dc: mockDockerClient{
 					ImagePullFunc: func(ctx context.Context, image string) error { return nil },
 					ImageTagFunc:  func(ctx context.Context, src, dst string) error { return nil },
-					ImagePushFunc: func(ctx context.Context, image string) error {
-						return errors.New("error image push")
+					ImagePushFunc: func(ctx context.Context, image string) (string, error) {
+						return "", errors.New("error image push")
 					},
+					ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
 				},
 				mods:       []serverModifier{withRegistryUser(registryUser)},
-				containers: []v1.Container{{Image: alpine}},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
 			},
 			want: want{
 				err: true,
@@ -131,36 +157,67 @@ func TestCreateResponse(t *testing.T) {
 		"success-image-pull-tag-push-with-user": {
 			args: args{
 				dc: mockDockerClient{
-					ImagePullFunc: func(ctx context.Context, image string) error { return nil },
-					ImageTagFunc:  func(ctx context.Context, src, dst string) error { return nil },
-					ImagePushFunc: func(ctx context.Context, image string) error { return nil },
+					ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+					ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+					ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+					ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
 				},
 				mods:       []serverModifier{withRegistryUser(registryUser)},
-				containers: []v1.Container{{Image: alpine}},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
 			},
-			want: want{res: reviewResponse{uid: uid, allowed: true, patch: getPatch(alpine, "", registryUser)}},
+			want: want{res: reviewResponse{uid: uid, allowed: true, patch: getPatch("alpine", alpine, "", registryUser)}},
 		},
 		"success-image-pull-tag-push-with-registry": {
 			args: args{
 				dc: mockDockerClient{
-					ImagePullFunc: func(ctx context.Context, image string) error { return nil },
-					ImageTagFunc:  func(ctx context.Context, src, dst string) error { return nil },
-					ImagePushFunc: func(ctx context.Context, image string) error { return nil },
+					ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+					ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+					ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+					ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+				},
+				mods:       []serverModifier{withRegistryUser(registryUser), withRegistry(backupRegistry)},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
+			},
+			want: want{res: reviewResponse{uid: uid, allowed: true, patch: getPatch("alpine", alpine, backupRegistry, registryUser)}},
+		},
+		"success-image-pull-tag-push-pin-digest": {
+			args: args{
+				dc: mockDockerClient{
+					ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+					ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+					ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+					ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
 				},
-				mods:       []serverModifier{withRegistryUser(registryUser), withRegistry(registry)},
-				containers: []v1.Container{{Image: alpine}},
+				mods:       []serverModifier{withRegistryUser(registryUser), withRegistry(backupRegistry), withPinDigest()},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
+			},
+			want: want{res: reviewResponse{uid: uid, allowed: true, patch: getPatchWithImage("alpine", alpine, "quay.io/gauravgahlot/alpine@"+pushDigest)}},
+		},
+		"error-pin-digest-not-reported": {
+			args: args{
+				dc: mockDockerClient{
+					ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+					ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+					ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return "", nil },
+					ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+				},
+				mods:       []serverModifier{withRegistryUser(registryUser), withPinDigest()},
+				containers: []v1.Container{{Name: "alpine", Image: alpine}},
+			},
+			want: want{
+				err: true,
+				res: errorResponse(errCreatingPatch),
 			},
-			want: want{res: reviewResponse{uid: uid, allowed: true, patch: getPatch(alpine, registry, registryUser)}},
 		},
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), maxWebhookTimeout*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), maxWebhookTimeout)
 	defer cancel()
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
 			s := testServer(t, tc.args.dc, tc.args.mods...)
-			res, err := s.createResponse(ctx, tc.args.containers, uid)
+			res, err := s.createResponse(ctx, eventTarget{}, containerImages(containersPath, tc.args.containers), nil, uid)
 			if err != nil {
 				assert.True(t, tc.want.err)
 				assert.Error(t, err)
@@ -171,9 +228,192 @@ func TestCreateResponse(t *testing.T) {
 	}
 }
 
-func testServer(t *testing.T, d docker.Client, modifiers ...serverModifier) *server {
+func TestCloneLocksImage(t *testing.T) {
+	ops := []string{}
+	d := dockerClient()
+	d.ImagePullFunc = func(ctx context.Context, image string) error {
+		ops = append(ops, "pull "+image)
+		return nil
+	}
+	d.ImagePushFunc = func(ctx context.Context, image string) (string, error) {
+		ops = append(ops, "push "+image)
+		return pushDigest, nil
+	}
+	l := mockLocker{LockFunc: func(ctx context.Context, image string) (context.Context, func(), error) {
+		ops = append(ops, "lock "+image)
+		return ctx, func() { ops = append(ops, "unlock "+image) }, nil
+	}}
+	s := testServer(t, d, withRegistryUser(registryUser), withLocker(l))
+
+	_, _, err := s.clone(context.Background(), alpine)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"lock " + alpine,
+		"pull " + alpine,
+		"push gauravgahlot/alpine:3.12",
+		"unlock " + alpine,
+	}, ops)
+
+	l.LockFunc = func(ctx context.Context, image string) (context.Context, func(), error) {
+		return nil, nil, context.DeadlineExceeded
+	}
+	s = testServer(t, d, withRegistryUser(registryUser), withLocker(l))
+	_, _, err = s.clone(context.Background(), alpine)
+	assert.Error(t, err)
+}
+
+func TestCloneLockLost(t *testing.T) {
+	lockCtx, lose := context.WithCancel(context.Background())
+	unlocked := false
+	l := mockLocker{LockFunc: func(ctx context.Context, image string) (context.Context, func(), error) {
+		return lockCtx, func() { unlocked = true }, nil
+	}}
+
+	// The push blocks until the lock is lost, as the Docker client does
+	// with the context of the clone.
+	d := dockerClient()
+	d.ImagePushFunc = func(ctx context.Context, image string) (string, error) {
+		lose()
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	s := testServer(t, d, withRegistryUser(registryUser), withLocker(l))
+
+	_, _, err := s.clone(context.Background(), alpine)
+	assert.EqualError(t, err, "failed to push docker image: context canceled")
+	assert.True(t, unlocked)
+}
+
+func TestPinnedImage(t *testing.T) {
+	cases := map[string]struct {
+		dst  string
+		want string
+	}{
+		"docker-hub":    {dst: "gauravgahlot/alpine:3.12", want: "gauravgahlot/alpine@" + pushDigest},
+		"registry":      {dst: "quay.io/gauravgahlot/alpine:3.12", want: "quay.io/gauravgahlot/alpine@" + pushDigest},
+		"registry-port": {dst: "localhost:5000/gauravgahlot/alpine", want: "localhost:5000/gauravgahlot/alpine@" + pushDigest},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := pinnedImage(tc.dst, pushDigest)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestOriginalImagesPatch(t *testing.T) {
+	originals := map[string]annotation.Original{"app": {Image: alpine, Digest: digest}}
+
+	cases := map[string]struct {
+		annotations map[string]string
+		want        patch
+	}{
+		"no-annotations": {
+			annotations: nil,
+			want: patch{
+				Op:    "add",
+				Path:  "/metadata/annotations",
+				Value: map[string]string{annotation.OriginalImages: `{"app":{"image":"alpine:3.12","digest":"` + digest + `"}}`},
+			},
+		},
+		"other-annotations": {
+			annotations: map[string]string{"team": "platform"},
+			want: patch{
+				Op:    "add",
+				Path:  "/metadata/annotations/image-cloner.io~1original-images",
+				Value: `{"app":{"image":"alpine:3.12","digest":"` + digest + `"}}`,
+			},
+		},
+		"merge-recorded": {
+			annotations: map[string]string{annotation.OriginalImages: `{"app":{"image":"alpine:3.11"},"sidecar":{"image":"busybox:1.33"}}`},
+			want: patch{
+				Op:    "add",
+				Path:  "/metadata/annotations/image-cloner.io~1original-images",
+				Value: `{"app":{"image":"alpine:3.12","digest":"` + digest + `"},"sidecar":{"image":"busybox:1.33"}}`,
+			},
+		},
+		"overwrite-invalid": {
+			annotations: map[string]string{annotation.OriginalImages: "alpine"},
+			want: patch{
+				Op:    "add",
+				Path:  "/metadata/annotations/image-cloner.io~1original-images",
+				Value: `{"app":{"image":"alpine:3.12","digest":"` + digest + `"}}`,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := originalImagesPatch(tc.annotations, originals)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestChangedImages(t *testing.T) {
+	old := containerImages(containersPath, []v1.Container{
+		{Name: "app", Image: alpine},
+		{Name: "sidecar", Image: "busybox:1.33"},
+	})
+
+	cases := map[string]struct {
+		containers []v1.Container
+		want       []string
+	}{
+		"unchanged": {
+			containers: []v1.Container{
+				{Name: "app", Image: alpine},
+				{Name: "sidecar", Image: "busybox:1.33"},
+			},
+			want: []string{},
+		},
+		"reordered": {
+			containers: []v1.Container{
+				{Name: "sidecar", Image: "busybox:1.33"},
+				{Name: "app", Image: alpine},
+			},
+			want: []string{},
+		},
+		"changed": {
+			containers: []v1.Container{
+				{Name: "app", Image: "alpine:3.14"},
+				{Name: "sidecar", Image: "busybox:1.33"},
+			},
+			want: []string{"alpine:3.14"},
+		},
+		"added": {
+			containers: []v1.Container{
+				{Name: "app", Image: alpine},
+				{Name: "sidecar", Image: "busybox:1.33"},
+				{Name: "proxy", Image: "nginx:1.21"},
+			},
+			want: []string{"nginx:1.21"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := []string{}
+			for _, img := range changedImages(containerImages(containersPath, tc.containers), old) {
+				got = append(got, img.ref)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func testServer(t testing.TB, d docker.Client, modifiers ...serverModifier) *server {
 	s := &server{
 		client: d,
+		registryClient: mockRegistryClient{
+			ConfigDigestFunc: func(ctx context.Context, ref, platform string) (string, error) {
+				return "", registry.ErrNotFound
+			},
+		},
+		tagConflict: TagConflictOverwrite,
 	}
 
 	for _, fn := range modifiers {
@@ -194,12 +434,25 @@ func errorResponse(msg string) reviewResponse {
 	}
 }
 
-func getPatch(src, reg, user string) []byte {
+func getPatch(container, src, reg, user string) []byte {
+	return getPatchWithImage(container, src, newImage(src, reg, user))
+}
+
+func getPatchWithImage(container, src, dst string) []byte {
+	path := fmt.Sprintf("/spec/template/spec/containers/%d/image", 0)
+	originals, _ := annotation.Encode(map[string]annotation.Original{
+		container: {Image: src, Digest: digest, Path: path},
+	})
 	list := []patch{
 		{
 			Op:    "replace",
-			Path:  fmt.Sprintf("/spec/template/spec/containers/%d/image", 0),
-			Value: newImage(src, reg, user),
+			Path:  path,
+			Value: dst,
+		},
+		{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{annotation.OriginalImages: originals},
 		},
 	}
 	patch, _ := json.Marshal(list)
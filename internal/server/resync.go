@@ -0,0 +1,301 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/pointer"
+	"github.com/gauravgahlot/image-cloner/internal/upstream"
+)
+
+// ResyncPolicy decides what happens to a workload when the tag of the
+// original image of its backup moves upstream.
+type ResyncPolicy string
+
+const (
+	// ResyncOff leaves the backup as it was first cloned.
+	ResyncOff ResyncPolicy = "off"
+
+	// ResyncBackup copies the new image under a tag suffixed with its
+	// digest, without changing the workload.
+	ResyncBackup ResyncPolicy = "backup"
+
+	// ResyncRollout also rewrites the workload to the new backup, which
+	// rolls it out.
+	ResyncRollout ResyncPolicy = "rollout"
+)
+
+// ParseResyncPolicy returns the policy named s.
+func ParseResyncPolicy(s string) (ResyncPolicy, error) {
+	switch p := ResyncPolicy(s); p {
+	case ResyncOff, ResyncBackup, ResyncRollout:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown resync policy %q", s)
+}
+
+// resyncer remembers the digest each source was last copied at, so that a
+// source that moved is copied once even if its workloads are not rolled.
+type resyncer struct {
+	tags   []string
+	policy ResyncPolicy
+
+	mu     sync.Mutex
+	copied map[string]string
+}
+
+// resyncResult describes the resync of a source that moved.
+type resyncResult struct {
+	image  string
+	digest string
+	backup string
+	rolled []string
+	err    error
+}
+
+// resync copies the sources whose tag moved since they were cloned, and
+// rolls out the workloads of the namespaces whose policy is rollout.
+func (s *server) resync(ctx context.Context) ([]resyncResult, error) {
+	workloads, err := kube.ListWorkloads(ctx, s.kube, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	policies := map[string]ResyncPolicy{}
+	results := []resyncResult{}
+	for _, src := range upstream.Sources(workloads) {
+		if !s.resyncer.mutable(src.Image) {
+			continue
+		}
+
+		uses := []upstream.Use{}
+		for _, u := range src.Uses {
+			if s.namespacePolicy(ctx, policies, u.Namespace) != ResyncOff {
+				uses = append(uses, u)
+			}
+		}
+		if len(uses) == 0 {
+			continue
+		}
+
+		current, err := s.registryClient.Head(ctx, src.Image)
+		if err != nil {
+			klog.FromContext(ctx).Info("Failed to resolve source", "source", src.Image, "err", err)
+			continue
+		}
+		if current == src.Digest {
+			continue
+		}
+
+		res := s.resyncSource(ctx, src.Image, current, uses, policies)
+		if res.err != nil {
+			klog.FromContext(ctx).Error(res.err, "Failed to resync source", "source", src.Image)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func (s *server) resyncSource(ctx context.Context, src, current string, uses []upstream.Use, policies map[string]ResyncPolicy) resyncResult {
+	res := resyncResult{image: src, digest: current, rolled: []string{}}
+
+	s.resyncer.mu.Lock()
+	backup, copied := s.resyncer.copied[src+"@"+current]
+	s.resyncer.mu.Unlock()
+
+	if !copied {
+		var pulled string
+		b, img, err := s.cloneTo(ctx, src, func(pulled docker.Image) (string, error) {
+			return digestSuffixedTag(newImage(src, s.registry, s.registryUser), pulled.ID)
+		})
+		if err != nil {
+			res.err = err
+			return res
+		}
+		backup, pulled = b, img.Digest
+
+		s.resyncer.mu.Lock()
+		s.resyncer.copied[src+"@"+current] = backup
+		s.resyncer.mu.Unlock()
+		klog.FromContext(ctx).Info("Source moved, copied it", "source", src, "digest", pulled, "destination", backup)
+	}
+	res.backup = backup
+
+	// The containers of a workload using the source are rolled out by a
+	// single patch, since each patch records the original images of all its
+	// containers.
+	rollouts := []*workloadRollout{}
+	byWorkload := map[string]*workloadRollout{}
+	for _, u := range uses {
+		if policies[u.Namespace] != ResyncRollout {
+			continue
+		}
+		key := fmt.Sprintf("%s %s/%s", u.Kind, u.Namespace, u.Name)
+		r, ok := byWorkload[key]
+		if !ok {
+			r = &workloadRollout{name: key, workload: u.Workload()}
+			byWorkload[key] = r
+			rollouts = append(rollouts, r)
+		}
+		r.containers = append(r.containers, u.Container)
+	}
+
+	for _, r := range rollouts {
+		if err := s.rollout(ctx, r, src, current, backup); err != nil {
+			res.err = err
+			continue
+		}
+		res.rolled = append(res.rolled, r.name)
+	}
+	return res
+}
+
+// workloadRollout is the rollout of the containers of a workload using a source.
+type workloadRollout struct {
+	name       string
+	workload   kube.Workload
+	containers []string
+}
+
+// rollout rewrites the containers of r to backup, and records the digest of
+// src they were copied at. The patch fails if a container or the original
+// images changed since the workload was listed.
+func (s *server) rollout(ctx context.Context, r *workloadRollout, src, digest, backup string) error {
+	w := r.workload
+	patches := []patch{}
+	originals := map[string]annotation.Original{}
+	for _, c := range r.containers {
+		i := containerIndex(w.Containers, c)
+		if i < 0 {
+			return fmt.Errorf("container %s not found in %s", c, r.name)
+		}
+
+		imgPath := fmt.Sprintf("%s/%d/image", containersPath, i)
+		patches = append(patches,
+			patch{Op: "test", Path: imgPath, Value: w.Containers[i].Image},
+			patch{Op: "replace", Path: imgPath, Value: backup},
+		)
+		originals[c] = annotation.Original{Image: src, Digest: digest, Path: imgPath}
+	}
+
+	if v, ok := w.Annotations[annotation.OriginalImages]; ok {
+		patches = append(patches, patch{
+			Op:    "test",
+			Path:  "/metadata/annotations/" + pointer.Escape(annotation.OriginalImages),
+			Value: v,
+		})
+	}
+	p, err := originalImagesPatch(w.Annotations, originals)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(append(patches, p))
+	if err != nil {
+		return err
+	}
+	return kube.PatchWorkload(ctx, s.kube, w, types.JSONPatchType, data, metav1.PatchOptions{})
+}
+
+// containerIndex returns the index of the container called container, or
+// -1.
+func containerIndex(containers []corev1.Container, container string) int {
+	for i, c := range containers {
+		if c.Name == container {
+			return i
+		}
+	}
+	return -1
+}
+
+// mutable reports whether image is referenced by a tag matching the resync
+// patterns; any tag if there are none.
+func (r *resyncer) mutable(image string) bool {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return false
+	}
+	tag, ok := ref.(name.Tag)
+	if !ok {
+		return false
+	}
+
+	if len(r.tags) == 0 {
+		return true
+	}
+	for _, p := range r.tags {
+		if ok, _ := path.Match(p, tag.TagStr()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacePolicy returns the resync policy of namespace, caching it in
+// policies.
+func (s *server) namespacePolicy(ctx context.Context, policies map[string]ResyncPolicy, namespace string) ResyncPolicy {
+	if p, ok := policies[namespace]; ok {
+		return p
+	}
+
+	policy := s.resyncer.policy
+	ns, err := s.kube.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		klog.FromContext(ctx).Info("Using the default resync policy", "namespace", namespace, "err", err)
+	} else if v, ok := ns.Annotations[annotation.ResyncPolicy]; ok {
+		if p, err := ParseResyncPolicy(v); err == nil {
+			policy = p
+		} else {
+			klog.FromContext(ctx).Info("Using the default resync policy", "namespace", namespace, "err", err)
+		}
+	}
+
+	policies[namespace] = policy
+	return policy
+}
+
+// periodicResync returns a task resyncing the sources every interval.
+func (s *server) periodicResync(interval time.Duration) func(context.Context) {
+	return func(ctx context.Context) {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			results, err := s.resync(ctx)
+			if err != nil {
+				klog.ErrorS(err, "Resync failed")
+				return
+			}
+			for _, r := range results {
+				if r.err == nil {
+					klog.InfoS("Resynced source", "source", r.image, "digest", r.digest, "destination", r.backup, "rolledOut", r.rolled)
+				}
+			}
+		}, interval)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+)
+
+func resyncObjects() []runtime.Object {
+	objects := []runtime.Object{
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "frozen", Annotations: map[string]string{annotation.ResyncPolicy: "off"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "rolling", Annotations: map[string]string{annotation.ResyncPolicy: "rollout"}}},
+	}
+	for _, ns := range []string{"default", "frozen", "rolling"} {
+		d := testDeployment(ns, "alpine", "gauravgahlot/alpine:latest")
+		d.Annotations = map[string]string{annotation.OriginalImages: `{"alpine":{"image":"alpine:latest","digest":"` + pushDigest + `"}}`}
+		objects = append(objects, d)
+	}
+
+	pinned := testDeployment("default", "pinned", "gauravgahlot/alpine:3.12")
+	pinned.Annotations = map[string]string{annotation.OriginalImages: `{"alpine":{"image":"alpine@` + pushDigest + `"}}`}
+	return append(objects, pinned)
+}
+
+func TestResync(t *testing.T) {
+	cs := fake.NewSimpleClientset(resyncObjects()...)
+	pulls := 0
+	d := dockerClient()
+	d.ImagePullFunc = func(ctx context.Context, image string) error {
+		pulls++
+		return nil
+	}
+	heads := []string{}
+	r := mockRegistryClient{HeadFunc: func(ctx context.Context, ref string) (string, error) {
+		heads = append(heads, ref)
+		return digest, nil
+	}}
+	s := testServer(t, d, withRegistryUser(registryUser), withRegistryClient(r))
+	s.kube = cs
+	s.resyncer = &resyncer{policy: ResyncBackup, copied: map[string]string{}}
+
+	results, err := s.resync(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []resyncResult{{
+		image:  "alpine:latest",
+		digest: digest,
+		backup: "gauravgahlot/alpine:latest-d4ff818577bc",
+		rolled: []string{"Deployment rolling/alpine"},
+	}}, results)
+	assert.Equal(t, []string{"alpine:latest"}, heads)
+	assert.Equal(t, 1, pulls)
+
+	rolled, err := cs.AppsV1().Deployments("rolling").Get(context.Background(), "alpine", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "gauravgahlot/alpine:latest-d4ff818577bc", rolled.Spec.Template.Spec.Containers[0].Image)
+	originals, err := annotation.Decode(rolled.Annotations)
+	assert.NoError(t, err)
+	assert.Equal(t, annotation.Original{
+		Image: "alpine:latest", Digest: digest, Path: "/spec/template/spec/containers/0/image",
+	}, originals["alpine"])
+
+	for _, ns := range []string{"default", "frozen"} {
+		d, err := cs.AppsV1().Deployments(ns).Get(context.Background(), "alpine", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "gauravgahlot/alpine:latest", d.Spec.Template.Spec.Containers[0].Image)
+	}
+
+	// The source is not copied again while it does not move.
+	results, err = s.resync(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Empty(t, results[0].rolled)
+	assert.Equal(t, 1, pulls)
+}
+
+func TestResyncMutable(t *testing.T) {
+	r := &resyncer{tags: []string{"latest", "3"}}
+
+	assert.True(t, r.mutable("alpine:latest"))
+	assert.True(t, r.mutable("alpine"))
+	assert.True(t, r.mutable("quay.io/gauravgahlot/alpine:3"))
+	assert.False(t, r.mutable("alpine:3.12"))
+	assert.False(t, r.mutable("alpine@"+digest))
+
+	r.tags = nil
+	assert.True(t, r.mutable("alpine:3.12"))
+}
+
+func TestResyncRolloutContainers(t *testing.T) {
+	d := testDeployment("rolling", "alpine", "gauravgahlot/alpine:latest", "gauravgahlot/alpine:latest")
+	d.Annotations = map[string]string{annotation.OriginalImages: `{"alpine":{"image":"alpine:latest","digest":"` + pushDigest +
+		`"},"sidecar":{"image":"alpine:latest","digest":"` + pushDigest + `"}}`}
+	cs := fake.NewSimpleClientset(resyncObjects()[2], d)
+	r := mockRegistryClient{HeadFunc: func(ctx context.Context, ref string) (string, error) { return digest, nil }}
+	s := testServer(t, dockerClient(), withRegistryUser(registryUser), withRegistryClient(r))
+	s.kube = cs
+	s.resyncer = &resyncer{policy: ResyncBackup, copied: map[string]string{}}
+
+	results, err := s.resync(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.NoError(t, results[0].err)
+	assert.Equal(t, []string{"Deployment rolling/alpine"}, results[0].rolled)
+
+	rolled, err := cs.AppsV1().Deployments("rolling").Get(context.Background(), "alpine", metav1.GetOptions{})
+	assert.NoError(t, err)
+	originals, err := annotation.Decode(rolled.Annotations)
+	assert.NoError(t, err)
+	for i, c := range rolled.Spec.Template.Spec.Containers {
+		assert.Equal(t, "gauravgahlot/alpine:latest-d4ff818577bc", rolled.Spec.Template.Spec.Containers[i].Image)
+		assert.Equal(t, annotation.Original{
+			Image: "alpine:latest", Digest: digest, Path: fmt.Sprintf("/spec/template/spec/containers/%d/image", i),
+		}, originals[c.Name])
+	}
+}
+
+func TestResyncRolloutStale(t *testing.T) {
+	d := testDeployment("rolling", "alpine", "gauravgahlot/alpine:latest")
+	d.Annotations = map[string]string{annotation.OriginalImages: `{"alpine":{"image":"alpine:latest","digest":"` + pushDigest + `"}}`}
+	cs := fake.NewSimpleClientset(d)
+	s := testServer(t, dockerClient())
+	s.kube = cs
+
+	// The original images were recorded again since the workload was
+	// listed, so the patch must not overwrite them.
+	stale := kube.DeploymentWorkload(d.DeepCopy())
+	d.Annotations[annotation.OriginalImages] = `{"alpine":{"image":"alpine:latest","digest":"` + digest + `"}}`
+	_, err := cs.AppsV1().Deployments("rolling").Update(context.Background(), d, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	r := &workloadRollout{name: "Deployment rolling/alpine", workload: stale, containers: []string{"alpine"}}
+	err = s.rollout(context.Background(), r, "alpine:latest", digest, "gauravgahlot/alpine:latest-d4ff818577bc")
+	assert.Error(t, err)
+
+	got, err := cs.AppsV1().Deployments("rolling").Get(context.Background(), "alpine", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "gauravgahlot/alpine:latest", got.Spec.Template.Spec.Containers[0].Image)
+}
@@ -15,48 +15,344 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"time"
 
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/audit"
 	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/jobs"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+	"github.com/gauravgahlot/image-cloner/internal/upstream"
+	"github.com/gauravgahlot/image-cloner/internal/verify"
 )
 
+// shutdownTimeout bounds how long the servers wait for the requests in
+// flight, such as admissions cloning images, once asked to stop. Along with
+// the last batch of notifications, it fits in the default grace period of a
+// terminated pod.
+const shutdownTimeout = 20 * time.Second
+
 // Server defines the basic operations for image-cloner server.
 type Server interface {
-	Serve() error
+	// Serve serves admissions until ctx is done, and then shuts down.
+	Serve(ctx context.Context) error
 }
 
 type server struct {
-	httpServer http.Server
+	httpServer    http.Server
+	apiServer     *http.Server
+	metricsServer *http.Server
+
+	client         docker.Client
+	registryClient registry.Client
+	registryUser   string
+	registry       string
+	workloads      workloads
+	pinDigest      bool
+	tagConflict    TagConflictPolicy
+
+	// kube, leaseNamespace, locker and pushes are set when replicas
+	// coordinate through Leases; background tasks only run on the elected
+	// leader.
+	kube           kubernetes.Interface
+	dynamic        dynamic.Interface
+	leaseNamespace string
+	locker         imageLocker
+	pushes         *kube.PushLog
+	recorder       record.EventRecorder
+	notifiers      notify.Notifiers
+	audit          *audit.Log
+	jobs           *jobs.Store
+	progress       *progressHub
+	background     []func(ctx context.Context)
+	leading        int32
+	upstream       *upstream.Checker
+	resyncer       *resyncer
+	verifier       *verify.Verifier
+
+	// local tracks the images pulled only for cloning; nil if they are
+	// kept in the local daemon.
+	local   *localImages
+	sweeper func(ctx context.Context)
+}
 
-	client       docker.Client
-	registryUser string
-	registry     string
+// imageLocker serializes the cloning of an image across replicas. The
+// context returned by Lock is canceled if the lock is lost while held.
+type imageLocker interface {
+	Lock(ctx context.Context, image string) (context.Context, func(), error)
 }
 
 // Setup initializes and returns a server; error otherwise.
 func Setup(cfg Config) (Server, error) {
-	client, err := docker.CreateClient()
+	s, err := newServer(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	s := server{
-		client:       client,
-		registryUser: docker.RegistryUser(),
-		registry:     os.Getenv("REGISTRY"),
-		httpServer: http.Server{
-			Addr:      cfg.Addr,
-			TLSConfig: configTLS(cfg),
-		},
+	s.httpServer = http.Server{
+		Addr:      cfg.Addr,
+		TLSConfig: configTLS(cfg),
+	}
+
+	if cfg.LeaseNamespace != "" {
+		cs, err := kube.NewClient(cfg.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.useLeases(cs, cfg.LeaseNamespace); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Audit.Path != "" {
+		if s.audit, err = audit.Open(cfg.Audit); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RecordEvents && s.recorder == nil {
+		cs, err := kube.NewClient(cfg.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		s.recorder = kube.NewRecorder(cs)
+	}
+
+	if cfg.BackfillInterval > 0 {
+		if s.kube == nil {
+			return nil, fmt.Errorf("backfill interval requires a lease namespace")
+		}
+		if len(s.workloads) > 0 {
+			if s.dynamic, err = kube.NewDynamicClient(cfg.Kubeconfig); err != nil {
+				return nil, err
+			}
+		}
+		s.background = append(s.background, s.periodicBackfill(cfg.BackfillInterval))
+	}
+
+	if cfg.GCInterval > 0 {
+		if s.kube == nil {
+			return nil, fmt.Errorf("gc interval requires a lease namespace")
+		}
+		if len(s.workloads) > 0 && s.dynamic == nil {
+			if s.dynamic, err = kube.NewDynamicClient(cfg.Kubeconfig); err != nil {
+				return nil, err
+			}
+		}
+		s.background = append(s.background, s.periodicGC(cfg.GCInterval, cfg.GC))
+	}
+
+	if cfg.UpstreamInterval > 0 {
+		if s.kube == nil {
+			return nil, fmt.Errorf("upstream check interval requires a lease namespace")
+		}
+		s.background = append(s.background, s.periodicUpstreamCheck(cfg.UpstreamInterval))
+	}
+
+	// The resyncer also serves the resyncs requested through the API, even
+	// if the leader does not resync periodically.
+	if s.kube != nil {
+		policy, err := ParseResyncPolicy(cfg.ResyncPolicy)
+		if err != nil {
+			return nil, err
+		}
+		s.resyncer = &resyncer{tags: cfg.ResyncTags, policy: policy, copied: map[string]string{}}
+	}
+
+	if cfg.ResyncInterval > 0 {
+		if s.kube == nil {
+			return nil, fmt.Errorf("resync interval requires a lease namespace")
+		}
+		s.background = append(s.background, s.periodicResync(cfg.ResyncInterval))
+	}
+
+	if cfg.VerifyInterval > 0 {
+		if s.kube == nil {
+			return nil, fmt.Errorf("verify interval requires a lease namespace")
+		}
+		s.background = append(s.background, s.periodicVerify(cfg.VerifyInterval))
+	}
+
+	s.metricsServer = metricsServer(cfg.MetricsAddr)
+
+	if cfg.APIAddr != "" {
+		if cfg.APITokenFile == "" {
+			return nil, fmt.Errorf("api port requires a token file")
+		}
+		tokens, err := loadTokens(cfg.APITokenFile)
+		if err != nil {
+			return nil, err
+		}
+		s.apiServer = s.newAPIServer(cfg.APIAddr, configTLS(cfg), tokens)
 	}
 
 	http.HandleFunc("/readyz", s.readyz)
 	http.HandleFunc("/clone-image", s.cloneImage)
 
-	return &s, nil
+	return s, nil
+}
+
+// newServer returns a server with the clients and settings used to clone
+// images, without its HTTP server.
+func newServer(cfg Config) (*server, error) {
+	client, err := docker.CreateClient()
+	if err != nil {
+		return nil, err
+	}
+	client = docker.Traced(client)
+
+	registryClient, err := registry.CreateClient(os.Getenv("REGISTRY"), docker.RegistryUser(), docker.RegistryPassword())
+	if err != nil {
+		return nil, err
+	}
+	registryClient = registry.Traced(registryClient)
+
+	workloads, err := loadWorkloads(cfg.WorkloadsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tagConflict, err := ParseTagConflictPolicy(cfg.TagConflict)
+	if err != nil {
+		return nil, err
+	}
+
+	notifiers, err := notify.Load(cfg.NotifiersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		client:         client,
+		registryClient: registryClient,
+		registryUser:   docker.RegistryUser(),
+		registry:       os.Getenv("REGISTRY"),
+		workloads:      workloads,
+		pinDigest:      cfg.PinDigest,
+		tagConflict:    tagConflict,
+		notifiers:      notifiers,
+		jobs:           jobs.NewStore(jobs.DefaultMaxJobs),
+		progress:       newProgressHub(),
+		upstream:       upstream.NewChecker(registryClient, upstreamQPS),
+		verifier:       verify.NewVerifier(registryClient),
+	}
+
+	if !cfg.KeepLocalImages {
+		s.local = newLocalImages(client)
+		if cfg.SweepInterval > 0 {
+			s.sweeper = s.local.sweeper(cfg.SweepInterval, cfg.SweepThreshold)
+		}
+	}
+	return s, nil
+}
+
+// useLeases makes the server coordinate with other replicas through Leases
+// in namespace.
+func (s *server) useLeases(cs kubernetes.Interface, namespace string) error {
+	locker, err := kube.NewImageLocker(cs, namespace)
+	if err != nil {
+		return err
+	}
+
+	s.kube = cs
+	s.leaseNamespace = namespace
+	s.locker = locker
+	s.pushes = kube.NewPushLog(cs, namespace)
+	s.recorder = kube.NewRecorder(cs)
+	return nil
+}
+
+func (s *server) Serve(ctx context.Context) error {
+	servers := []*http.Server{&s.httpServer}
+	for _, srv := range []*http.Server{s.apiServer, s.metricsServer} {
+		if srv != nil {
+			servers = append(servers, srv)
+		}
+	}
+
+	if s.apiServer != nil {
+		go listenTLS("api", s.apiServer)
+	}
+	if s.metricsServer != nil {
+		go listen("metrics", s.metricsServer)
+	}
+	if s.sweeper != nil {
+		go s.sweeper(ctx)
+	}
+	// The replicas elect a leader for the resyncs requested through the
+	// API even without background tasks.
+	if len(s.background) > 0 || s.resyncer != nil {
+		go s.runBackground(ctx)
+	}
+
+	// The notifiers send the events still queued once ctx is done, which
+	// Serve waits for before returning.
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		if len(s.notifiers) > 0 {
+			s.notifiers.Run(ctx)
+		}
+	}()
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- s.httpServer.ListenAndServeTLS("", "")
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+
+	klog.InfoS("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			klog.ErrorS(err, "Failed to shut down server", "addr", srv.Addr)
+		}
+	}
+	<-notified
+	return nil
+}
+
+// metricsServer returns the plain HTTP server of the metrics at addr; nil
+// if addr is empty.
+func metricsServer(addr string) *http.Server {
+	if addr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
 }
 
-func (s *server) Serve() error {
-	return s.httpServer.ListenAndServeTLS("", "")
+// listen serves srv over plain HTTP until it fails or is shut down.
+func listen(name string, srv *http.Server) {
+	klog.InfoS("Server listening", "server", name, "addr", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.ErrorS(err, "Server stopped", "server", name)
+	}
+}
+
+// listenTLS serves srv over HTTPS, with the certificate of its TLS config,
+// until it fails or is shut down.
+func listenTLS(name string, srv *http.Server) {
+	klog.InfoS("Server listening", "server", name, "addr", srv.Addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		klog.ErrorS(err, "Server stopped", "server", name)
+	}
 }
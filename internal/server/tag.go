@@ -0,0 +1,136 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+// TagConflictPolicy decides what happens when the backup tag of an image
+// already exists in the backup registry with different content.
+type TagConflictPolicy string
+
+const (
+	// TagConflictOverwrite pushes over the existing tag and logs a warning.
+	TagConflictOverwrite TagConflictPolicy = "overwrite"
+
+	// TagConflictKeep keeps the existing tag, and pushes the image to a tag
+	// suffixed with its digest instead.
+	TagConflictKeep TagConflictPolicy = "keep"
+
+	// TagConflictRefuse rejects the admission request.
+	TagConflictRefuse TagConflictPolicy = "refuse"
+)
+
+// ParseTagConflictPolicy returns the policy named s, TagConflictOverwrite
+// if s is empty.
+func ParseTagConflictPolicy(s string) (TagConflictPolicy, error) {
+	switch p := TagConflictPolicy(s); p {
+	case "":
+		return TagConflictOverwrite, nil
+	case TagConflictOverwrite, TagConflictKeep, TagConflictRefuse:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown tag conflict policy %q", s)
+}
+
+// errTagConflict is returned when the policy refuses to overwrite a tag.
+type errTagConflict struct {
+	dst      string
+	existing string
+	id       string
+}
+
+func (e errTagConflict) Error() string {
+	return fmt.Sprintf("backup tag %s already exists with image %s, refusing to overwrite it with image %s",
+		e.dst, e.existing, e.id)
+}
+
+// guardTag checks whether dst already exists in the backup registry with an
+// image other than pulled, and returns the tag the image should be pushed to
+// according to the tag conflict policy. The image of dst for the platform of
+// pulled is compared if dst is an index.
+func (s *server) guardTag(ctx context.Context, dst string, pulled docker.Image) (string, error) {
+	id := pulled.ID
+	existing, err := s.registryClient.ConfigDigest(ctx, dst, pulled.Platform)
+	if errors.Is(err, registry.ErrNotFound) {
+		metrics.BackupLookups.WithLabelValues("miss").Inc()
+		return dst, nil
+	}
+	if err != nil {
+		if s.tagConflict == TagConflictOverwrite {
+			klog.FromContext(ctx).Info("Failed to check backup tag, overwriting it", "destination", dst, "err", err)
+			return dst, nil
+		}
+		return "", fmt.Errorf("failed to check backup tag %s: %v", dst, err)
+	}
+
+	if existing == id {
+		metrics.BackupLookups.WithLabelValues("hit").Inc()
+		return dst, nil
+	}
+	metrics.BackupLookups.WithLabelValues("miss").Inc()
+
+	switch s.tagConflict {
+	case TagConflictKeep:
+		suffixed, err := digestSuffixedTag(dst, id)
+		if err != nil {
+			return "", err
+		}
+		klog.FromContext(ctx).Info("Backup tag exists with another image, pushing to a suffixed tag",
+			"destination", dst, "existing", existing, "id", id, "suffixed", suffixed)
+		return suffixed, nil
+	case TagConflictRefuse:
+		return "", errTagConflict{dst: dst, existing: existing, id: id}
+	default:
+		klog.FromContext(ctx).Info("Overwriting backup tag", "destination", dst, "existing", existing, "id", id)
+		return dst, nil
+	}
+}
+
+// digestSuffixedTag returns dst with the short form of id appended to its
+// tag, e.g. alpine:3.12-0123456789ab.
+func digestSuffixedTag(dst, id string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(dst)
+	if err != nil {
+		return "", err
+	}
+
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+
+	hex := id[strings.Index(id, ":")+1:]
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+
+	suffixed, err := reference.WithTag(reference.TrimNamed(named), tag+"-"+hex)
+	if err != nil {
+		return "", err
+	}
+	return reference.FamiliarString(suffixed), nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+const otherImageID = "sha256:0f5f445df8ccbd8a062ad3d02d459e8549d9998c62a5b7cbf77baf68aa73bf5b"
+
+func TestGuardTag(t *testing.T) {
+	dst := "gauravgahlot/alpine:3.12"
+
+	cases := map[string]struct {
+		existing string
+		err      error
+		policy   TagConflictPolicy
+		want     string
+		wantErr  bool
+	}{
+		"not-found":          {err: registry.ErrNotFound, policy: TagConflictRefuse, want: dst},
+		"same-image":         {existing: imageID, policy: TagConflictRefuse, want: dst},
+		"conflict-overwrite": {existing: otherImageID, policy: TagConflictOverwrite, want: dst},
+		"conflict-keep":      {existing: otherImageID, policy: TagConflictKeep, want: "gauravgahlot/alpine:3.12-d4ff818577bc"},
+		"conflict-refuse":    {existing: otherImageID, policy: TagConflictRefuse, wantErr: true},
+		"error-overwrite":    {err: errors.New("unauthorized"), policy: TagConflictOverwrite, want: dst},
+		"error-keep":         {err: errors.New("unauthorized"), policy: TagConflictKeep, wantErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := mockRegistryClient{
+				ConfigDigestFunc: func(ctx context.Context, ref, p string) (string, error) {
+					assert.Equal(t, dst, ref)
+					assert.Equal(t, platform, p)
+					return tc.existing, tc.err
+				},
+			}
+			s := testServer(t, nil, withRegistryClient(r), withTagConflict(tc.policy))
+
+			got, err := s.guardTag(context.Background(), dst, pulledImage)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestDigestSuffixedTag(t *testing.T) {
+	cases := map[string]struct {
+		dst  string
+		want string
+	}{
+		"tagged":   {dst: "quay.io/gauravgahlot/alpine:3.12", want: "quay.io/gauravgahlot/alpine:3.12-d4ff818577bc"},
+		"untagged": {dst: "gauravgahlot/alpine", want: "gauravgahlot/alpine:latest-d4ff818577bc"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := digestSuffixedTag(tc.dst, imageID)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCreateResponseTagConflict(t *testing.T) {
+	d := mockDockerClient{
+		ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+		ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+	}
+	r := mockRegistryClient{
+		ConfigDigestFunc: func(ctx context.Context, ref, platform string) (string, error) { return otherImageID, nil },
+	}
+	s := testServer(t, d, withRegistryUser(registryUser), withRegistryClient(r), withTagConflict(TagConflictRefuse))
+
+	res, err := s.createResponse(context.Background(), eventTarget{}, containerImages(containersPath, []v1.Container{{Name: "alpine", Image: alpine}}), nil, uid)
+	assert.Error(t, err)
+	assert.False(t, res.allowed)
+	assert.Equal(t, int32(409), res.status.code)
+	assert.Equal(t, metav1.StatusReasonConflict, res.status.reason)
+}
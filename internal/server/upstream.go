@@ -0,0 +1,91 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/notify"
+	"github.com/gauravgahlot/image-cloner/internal/upstream"
+)
+
+// upstreamQPS is the number of sources checked per second.
+const upstreamQPS = 5
+
+// Reasons of the Events recorded on the workloads whose sources changed
+// status.
+var upstreamReasons = map[upstream.Status]string{
+	upstream.Available:   "UpstreamImageAvailable",
+	upstream.Gone:        "UpstreamImageGone",
+	upstream.Changed:     "UpstreamImageChanged",
+	upstream.RateLimited: "UpstreamRateLimited",
+	upstream.Failed:      "UpstreamCheckFailed",
+}
+
+// checkUpstream checks the sources of the images recorded in the
+// annotations of the workloads, and records an Event on the workloads whose
+// source changed status since the last check.
+func (s *server) checkUpstream(ctx context.Context) error {
+	workloads, err := kube.ListWorkloads(ctx, s.kube, "", "")
+	if err != nil {
+		return err
+	}
+
+	report, previous := s.upstream.Check(ctx, upstream.Sources(workloads))
+	for _, src := range report.Sources {
+		prev, checked := previous[src.Image+"@"+src.Digest]
+		if prev == src.Status || (!checked && src.Status == upstream.Available) {
+			continue
+		}
+
+		eventType := corev1.EventTypeWarning
+		if src.Status == upstream.Available {
+			eventType = corev1.EventTypeNormal
+		}
+		for _, u := range src.Uses {
+			msg := fmt.Sprintf("Source %s of the backup used by container %s is %s", src.Image, u.Container, src.Status)
+			s.recorder.Event(u.Workload().Reference(), eventType, upstreamReasons[src.Status], msg)
+			s.notifiers.Notify(notify.Event{
+				Type:      notify.Upstream(string(src.Status)),
+				Kind:      u.Kind,
+				Namespace: u.Namespace,
+				Name:      u.Name,
+				Container: u.Container,
+				Source:    src.Image,
+				Message:   msg,
+				Error:     src.Error,
+			})
+		}
+	}
+	return nil
+}
+
+// periodicUpstreamCheck returns a task checking the sources every interval.
+func (s *server) periodicUpstreamCheck(interval time.Duration) func(context.Context) {
+	return func(ctx context.Context) {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			if err := s.checkUpstream(ctx); err != nil {
+				klog.ErrorS(err, "Upstream check failed")
+			}
+		}, interval)
+	}
+}
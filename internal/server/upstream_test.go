@@ -0,0 +1,54 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+	"github.com/gauravgahlot/image-cloner/internal/upstream"
+)
+
+func TestCheckUpstream(t *testing.T) {
+	d := testDeployment("default", "alpine", "gauravgahlot/alpine:3.12")
+	d.Annotations = map[string]string{annotation.OriginalImages: `{"alpine":{"image":"alpine:3.12","digest":"` + digest + `"}}`}
+	cs := fake.NewSimpleClientset(d)
+
+	head := func(ctx context.Context, ref string) (string, error) { return "", registry.ErrNotFound }
+	r := mockRegistryClient{HeadFunc: func(ctx context.Context, ref string) (string, error) { return head(ctx, ref) }}
+	recorder := record.NewFakeRecorder(10)
+	s := testServer(t, mockDockerClient{}, withRegistryClient(r))
+	s.kube = cs
+	s.recorder = recorder
+	s.upstream = upstream.NewChecker(r, 1000)
+
+	assert.NoError(t, s.checkUpstream(context.Background()))
+	assert.Equal(t, "Warning UpstreamImageGone Source alpine:3.12 of the backup used by container alpine is gone", <-recorder.Events)
+
+	// No Event is recorded until the status changes.
+	assert.NoError(t, s.checkUpstream(context.Background()))
+	assert.Empty(t, recorder.Events)
+
+	head = func(ctx context.Context, ref string) (string, error) { return digest, nil }
+	assert.NoError(t, s.checkUpstream(context.Background()))
+	assert.Equal(t, "Normal UpstreamImageAvailable Source alpine:3.12 of the backup used by container alpine is available", <-recorder.Events)
+	assert.Equal(t, upstream.Available, s.upstream.Last().Sources[0].Status)
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/index"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/verify"
+)
+
+// Verify checks the integrity of the backups used by the workloads of the
+// cluster of cs, and whether they are still the image recorded as their
+// source.
+func Verify(ctx context.Context, cfg Config, cs kubernetes.Interface) (verify.Report, error) {
+	s, err := newServer(cfg)
+	if err != nil {
+		return verify.Report{}, err
+	}
+	return s.verifyBackups(ctx, cs)
+}
+
+func (s *server) verifyBackups(ctx context.Context, cs kubernetes.Interface) (verify.Report, error) {
+	workloads, err := kube.ListWorkloads(ctx, cs, "", "")
+	if err != nil {
+		return verify.Report{}, err
+	}
+
+	entries := []index.Entry{}
+	for _, e := range index.Build(workloads) {
+		if s.isUsingBackupRegistry(e.Backup) {
+			entries = append(entries, e)
+		}
+	}
+	return s.verifier.Verify(ctx, entries), nil
+}
+
+// periodicVerify returns a task verifying the backups every interval.
+func (s *server) periodicVerify(interval time.Duration) func(context.Context) {
+	return func(ctx context.Context) {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			report, err := s.verifyBackups(ctx, s.kube)
+			if err != nil {
+				klog.ErrorS(err, "Backup verification failed")
+				return
+			}
+			klog.InfoS("Backup verification done",
+				"verified", len(report.Results)-report.Failed(), "failed", report.Failed())
+		}, interval)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+	"github.com/gauravgahlot/image-cloner/internal/verify"
+)
+
+func TestVerifyBackups(t *testing.T) {
+	d := testDeployment("default", "alpine", "gauravgahlot/alpine:3.12", "busybox:1.33")
+	d.Annotations = map[string]string{annotation.OriginalImages: `{"alpine":{"image":"alpine:3.12","digest":"` + digest + `"}}`}
+	cs := fake.NewSimpleClientset(d)
+
+	verified := []string{}
+	r := mockRegistryClient{
+		VerifyFunc: func(ctx context.Context, ref string) (registry.Verified, error) {
+			verified = append(verified, ref)
+			return registry.Verified{Digest: digest, Configs: []string{imageID}, Blobs: 2}, nil
+		},
+	}
+	s := testServer(t, mockDockerClient{}, withRegistryUser(registryUser), withRegistryClient(r))
+	s.verifier = verify.NewVerifier(r)
+
+	report, err := s.verifyBackups(context.Background(), cs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gauravgahlot/alpine:3.12"}, verified)
+	assert.Len(t, report.Results, 1)
+	assert.Equal(t, verify.Verified, report.Results[0].Status)
+	assert.Equal(t, verify.Match, report.Results[0].Source)
+	assert.Equal(t, []string{"Deployment default/alpine"}, report.Results[0].Workloads)
+	assert.Equal(t, 0, report.Failed())
+}
+
+func TestVerifyMinimalConfig(t *testing.T) {
+	// Without workloads, no backup is fetched, so only the setup of the
+	// server is tested.
+	report, err := Verify(context.Background(), Config{}, fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.Empty(t, report.Results)
+}
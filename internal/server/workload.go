@@ -0,0 +1,167 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+
+	"github.com/gauravgahlot/image-cloner/internal/pointer"
+)
+
+// WorkloadConfig registers a kind, usually a custom resource, whose
+// containers are not at the pod template path of the built-in workloads.
+type WorkloadConfig struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+
+	// Paths are JSON pointers to either an array of containers, a single
+	// container, or an image string.
+	Paths []string `json:"paths"`
+}
+
+type workloadsFile struct {
+	Workloads []WorkloadConfig `json:"workloads"`
+}
+
+// workloads maps a registered kind to the JSON pointers of its images.
+type workloads map[metav1.GroupVersionKind][]string
+
+// kinds returns the registered kinds, sorted.
+func (w workloads) kinds() []schema.GroupVersionKind {
+	kinds := make([]schema.GroupVersionKind, 0, len(w))
+	for gvk := range w {
+		kinds = append(kinds, schema.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind})
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].String() < kinds[j].String() })
+	return kinds
+}
+
+// paths returns the JSON pointers of the images of gvk.
+func (w workloads) paths(gvk schema.GroupVersionKind) []string {
+	return w[metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}]
+}
+
+// RegisteredKinds returns the kinds registered in the workloads config at
+// path, for the subcommands that list their objects.
+func RegisteredKinds(path string) ([]schema.GroupVersionKind, error) {
+	w, err := loadWorkloads(path)
+	if err != nil {
+		return nil, err
+	}
+	return w.kinds(), nil
+}
+
+// loadWorkloads reads the workloads registered in the YAML or JSON file at
+// path. An empty path registers none.
+func loadWorkloads(path string) (workloads, error) {
+	if path == "" {
+		return workloads{}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f workloadsFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid workloads file %s: %v", path, err)
+	}
+	return newWorkloads(f.Workloads)
+}
+
+func newWorkloads(configs []WorkloadConfig) (workloads, error) {
+	w := workloads{}
+	for _, c := range configs {
+		if c.Version == "" || c.Kind == "" {
+			return nil, fmt.Errorf("workload %s/%s: version and kind are required", c.Group, c.Kind)
+		}
+		if len(c.Paths) == 0 {
+			return nil, fmt.Errorf("workload %s/%s: at least one path is required", c.Group, c.Kind)
+		}
+		for _, p := range c.Paths {
+			if _, err := pointer.Parse(p); err != nil {
+				return nil, fmt.Errorf("workload %s/%s: %v", c.Group, c.Kind, err)
+			}
+		}
+
+		gvk := metav1.GroupVersionKind{Group: c.Group, Version: c.Version, Kind: c.Kind}
+		w[gvk] = append(w[gvk], c.Paths...)
+	}
+	return w, nil
+}
+
+// unstructuredImages decodes raw as an unstructured object and returns the
+// images found at paths. Paths that do not exist in the object are ignored.
+func unstructuredImages(raw []byte, paths []string) ([]image, error) {
+	var obj interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+
+	images := []image{}
+	for _, p := range paths {
+		tokens, err := pointer.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+
+		node, ok := pointer.Resolve(obj, tokens)
+		if !ok {
+			continue
+		}
+
+		switch v := node.(type) {
+		case string:
+			images = append(images, image{container: p, ref: v, path: p})
+		case map[string]interface{}:
+			if img, ok := unstructuredContainer(v, p); ok {
+				images = append(images, img)
+			}
+		case []interface{}:
+			for i, c := range v {
+				m, ok := c.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if img, ok := unstructuredContainer(m, fmt.Sprintf("%s/%d", p, i)); ok {
+					images = append(images, img)
+				}
+			}
+		}
+	}
+	return images, nil
+}
+
+func unstructuredContainer(c map[string]interface{}, path string) (image, bool) {
+	ref, ok := c["image"].(string)
+	if !ok {
+		return image{}, false
+	}
+
+	name, _ := c["name"].(string)
+	if name == "" {
+		name = path
+	}
+	return image{container: name, ref: ref, path: path + "/image"}, true
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/gauravgahlot/image-cloner/internal/docker"
+)
+
+var rollout = metav1.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
+
+func TestLoadWorkloads(t *testing.T) {
+	cases := map[string]struct {
+		config string
+		want   workloads
+		err    bool
+	}{
+		"registered": {
+			config: `
+workloads:
+  - group: argoproj.io
+    version: v1alpha1
+    kind: Rollout
+    paths:
+      - /spec/template/spec/containers
+      - /spec/template/spec/initContainers
+  - group: tekton.dev
+    version: v1beta1
+    kind: Task
+    paths: [/spec/steps]
+`,
+			want: workloads{
+				rollout: {"/spec/template/spec/containers", "/spec/template/spec/initContainers"},
+				{Group: "tekton.dev", Version: "v1beta1", Kind: "Task"}: {"/spec/steps"},
+			},
+		},
+		"missing-paths": {
+			config: "workloads: [{group: tekton.dev, version: v1beta1, kind: Task}]",
+			err:    true,
+		},
+		"invalid-pointer": {
+			config: "workloads: [{group: tekton.dev, version: v1beta1, kind: Task, paths: [spec/steps]}]",
+			err:    true,
+		},
+		"unknown-field": {
+			config: "workloads: [{kind: Task, version: v1beta1, path: /spec/steps}]",
+			err:    true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "workloads.yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadWorkloads(path)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestUnstructuredImages(t *testing.T) {
+	raw := []byte(`{
+		"metadata": {"annotations": {"example.com/image": "redis:6"}},
+		"spec": {
+			"steps": [
+				{"name": "build", "image": "golang:1.17"},
+				{"name": "no-image"},
+				"not-a-container"
+			],
+			"sidecar": {"image": "busybox:1.33"}
+		}
+	}`)
+	paths := []string{"/spec/steps", "/spec/sidecar", "/metadata/annotations/example.com~1image", "/spec/missing"}
+
+	got, err := unstructuredImages(raw, paths)
+	assert.NoError(t, err)
+	assert.Equal(t, []image{
+		{container: "build", ref: "golang:1.17", path: "/spec/steps/0/image"},
+		{container: "/spec/sidecar", ref: "busybox:1.33", path: "/spec/sidecar/image"},
+		{container: "/metadata/annotations/example.com~1image", ref: "redis:6", path: "/metadata/annotations/example.com~1image"},
+	}, got)
+}
+
+func TestCloneImageRegisteredWorkload(t *testing.T) {
+	d := mockDockerClient{
+		ImagePullFunc:    func(ctx context.Context, image string) error { return nil },
+		ImageTagFunc:     func(ctx context.Context, src, dst string) error { return nil },
+		ImagePushFunc:    func(ctx context.Context, image string) (string, error) { return pushDigest, nil },
+		ImageInspectFunc: func(ctx context.Context, image string) (docker.Image, error) { return pulledImage, nil },
+	}
+	w := workloads{rollout: {containersPath}}
+	s := testServer(t, d, withRegistryUser(registryUser), withWorkloads(w))
+
+	var review v1.AdmissionReview
+	if err := json.Unmarshal([]byte(admissionReviewRequestDeployment), &review); err != nil {
+		t.Fatal(err)
+	}
+	review.Request.Kind = rollout
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/clone-image", bytes.NewBuffer(body))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.cloneImage).ServeHTTP(rr, req)
+
+	var res v1.AdmissionReview
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.True(t, res.Response.Allowed)
+	assert.Equal(t, getPatch("alpine", alpine, "", registryUser), res.Response.Patch)
+}
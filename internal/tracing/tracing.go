@@ -0,0 +1,116 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records OpenTelemetry spans of the admissions and of the
+// stages of the clones, and exports them over OTLP.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer of image cloner.
+const instrumentation = "github.com/gauravgahlot/image-cloner"
+
+// Attributes of the spans.
+const (
+	UID         = attribute.Key("k8s.admission.uid")
+	Operation   = attribute.Key("k8s.admission.operation")
+	Kind        = attribute.Key("k8s.object.kind")
+	Namespace   = attribute.Key("k8s.namespace.name")
+	Name        = attribute.Key("k8s.object.name")
+	Container   = attribute.Key("k8s.container.name")
+	Image       = attribute.Key("image_cloner.image")
+	Source      = attribute.Key("image_cloner.source")
+	Destination = attribute.Key("image_cloner.destination")
+)
+
+// Options configure the export of the spans.
+type Options struct {
+	// Endpoint is the host and port of the OTLP/HTTP receiver, such as
+	// otel-collector:4318. Spans are not exported if it is empty.
+	Endpoint string
+
+	// Insecure sends the spans over plain HTTP.
+	Insecure bool
+}
+
+// Setup exports the spans to the endpoint of opts, and returns the function
+// flushing the spans left before the process exits.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("image-cloner"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+type uidKey struct{}
+
+// WithUID returns ctx carrying the UID of the admission it serves, which is
+// recorded on every span started from it.
+func WithUID(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, uidKey{}, uid)
+}
+
+// Start starts a span named name, child of the span of ctx if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if uid, ok := ctx.Value(uidKey{}).(string); ok && uid != "" {
+		attrs = append(attrs, UID.String(uid))
+	}
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span if it is not nil, and ends span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract returns ctx carrying the span propagated by the headers of a
+// request, if any.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans records the spans ended during the test in the returned
+// exporter.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return exporter
+}
+
+func TestStart(t *testing.T) {
+	exporter := recordSpans(t)
+
+	ctx, parent := Start(context.Background(), "cloneImage")
+	ctx = WithUID(ctx, "4584308f")
+	_, child := Start(ctx, "clone", Container.String("alpine"))
+	End(child, errors.New("error image pull"))
+	End(parent, nil)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "clone", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.ElementsMatch(t, []attribute.KeyValue{Container.String("alpine"), UID.String("4584308f")}, spans[0].Attributes)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Equal(t, "error image pull", spans[0].Status.Description)
+
+	assert.Equal(t, "cloneImage", spans[1].Name)
+	assert.Empty(t, spans[1].Attributes)
+	assert.Equal(t, codes.Unset, spans[1].Status.Code)
+}
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Options{})
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package upstream checks that the original images of the backups are
+// still available from their source registry.
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/client-go/util/flowcontrol"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+// Status of the source of an original image.
+type Status string
+
+// Statuses of a source.
+const (
+	// Available sources still have the image that was cloned.
+	Available Status = "available"
+	// Gone sources no longer have the image.
+	Gone Status = "gone"
+	// Changed sources have a different image under the same reference.
+	Changed Status = "changed"
+	// RateLimited sources refused to be checked.
+	RateLimited Status = "rate-limited"
+	// Failed sources could not be checked.
+	Failed Status = "error"
+)
+
+// Use is a container of a workload using the backup of a source.
+type Use struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+
+	workload kube.Workload
+}
+
+// Workload returns the workload of the container.
+func (u Use) Workload() kube.Workload {
+	return u.workload
+}
+
+// Source is an original image, as recorded when it was cloned.
+type Source struct {
+	Image string `json:"image"`
+
+	// Digest is the digest recorded when the image was cloned, and Current
+	// the digest of the source when it was checked.
+	Digest  string `json:"digest,omitempty"`
+	Current string `json:"current,omitempty"`
+
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	Uses []Use `json:"uses"`
+}
+
+// Report lists the sources as of their last check.
+type Report struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	Sources   []Source  `json:"sources"`
+}
+
+// Sources returns the sources recorded in the OriginalImages annotation of
+// workloads; one per image and recorded digest.
+func Sources(workloads []kube.Workload) []Source {
+	type key struct{ image, digest string }
+	sources := map[key]*Source{}
+
+	for _, w := range workloads {
+		originals, err := annotation.Decode(w.Annotations)
+		if err != nil {
+			klog.InfoS("Ignoring the original images of workload", "kind", w.Kind, "namespace", w.Namespace, "name", w.Name, "err", err)
+			continue
+		}
+
+		for container, o := range originals {
+			k := key{o.Image, o.Digest}
+			if sources[k] == nil {
+				sources[k] = &Source{Image: o.Image, Digest: o.Digest, Uses: []Use{}}
+			}
+			sources[k].Uses = append(sources[k].Uses, Use{
+				Kind:      w.Kind,
+				Namespace: w.Namespace,
+				Name:      w.Name,
+				Container: container,
+				workload:  w,
+			})
+		}
+	}
+
+	list := make([]Source, 0, len(sources))
+	for _, s := range sources {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Image != list[j].Image {
+			return list[i].Image < list[j].Image
+		}
+		return list[i].Digest < list[j].Digest
+	})
+	return list
+}
+
+// Checker checks sources, and keeps the report of the last check.
+type Checker struct {
+	reg registry.Client
+	qps float32
+
+	mu   sync.RWMutex
+	last Report
+}
+
+// NewChecker returns a Checker that sends at most qps requests per second
+// to the source registries.
+func NewChecker(reg registry.Client, qps float32) *Checker {
+	return &Checker{reg: reg, qps: qps, last: Report{Sources: []Source{}}}
+}
+
+// Check sets the status of sources, and returns them along with the status
+// they had at the previous check, if any.
+func (c *Checker) Check(ctx context.Context, sources []Source) (Report, map[string]Status) {
+	limiter := flowcontrol.NewTokenBucketRateLimiter(c.qps, 1)
+	defer limiter.Stop()
+
+	// A registry that rate limited a request is not sent any more of them
+	// until the next check.
+	limited := map[string]bool{}
+	for i := range sources {
+		s := &sources[i]
+		ref, err := name.ParseReference(s.Image)
+		if err != nil {
+			s.Status, s.Error = Failed, err.Error()
+			continue
+		}
+		host := ref.Context().RegistryStr()
+		if limited[host] {
+			s.Status = RateLimited
+			continue
+		}
+
+		if err := limiter.Wait(ctx); err != nil {
+			s.Status, s.Error = Failed, err.Error()
+			continue
+		}
+
+		s.Current, s.Status, s.Error = c.check(ctx, s.Image, s.Digest)
+		if s.Status == RateLimited {
+			limited[host] = true
+		}
+	}
+
+	report := Report{CheckedAt: time.Now().UTC(), Sources: sources}
+
+	c.mu.Lock()
+	previous := map[string]Status{}
+	for _, s := range c.last.Sources {
+		previous[s.Image+"@"+s.Digest] = s.Status
+	}
+	c.last = report
+	c.mu.Unlock()
+
+	record(report)
+	return report, previous
+}
+
+func (c *Checker) check(ctx context.Context, image, recorded string) (string, Status, string) {
+	current, err := c.reg.Head(ctx, image)
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		return "", Gone, ""
+	case errors.Is(err, registry.ErrRateLimited):
+		return "", RateLimited, ""
+	case err != nil:
+		return "", Failed, err.Error()
+	case recorded != "" && current != recorded:
+		return current, Changed, ""
+	}
+	return current, Available, ""
+}
+
+// Last returns the report of the last check.
+func (c *Checker) Last() Report {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.last
+}
+
+// ServeHTTP writes the report of the last check as JSON.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.Last()); err != nil {
+		klog.ErrorS(err, "Failed to write the upstream report")
+	}
+}
+
+// record updates the metrics of the sources.
+func record(r Report) {
+	metrics.UpstreamSources.Reset()
+	metrics.UpstreamSourceUnavailable.Reset()
+	for _, st := range []Status{Available, Gone, Changed, RateLimited, Failed} {
+		metrics.UpstreamSources.WithLabelValues(string(st))
+	}
+
+	for _, s := range r.Sources {
+		metrics.UpstreamSources.WithLabelValues(string(s.Status)).Inc()
+		if s.Status != Available {
+			metrics.UpstreamSourceUnavailable.WithLabelValues(s.Image, string(s.Status)).Set(1)
+		}
+	}
+	metrics.UpstreamLastCheck.Set(float64(r.CheckedAt.Unix()))
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gauravgahlot/image-cloner/internal/annotation"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+const (
+	recorded = "sha256:d4ff818577bc193b309b355b02ebc9220427090057b54a59e73b79bdfe139b83"
+	moved    = "sha256:1775bebec23e1f3ce486989bfc9ff3c4e951690df84aa9f926497d82f2ffca9d"
+)
+
+type fakeRegistry struct {
+	registry.Client
+
+	heads map[string]func() (string, error)
+	calls []string
+}
+
+func (r *fakeRegistry) Head(ctx context.Context, ref string) (string, error) {
+	r.calls = append(r.calls, ref)
+	return r.heads[ref]()
+}
+
+func workload(name string, originals map[string]annotation.Original) kube.Workload {
+	value, _ := annotation.Encode(originals)
+	return kube.Workload{
+		Kind:        kube.Deployment,
+		Namespace:   "default",
+		Name:        name,
+		Annotations: map[string]string{annotation.OriginalImages: value},
+	}
+}
+
+func TestSources(t *testing.T) {
+	sources := Sources([]kube.Workload{
+		workload("a", map[string]annotation.Original{"app": {Image: "alpine:3.12", Digest: recorded}}),
+		workload("b", map[string]annotation.Original{"app": {Image: "alpine:3.12", Digest: recorded}, "sidecar": {Image: "busybox:1.33"}}),
+		{Kind: kube.Deployment, Name: "plain"},
+	})
+
+	assert.Len(t, sources, 2)
+	assert.Equal(t, "alpine:3.12", sources[0].Image)
+	assert.Len(t, sources[0].Uses, 2)
+	assert.Equal(t, "busybox:1.33", sources[1].Image)
+	assert.Equal(t, "b", sources[1].Uses[0].Name)
+	assert.Equal(t, "sidecar", sources[1].Uses[0].Container)
+	assert.Equal(t, "b", sources[1].Uses[0].Workload().Name)
+}
+
+func TestCheck(t *testing.T) {
+	reg := &fakeRegistry{heads: map[string]func() (string, error){
+		"alpine:3.12":        func() (string, error) { return recorded, nil },
+		"alpine:3":           func() (string, error) { return moved, nil },
+		"busybox:1.33":       func() (string, error) { return "", registry.ErrNotFound },
+		"quay.io/a/nginx:1":  func() (string, error) { return "", registry.ErrRateLimited },
+		"quay.io/a/redis:6":  func() (string, error) { return recorded, nil },
+		"gcr.io/a/pause:3.5": func() (string, error) { return "", errors.New("connection refused") },
+		"unrecorded:1.0":     func() (string, error) { return moved, nil },
+		"Nginx:1":            func() (string, error) { return "", registry.ErrRateLimited },
+		"Redis:6":            func() (string, error) { return recorded, nil },
+	}}
+	sources := []Source{
+		{Image: "alpine:3.12", Digest: recorded},
+		{Image: "alpine:3", Digest: recorded},
+		{Image: "busybox:1.33", Digest: recorded},
+		{Image: "quay.io/a/nginx:1", Digest: recorded},
+		{Image: "quay.io/a/redis:6", Digest: recorded},
+		{Image: "gcr.io/a/pause:3.5", Digest: recorded},
+		{Image: "unrecorded:1.0"},
+		{Image: "Nginx:1", Digest: recorded},
+		{Image: "Redis:6", Digest: recorded},
+	}
+
+	c := NewChecker(reg, 1000)
+	report, previous := c.Check(context.Background(), sources)
+	assert.Empty(t, previous)
+
+	got := map[string]Status{}
+	for _, s := range report.Sources {
+		got[s.Image] = s.Status
+	}
+	assert.Equal(t, map[string]Status{
+		"alpine:3.12":        Available,
+		"alpine:3":           Changed,
+		"busybox:1.33":       Gone,
+		"quay.io/a/nginx:1":  RateLimited,
+		"quay.io/a/redis:6":  RateLimited,
+		"gcr.io/a/pause:3.5": Failed,
+		"unrecorded:1.0":     Available,
+		"Nginx:1":            Failed,
+		"Redis:6":            Failed,
+	}, got)
+	assert.NotContains(t, reg.calls, "quay.io/a/redis:6")
+
+	// Unparsable sources fail without being checked.
+	assert.NotContains(t, reg.calls, "Nginx:1")
+	assert.NotContains(t, reg.calls, "Redis:6")
+	assert.Equal(t, report, c.Last())
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.UpstreamSources.WithLabelValues(string(RateLimited))))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.UpstreamSourceUnavailable.WithLabelValues("busybox:1.33", string(Gone))))
+
+	_, previous = c.Check(context.Background(), []Source{{Image: "busybox:1.33", Digest: recorded}})
+	assert.Equal(t, Gone, previous["busybox:1.33@"+recorded])
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.UpstreamSources.WithLabelValues(string(RateLimited))))
+}
+
+func TestServeHTTP(t *testing.T) {
+	reg := &fakeRegistry{heads: map[string]func() (string, error){
+		"busybox:1.33": func() (string, error) { return "", registry.ErrNotFound },
+	}}
+	c := NewChecker(reg, 1000)
+	c.Check(context.Background(), []Source{{Image: "busybox:1.33", Uses: []Use{{Kind: kube.Deployment, Name: "a"}}}})
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/upstream", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var got Report
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, Gone, got.Sources[0].Status)
+	assert.Equal(t, "a", got.Sources[0].Uses[0].Name)
+
+	rec = httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upstream", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verify checks that the backups can be pulled, and that they are
+// the image that was cloned.
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/index"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+// Status of a backup.
+type Status string
+
+// Statuses of a backup.
+const (
+	// Verified backups have a manifest and blobs matching their digest.
+	Verified Status = "verified"
+	// Missing backups have no manifest, or are missing a blob.
+	Missing Status = "missing"
+	// Corrupt backups have content that does not match its digest.
+	Corrupt Status = "corrupt"
+	// Unverified backups could not be fetched, such as when the registry
+	// refused the request or could not be reached; they may be intact.
+	Unverified Status = "unverified"
+)
+
+// SourceMatch tells whether a backup is the image recorded as its source.
+type SourceMatch string
+
+// Results of the comparison with the source.
+const (
+	Match    SourceMatch = "match"
+	Mismatch SourceMatch = "mismatch"
+	// Unknown if the source digest was not recorded, or the source could
+	// not be fetched.
+	Unknown SourceMatch = "unknown"
+)
+
+// Result is the verification of a backup.
+type Result struct {
+	index.Entry
+
+	Status Status      `json:"status"`
+	Source SourceMatch `json:"sourceMatch"`
+	Digest string      `json:"digest,omitempty"`
+	Blobs  int         `json:"blobs"`
+	Bytes  int64       `json:"bytes"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Report lists the results of a verification.
+type Report struct {
+	VerifiedAt time.Time `json:"verifiedAt"`
+	Results    []Result  `json:"results"`
+}
+
+// Failed counts the backups that are not verified or do not match their
+// source.
+func (r Report) Failed() int {
+	n := 0
+	for _, res := range r.Results {
+		if res.Status != Verified || res.Source == Mismatch {
+			n++
+		}
+	}
+	return n
+}
+
+// Verifier verifies backups, and keeps the report of the last verification.
+type Verifier struct {
+	reg registry.Client
+
+	mu   sync.RWMutex
+	last Report
+}
+
+// NewVerifier returns a Verifier fetching the backups and sources with reg.
+func NewVerifier(reg registry.Client) *Verifier {
+	return &Verifier{reg: reg, last: Report{Results: []Result{}}}
+}
+
+// Verify fetches the manifest and every blob of the backup of each entry,
+// and compares it with the recorded digest of the source when there is
+// one.
+func (v *Verifier) Verify(ctx context.Context, entries []index.Entry) Report {
+	report := Report{Results: make([]Result, 0, len(entries))}
+	for _, e := range entries {
+		res := v.verify(ctx, e)
+		if res.Status != Verified {
+			klog.FromContext(ctx).Info("Backup failed verification", "backup", e.Backup, "status", res.Status, "err", res.Error)
+		}
+		report.Results = append(report.Results, res)
+	}
+	report.VerifiedAt = time.Now().UTC()
+
+	v.mu.Lock()
+	v.last = report
+	v.mu.Unlock()
+
+	record(report)
+	return report
+}
+
+func (v *Verifier) verify(ctx context.Context, e index.Entry) Result {
+	res := Result{Entry: e, Source: Unknown}
+
+	verified, err := v.reg.Verify(ctx, e.Backup)
+	res.Digest, res.Blobs, res.Bytes = verified.Digest, verified.Blobs, verified.Bytes
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		res.Status, res.Error = Missing, err.Error()
+		return res
+	case errors.Is(err, registry.ErrCorrupt):
+		res.Status, res.Error = Corrupt, err.Error()
+		return res
+	case err != nil:
+		res.Status, res.Error = Unverified, err.Error()
+		return res
+	}
+	res.Status = Verified
+
+	if e.SourceDigest == "" {
+		return res
+	}
+	if verified.Digest == e.SourceDigest {
+		res.Source = Match
+		return res
+	}
+
+	// A backup pushed from a pulled image has its own manifest, and the
+	// source may be an index of images for several platforms: the backup
+	// matches if its config is the config of one of them.
+	src, err := name.ParseReference(e.Source)
+	if err != nil {
+		return res
+	}
+	configs, err := v.reg.ConfigDigests(ctx, src.Context().Digest(e.SourceDigest).String())
+	if err != nil {
+		klog.FromContext(ctx).Info("Failed to fetch source", "source", e.Source, "digest", e.SourceDigest, "err", err)
+		return res
+	}
+
+	res.Source = Mismatch
+	for _, c := range configs {
+		for _, vc := range verified.Configs {
+			if c == vc {
+				res.Source = Match
+			}
+		}
+	}
+	return res
+}
+
+// Last returns the report of the last verification.
+func (v *Verifier) Last() Report {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.last
+}
+
+// ServeHTTP writes the report of the last verification as JSON.
+func (v *Verifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v.Last()); err != nil {
+		klog.ErrorS(err, "Failed to write the verification report")
+	}
+}
+
+// record updates the metrics of the backups. The backups that could not be
+// fetched are only counted by their status, since they are not known to
+// have failed.
+func record(r Report) {
+	metrics.VerifiedBackups.Reset()
+	metrics.VerifyFailure.Reset()
+
+	for _, res := range r.Results {
+		metrics.VerifiedBackups.WithLabelValues(string(res.Status), string(res.Source)).Inc()
+		if res.Status == Unverified {
+			continue
+		}
+		if res.Status != Verified || res.Source == Mismatch {
+			metrics.VerifyFailure.WithLabelValues(res.Backup, string(res.Status), string(res.Source)).Set(1)
+		}
+	}
+	metrics.VerifyLastRun.Set(float64(r.VerifiedAt.Unix()))
+}
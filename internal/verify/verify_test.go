@@ -0,0 +1,139 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gauravgahlot/image-cloner/internal/index"
+	"github.com/gauravgahlot/image-cloner/internal/metrics"
+	"github.com/gauravgahlot/image-cloner/internal/registry"
+)
+
+// digest returns a valid digest made of n.
+func digest(n string) string {
+	return "sha256:" + strings.Repeat(n, 32)
+}
+
+type fakeRegistry struct {
+	registry.Client
+
+	backups map[string]func() (registry.Verified, error)
+	sources map[string][]string
+}
+
+func (r fakeRegistry) Verify(ctx context.Context, ref string) (registry.Verified, error) {
+	return r.backups[ref]()
+}
+
+func (r fakeRegistry) ConfigDigests(ctx context.Context, ref string) ([]string, error) {
+	configs, ok := r.sources[ref]
+	if !ok {
+		return nil, registry.ErrNotFound
+	}
+	return configs, nil
+}
+
+func verified(manifest, config string) func() (registry.Verified, error) {
+	return func() (registry.Verified, error) {
+		return registry.Verified{Digest: manifest, Configs: []string{config}, Blobs: 3, Bytes: 2048}, nil
+	}
+}
+
+func TestVerify(t *testing.T) {
+	reg := fakeRegistry{
+		backups: map[string]func() (registry.Verified, error){
+			"gauravgahlot/same:1":     verified(digest("01"), digest("c1")),
+			"gauravgahlot/index:1":    verified(digest("02"), digest("c2")),
+			"gauravgahlot/other:1":    verified(digest("03"), digest("c3")),
+			"gauravgahlot/unrecord:1": verified(digest("04"), digest("c4")),
+			"gauravgahlot/gone-src:1": verified(digest("05"), digest("c5")),
+			"gauravgahlot/missing:1":  func() (registry.Verified, error) { return registry.Verified{}, registry.ErrNotFound },
+			"gauravgahlot/no-layer:1": func() (registry.Verified, error) {
+				return registry.Verified{}, fmt.Errorf("layer: %w", registry.ErrNotFound)
+			},
+			"gauravgahlot/corrupt:1": func() (registry.Verified, error) {
+				return registry.Verified{}, fmt.Errorf("layer: %w", registry.ErrCorrupt)
+			},
+			"gauravgahlot/denied:1": func() (registry.Verified, error) {
+				return registry.Verified{}, errors.New("UNAUTHORIZED: authentication required")
+			},
+		},
+		sources: map[string][]string{
+			"index.docker.io/library/index@" + digest("a2"): {digest("c0"), digest("c2")},
+			"index.docker.io/library/other@" + digest("a3"): {digest("c0")},
+		},
+	}
+	entries := []index.Entry{
+		{Source: "same:1", SourceDigest: digest("01"), Backup: "gauravgahlot/same:1"},
+		{Source: "index:1", SourceDigest: digest("a2"), Backup: "gauravgahlot/index:1"},
+		{Source: "other:1", SourceDigest: digest("a3"), Backup: "gauravgahlot/other:1"},
+		{Source: "unrecord:1", Backup: "gauravgahlot/unrecord:1"},
+		{Source: "gone-src:1", SourceDigest: digest("a5"), Backup: "gauravgahlot/gone-src:1"},
+		{Source: "missing:1", Backup: "gauravgahlot/missing:1"},
+		{Source: "no-layer:1", Backup: "gauravgahlot/no-layer:1"},
+		{Source: "corrupt:1", Backup: "gauravgahlot/corrupt:1"},
+		{Source: "denied:1", Backup: "gauravgahlot/denied:1"},
+	}
+
+	v := NewVerifier(reg)
+	report := v.Verify(context.Background(), entries)
+
+	type result struct {
+		status Status
+		source SourceMatch
+	}
+	want := map[string]result{
+		"same:1":     {Verified, Match},
+		"index:1":    {Verified, Match},
+		"other:1":    {Verified, Mismatch},
+		"unrecord:1": {Verified, Unknown},
+		"gone-src:1": {Verified, Unknown},
+		"missing:1":  {Missing, Unknown},
+		"no-layer:1": {Missing, Unknown},
+		"corrupt:1":  {Corrupt, Unknown},
+		"denied:1":   {Unverified, Unknown},
+	}
+	for _, r := range report.Results {
+		assert.Equal(t, want[r.Entry.Source], result{r.Status, r.Source}, r.Entry.Source)
+	}
+	assert.Equal(t, 5, report.Failed())
+	assert.Equal(t, 3, report.Results[0].Blobs)
+	assert.Equal(t, report, v.Last())
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.VerifiedBackups.WithLabelValues(string(Verified), string(Match))))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.VerifyFailure.WithLabelValues("gauravgahlot/corrupt:1", string(Corrupt), string(Unknown))))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.VerifiedBackups.WithLabelValues(string(Unverified), string(Unknown))))
+	assert.Equal(t, 4, testutil.CollectAndCount(metrics.VerifyFailure))
+
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/verify", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var served Report
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served))
+	assert.Len(t, served.Results, len(entries))
+	assert.Equal(t, "gauravgahlot/same:1", served.Results[0].Backup)
+}
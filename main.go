@@ -15,18 +15,61 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	klog "k8s.io/klog/v2"
 
+	"github.com/gauravgahlot/image-cloner/internal/audit"
+	"github.com/gauravgahlot/image-cloner/internal/gc"
+	"github.com/gauravgahlot/image-cloner/internal/kube"
 	"github.com/gauravgahlot/image-cloner/internal/server"
+	"github.com/gauravgahlot/image-cloner/internal/tracing"
 )
 
+// spanFlushTimeout bounds how long the spans not yet exported are flushed
+// for on exit.
+const spanFlushTimeout = 5 * time.Second
+
 var (
-	certFile string
-	keyFile  string
-	port     int
+	certFile      string
+	keyFile       string
+	port          int
+	workloadsFile string
+	notifiersFile string
+	pinDigest     bool
+	tagConflict   string
+
+	keepLocalImages bool
+	sweepInterval   time.Duration
+	sweepThreshold  string
+	auditOptions    audit.Options
+	auditMaxSize    string
+
+	mode             string
+	cluster          workloadFlags
+	workers          int
+	leaseNamespace   string
+	backfillInterval time.Duration
+	gcInterval       time.Duration
+	gcOptions        gc.Options
+	upstreamInterval time.Duration
+	resyncInterval   time.Duration
+	resyncTags       []string
+	resyncPolicy     string
+	verifyInterval   time.Duration
+	recordEvents     bool
+	apiPort          int
+	apiTokenFile     string
+	metricsPort      int
+	logFormat        string
+	traceOptions     tracing.Options
 )
 
 func init() {
@@ -36,26 +79,215 @@ func init() {
 		"file containing the private key matching --tls-cert-file.")
 	flag.IntVar(&port, "port", 443,
 		"secure port that the webhook listens on")
+	flag.StringVar(&workloadsFile, "workloads-config", "",
+		"file registering additional kinds and the JSON pointers to their images, in webhook mode.")
+	flag.StringVar(&notifiersFile, "notifiers-config", "",
+		"file configuring the receivers the outcome of the clones and upstream checks is sent to.")
+	cloneFlags(flag.CommandLine)
+	logFlag(flag.CommandLine)
+
+	flag.StringVar(&mode, "mode", "webhook",
+		"webhook to admit workloads, or controller to watch them where mutating webhooks are not allowed.")
+	flag.StringVar(&cluster.kubeconfig, "kubeconfig", "",
+		"path to the kubeconfig file; the in-cluster configuration is used if empty.")
+	flag.StringVar(&cluster.namespace, "namespace", "",
+		"namespace of the workloads the controller watches; all namespaces if empty.")
+	flag.StringVar(&cluster.selector, "selector", "",
+		"label selector of the workloads the controller watches.")
+	flag.IntVar(&workers, "workers", 2,
+		"number of workloads the controller clones at a time.")
+	leaseFlag(flag.CommandLine)
+	flag.DurationVar(&backfillInterval, "backfill-interval", 0,
+		"how often the leader backfills workloads not using the backup registry; never if 0. Requires --lease-namespace.")
+	flag.DurationVar(&gcInterval, "gc-interval", 0,
+		"how often the leader deletes unused backups; never if 0. Requires --lease-namespace.")
+	gcFlags(flag.CommandLine, "gc-", &gcOptions)
+	flag.DurationVar(&upstreamInterval, "upstream-check-interval", 0,
+		"how often the leader checks that the sources of the backups still exist; never if 0. Requires --lease-namespace.")
+	flag.DurationVar(&resyncInterval, "resync-interval", 0,
+		"how often the leader re-resolves the tags of the original images and copies the images they moved to; never if 0. Requires --lease-namespace.")
+	flag.Var((*listFlag)(&resyncTags), "resync-tag",
+		"pattern of the tags to resync, such as latest; may be repeated or comma-separated. All tags if empty.")
+	flag.StringVar(&resyncPolicy, "resync-policy", string(server.ResyncBackup),
+		"what a resync does to workloads, unless their namespace sets the image-cloner.io/resync annotation: off, backup or rollout.")
+	flag.DurationVar(&verifyInterval, "verify-interval", 0,
+		"how often the leader checks the integrity of the backups used by the workloads; never if 0. Requires --lease-namespace.")
+	flag.BoolVar(&recordEvents, "record-events", false,
+		"record the outcome of the clones as Events on the admitted workloads, or their namespace when they are created; always on with --lease-namespace.")
+	flag.IntVar(&apiPort, "api-port", 0,
+		"HTTPS port serving the API listing the clones and running them on demand; disabled if 0. Requires --api-token-file.")
+	flag.StringVar(&apiTokenFile, "api-token-file", "",
+		"file containing the bearer tokens accepted by the API, one per line.")
+	flag.IntVar(&metricsPort, "metrics-port", 0,
+		"plain HTTP port serving the Prometheus metrics at /metrics; disabled if 0.")
+	flag.StringVar(&traceOptions.Endpoint, "otlp-endpoint", "",
+		"host and port of the OTLP/HTTP receiver the spans of admissions and clones are exported to, such as otel-collector:4318; disabled if empty.")
+	flag.BoolVar(&traceOptions.Insecure, "otlp-insecure", false,
+		"export the spans over plain HTTP instead of HTTPS.")
+	flag.StringVar(&auditOptions.Path, "audit-log", "",
+		"file the decisions of the webhook on the images it admits are appended to as JSON lines; disabled if empty.")
+	flag.StringVar(&auditMaxSize, "audit-log-max-size", "100Mi",
+		"size above which the audit log is rotated.")
+	flag.IntVar(&auditOptions.MaxBackups, "audit-log-max-backups", audit.DefaultMaxBackups,
+		"number of rotated audit logs kept.")
+	flag.BoolVar(&auditOptions.HashChain, "audit-log-hash-chain", false,
+		"chain each audit record to the previous one by its hash, so that tampering is detected by the audit subcommand.")
+	flag.DurationVar(&sweepInterval, "sweep-interval", 10*time.Minute,
+		"how often the images that could not be removed once pushed are removed again; never if 0.")
+	flag.StringVar(&sweepThreshold, "sweep-threshold", "10Gi",
+		"size of the image layers in the local Docker daemon above which the sweep removes images.")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "revert":
+			runRevert(os.Args[2:])
+			return
+		case "backfill":
+			runBackfill(os.Args[2:])
+			return
+		case "gc":
+			runGC(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		}
+	}
+
 	klog.InitFlags(nil)
 	flag.Parse()
+	setupLogging()
+
+	threshold, err := resource.ParseQuantity(sweepThreshold)
+	if err != nil {
+		fatal(err, "Invalid sweep threshold", "threshold", sweepThreshold)
+	}
+
+	auditSize, err := resource.ParseQuantity(auditMaxSize)
+	if err != nil {
+		fatal(err, "Invalid audit log size", "size", auditMaxSize)
+	}
+	auditOptions.MaxSize = auditSize.Value()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdown, err := tracing.Setup(context.Background(), traceOptions)
+	if err != nil {
+		fatal(err, "Failed to set up tracing")
+	}
+	// The spans are flushed once the server or the controller stops on a
+	// signal, or fails; fatal exits without running deferred calls.
+	flushSpans := func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), spanFlushTimeout)
+		defer cancel()
+		if err := shutdown(flushCtx); err != nil {
+			klog.ErrorS(err, "Failed to flush spans")
+		}
+	}
+
+	switch mode {
+	case "webhook":
+	case "controller":
+		err := runController(ctx, threshold.Value())
+		flushSpans()
+		if err != nil {
+			fatal(err, "Controller failed")
+		}
+		return
+	default:
+		fatal(nil, "Invalid mode, must be webhook or controller", "mode", mode)
+	}
 
 	c := server.Config{
 		CertFile: certFile,
 		KeyFile:  keyFile,
 		Addr:     fmt.Sprintf(":%d", port),
+
+		WorkloadsFile: workloadsFile,
+		NotifiersFile: notifiersFile,
+		PinDigest:     pinDigest,
+		TagConflict:   tagConflict,
+		Audit:         auditOptions,
+
+		KeepLocalImages: keepLocalImages,
+		SweepInterval:   sweepInterval,
+		SweepThreshold:  threshold.Value(),
+
+		LeaseNamespace:   leaseNamespace,
+		Kubeconfig:       cluster.kubeconfig,
+		RecordEvents:     recordEvents,
+		BackfillInterval: backfillInterval,
+		GCInterval:       gcInterval,
+		GC:               gcOptions,
+		UpstreamInterval: upstreamInterval,
+		ResyncInterval:   resyncInterval,
+		ResyncTags:       resyncTags,
+		ResyncPolicy:     resyncPolicy,
+		VerifyInterval:   verifyInterval,
+
+		APITokenFile: apiTokenFile,
+	}
+	if apiPort != 0 {
+		c.APIAddr = fmt.Sprintf(":%d", apiPort)
+	}
+	if metricsPort != 0 {
+		c.MetricsAddr = fmt.Sprintf(":%d", metricsPort)
 	}
 
 	server, err := server.Setup(c)
 	if err != nil {
-		klog.Fatalf("[error]: %v", err)
+		flushSpans()
+		fatal(err, "Failed to set up the server")
+	}
+
+	klog.InfoS("Server listening", "addr", c.Addr)
+	err = server.Serve(ctx)
+	flushSpans()
+	if err != nil {
+		fatal(err, "Server stopped")
 	}
+}
 
-	klog.Info("[info] server listening at: ", c.Addr)
-	err = server.Serve()
+// runController runs the controller until ctx is done.
+func runController(ctx context.Context, threshold int64) error {
+	cs, err := kube.NewClient(cluster.kubeconfig)
 	if err != nil {
-		klog.Fatalf("[error]: %v", err)
+		return fmt.Errorf("failed to create the Kubernetes client: %v", err)
+	}
+
+	// The controller always elects a leader, so it needs a namespace for
+	// its Lease even when none is given.
+	if leaseNamespace == "" {
+		leaseNamespace = "default"
+	}
+
+	c := server.Config{
+		WorkloadsFile:  workloadsFile,
+		NotifiersFile:  notifiersFile,
+		PinDigest:      pinDigest,
+		TagConflict:    tagConflict,
+		LeaseNamespace: leaseNamespace,
+
+		KeepLocalImages: keepLocalImages,
+		SweepInterval:   sweepInterval,
+		SweepThreshold:  threshold,
+	}
+	if metricsPort != 0 {
+		c.MetricsAddr = fmt.Sprintf(":%d", metricsPort)
 	}
+	return server.RunController(ctx, c, cs, server.ControllerOptions{
+		Namespace: cluster.namespace,
+		Selector:  cluster.selector,
+		Workers:   workers,
+		LeaderElection: kube.LeaderElection{
+			Name:      "image-cloner-controller",
+			Namespace: leaseNamespace,
+		},
+	})
 }
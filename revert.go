@@ -0,0 +1,93 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/revert"
+	"github.com/gauravgahlot/image-cloner/internal/server"
+)
+
+// runRevert restores the original images of the workloads mutated by the
+// webhook. The webhook must be unregistered first, or it clones the
+// restored images again.
+func runRevert(args []string) {
+	var f workloadFlags
+	fs := flag.NewFlagSet("revert", flag.ExitOnError)
+	f.register(fs, "revert")
+	logFlag(fs)
+	klog.InitFlags(fs)
+	_ = fs.Parse(args)
+	setupLogging()
+
+	cs, err := kube.NewClient(f.kubeconfig)
+	if err != nil {
+		fatal(err, "Failed to create the Kubernetes client")
+	}
+
+	dyn, err := kube.NewDynamicClient(f.kubeconfig)
+	if err != nil {
+		fatal(err, "Failed to create the Kubernetes client")
+	}
+
+	kinds, err := server.RegisteredKinds(f.workloadsFile)
+	if err != nil {
+		fatal(err, "Failed to load the workloads config")
+	}
+
+	results, err := revert.Run(context.Background(), cs, dyn, revert.Options{
+		Kinds:     kinds,
+		Namespace: f.namespace,
+		Selector:  f.selector,
+		DryRun:    f.dryRun,
+	})
+	if err != nil {
+		fatal(err, "Revert failed")
+	}
+
+	suffix := ""
+	if f.dryRun {
+		suffix = " (dry run)"
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			klog.ErrorS(r.Err, "Failed to revert workload", "kind", r.Kind, "namespace", r.Namespace, "name", r.Name)
+			failed++
+			continue
+		}
+
+		images := []string{}
+		for name, image := range r.Images {
+			images = append(images, fmt.Sprintf("%s=%s", name, image))
+		}
+		sort.Strings(images)
+		fmt.Printf("%s %s/%s reverted%s: %s\n", r.Kind, r.Namespace, r.Name, suffix, strings.Join(images, ", "))
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
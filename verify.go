@@ -0,0 +1,60 @@
+// Copyright 2021 The image-cloner Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	klog "k8s.io/klog/v2"
+
+	"github.com/gauravgahlot/image-cloner/internal/kube"
+	"github.com/gauravgahlot/image-cloner/internal/server"
+)
+
+// runVerify checks the integrity of the backups used by the workloads, and
+// prints the report as JSON.
+func runVerify(args []string) {
+	var kubeconfig string
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.StringVar(&kubeconfig, "kubeconfig", "",
+		"path to the kubeconfig file; the in-cluster configuration is used if empty.")
+	logFlag(fs)
+	klog.InitFlags(fs)
+	_ = fs.Parse(args)
+	setupLogging()
+
+	cs, err := kube.NewClient(kubeconfig)
+	if err != nil {
+		fatal(err, "Failed to create the Kubernetes client")
+	}
+
+	report, err := server.Verify(context.Background(), server.Config{}, cs)
+	if err != nil {
+		fatal(err, "Backup verification failed")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		fatal(err, "Failed to print the report")
+	}
+
+	if report.Failed() > 0 {
+		os.Exit(1)
+	}
+}